@@ -10,6 +10,10 @@ func GetMarketOrderbookSnapshotV2Key(marketID string) string {
 	return fmt.Sprintf("HYDRO_MARKET_ORDERBOOK_SNAPSHOT_V2:%s", marketID)
 }
 
+func GetMarketOrderbookAggregatedSnapshotV2Key(marketID string, tickSize string, maxDepth int) string {
+	return fmt.Sprintf("HYDRO_MARKET_ORDERBOOK_SNAPSHOT_V2:%s:%s:%d", marketID, tickSize, maxDepth)
+}
+
 // queue key
 const HYDRO_WEBSOCKET_MESSAGES_QUEUE_KEY = "HYDRO_WEBSOCKET_MESSAGES_QUEUE_KEY"
 const HYDRO_ENGINE_EVENTS_QUEUE_KEY = "HYDRO_ENGINE_EVENTS_QUEUE_KEY"
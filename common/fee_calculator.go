@@ -0,0 +1,126 @@
+package common
+
+import (
+	"github.com/HydroProtocol/hydro-sdk-backend/sdk"
+	"github.com/shopspring/decimal"
+)
+
+// rate bases of the Hydro contract: fee rates in order data are in sdk.FeeRateBase, the HOT discount
+// is in DiscountRateBase and the maker rebate is a share of the taker fee in RebateRateBase
+const (
+	DiscountRateBase = 100
+	RebateRateBase   = 100
+)
+
+// HotFeeDiscounter returns the fee discount of a trader by the HOT it holds, 1 means no discount.
+// sdk.BlockChain implements it.
+type HotFeeDiscounter interface {
+	GetHotFeeDiscount(address string) decimal.Decimal
+}
+
+// MatchFee is what a match costs the maker and the taker in quote token
+type MatchFee struct {
+	MakerFee    decimal.Decimal `json:"makerFee"`
+	TakerFee    decimal.Decimal `json:"takerFee"`
+	MakerRebate decimal.Decimal `json:"makerRebate"`
+	MakerGasFee decimal.Decimal `json:"makerGasFee"`
+	TakerGasFee decimal.Decimal `json:"takerGasFee"`
+}
+
+// FeeCalculator calculates the fees of matches the same way the contract settles them:
+// rates are truncated to their raw integer values, amounts to the quote token decimals,
+// and every fee is rounded down.
+type FeeCalculator struct {
+	discounter HotFeeDiscounter
+}
+
+// NewFeeCalculator creates a calculator, traders get no discount if discounter is nil
+func NewFeeCalculator(discounter HotFeeDiscounter) *FeeCalculator {
+	return &FeeCalculator{discounter: discounter}
+}
+
+// Calculate sets the Fee of every match item of the result, canceled matches have zero fees.
+//
+// A maker order with a rebate pays no maker fee and gets MakerRebateRate of the taker fee, capped at
+// the taker fee. Every order pays its gas fee once, the taker its TakerGasFeeAmount with its first match
+// and the maker its MakerGasFeeAmount, which is zero if it is paid by an earlier match.
+func (c *FeeCalculator) Calculate(matchResult *MatchResult, quoteTokenDecimals int) {
+	discounts := make(map[string]decimal.Decimal)
+	takerGasFeePaid := false
+
+	for _, item := range matchResult.MatchItems {
+		fee := &MatchFee{}
+		item.Fee = fee
+
+		if item.MatchShouldBeCanceled || !item.MatchedAmount.IsPositive() {
+			continue
+		}
+
+		quoteAmount := toRawAmount(item.MatchedAmount.Mul(item.Price()), quoteTokenDecimals)
+
+		takerFeeRate := rawRate(matchResult.TakerOrder.TakerFeeRate, sdk.FeeRateBase)
+		takerFee := feeOf(quoteAmount, takerFeeRate, c.discount(discounts, matchResult.TakerOrder.Trader))
+		fee.TakerFee = fromRawAmount(takerFee, quoteTokenDecimals)
+
+		rebateRate := decimal.Min(rawRate(item.MakerOrder.MakerRebateRate, RebateRateBase), decimal.New(RebateRateBase, 0))
+
+		if rebateRate.IsPositive() {
+			rebate := takerFee.Mul(rebateRate).Div(decimal.New(RebateRateBase, 0)).Floor()
+			fee.MakerRebate = fromRawAmount(rebate, quoteTokenDecimals)
+		} else {
+			makerFeeRate := rawRate(item.MakerOrder.MakerFeeRate, sdk.FeeRateBase)
+			makerFee := feeOf(quoteAmount, makerFeeRate, c.discount(discounts, item.MakerOrder.Trader))
+			fee.MakerFee = fromRawAmount(makerFee, quoteTokenDecimals)
+		}
+
+		if !takerGasFeePaid {
+			fee.TakerGasFee = matchResult.TakerGasFeeAmount
+			takerGasFeePaid = true
+		}
+
+		fee.MakerGasFee = item.MakerGasFeeAmount
+	}
+}
+
+// discount returns the raw discount rate of trader, looked up once per trader
+func (c *FeeCalculator) discount(discounts map[string]decimal.Decimal, trader string) decimal.Decimal {
+	if discount, exist := discounts[trader]; exist {
+		return discount
+	}
+
+	discount := decimal.New(DiscountRateBase, 0)
+	if c.discounter != nil {
+		discount = rawRate(c.discounter.GetHotFeeDiscount(trader), DiscountRateBase)
+	}
+
+	discounts[trader] = discount
+
+	return discount
+}
+
+func feeOf(rawQuoteAmount, rawFeeRate, rawDiscount decimal.Decimal) decimal.Decimal {
+	return rawQuoteAmount.Mul(rawFeeRate).Mul(rawDiscount).Div(decimal.New(sdk.FeeRateBase*DiscountRateBase, 0)).Floor()
+}
+
+func rawRate(rate decimal.Decimal, base int64) decimal.Decimal {
+	return rate.Mul(decimal.New(base, 0)).Floor()
+}
+
+func toRawAmount(amount decimal.Decimal, decimals int) decimal.Decimal {
+	return amount.Shift(int32(decimals)).Floor()
+}
+
+func fromRawAmount(amount decimal.Decimal, decimals int) decimal.Decimal {
+	return amount.Shift(-int32(decimals))
+}
+
+// TotalMakerRebate returns the sum of the maker rebates calculated by FeeCalculator
+func (matchResult *MatchResult) TotalMakerRebate() (sum decimal.Decimal) {
+	for _, item := range matchResult.MatchItems {
+		if item.Fee != nil {
+			sum = sum.Add(item.Fee.MakerRebate)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// Matcher decides how the amount a taker takes from a price level is shared by the orders in it.
+type Matcher interface {
+	// Allocate returns the amount allocated to each of orders, in the same sequence.
+	// orders are in time priority, available is the amount each order offers,
+	// takeAmount is less than the sum of available. The allocations must add up to takeAmount.
+	Allocate(orders []*MemoryOrder, available []decimal.Decimal, takeAmount decimal.Decimal, marketAmountDecimals int) []decimal.Decimal
+
+	// IsTimePriority reports whether an order only gets an allocation after all orders ahead of it are filled.
+	// If true, orders behind the ones filling the taker are not visited, e.g. for self trade prevention.
+	IsTimePriority() bool
+}
+
+// FIFOMatcher fills orders of a price level one by one in time priority
+type FIFOMatcher struct{}
+
+func (m *FIFOMatcher) IsTimePriority() bool {
+	return true
+}
+
+func (m *FIFOMatcher) Allocate(orders []*MemoryOrder, available []decimal.Decimal, takeAmount decimal.Decimal, marketAmountDecimals int) []decimal.Decimal {
+	allocations := make([]decimal.Decimal, len(orders))
+
+	for i := range orders {
+		allocations[i] = decimal.Min(available[i], takeAmount)
+		takeAmount = takeAmount.Sub(allocations[i])
+	}
+
+	return allocations
+}
+
+// ProRataMatcher shares the taken amount of a price level in proportion to the amount of every order.
+//
+// Allocations are rounded down to marketAmountDecimals, an allocation less than MinAllocation becomes zero.
+// The rest left by rounding is allocated to orders in time priority.
+type ProRataMatcher struct {
+	MinAllocation decimal.Decimal
+}
+
+func (m *ProRataMatcher) IsTimePriority() bool {
+	return false
+}
+
+func (m *ProRataMatcher) Allocate(orders []*MemoryOrder, available []decimal.Decimal, takeAmount decimal.Decimal, marketAmountDecimals int) []decimal.Decimal {
+	allocations := make([]decimal.Decimal, len(orders))
+
+	totalAvailable := decimal.Zero
+	for i := range orders {
+		totalAvailable = totalAvailable.Add(available[i])
+	}
+
+	leftAmount := takeAmount
+
+	for i := range orders {
+		allocation := takeAmount.Mul(available[i]).Div(totalAvailable).Truncate(int32(marketAmountDecimals))
+		allocation = decimal.Min(allocation, available[i], leftAmount)
+
+		if allocation.LessThan(m.MinAllocation) {
+			allocation = decimal.Zero
+		}
+
+		allocations[i] = allocation
+		leftAmount = leftAmount.Sub(allocation)
+	}
+
+	for i := range orders {
+		if leftAmount.LessThanOrEqual(decimal.Zero) {
+			break
+		}
+
+		extra := decimal.Min(available[i].Sub(allocations[i]), leftAmount)
+		allocations[i] = allocations[i].Add(extra)
+		leftAmount = leftAmount.Sub(extra)
+	}
+
+	return allocations
+}
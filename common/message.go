@@ -14,6 +14,16 @@ const WsTypeTradeChange = "tradeChange"
 const WsTypeLockedBalanceChange = "lockedBalanceChange"
 
 const WsTypeNewMarketTrade = "newMarketTrade"
+const WsTypeAuctionIndicative = "auctionIndicative"
+const WsTypeMarketStatus = "marketStatus"
+
+// market status
+const (
+	MarketStatusTrading    = "trading"
+	MarketStatusHalted     = "halted"
+	MarketStatusClosed     = "closed"
+	MarketStatusCancelOnly = "cancelOnly"
+)
 
 //const MessageTypeAccount = "account"
 //const MessageTypeMarket = "market"
@@ -29,6 +39,35 @@ type WebsocketMarketOrderChangePayload struct {
 	Sequence uint64 `json:"sequence"`
 	Price    string `json:"price"`
 	Amount   string `json:"amount"`
+
+	// checksum of the orderbook after this change, see SnapshotChecksum
+	Checksum uint32 `json:"checksum"`
+}
+
+// WebsocketMarketL3OrderChangePayload is a per order change, Amount is the displayed amount of the order after the change
+type WebsocketMarketL3OrderChangePayload struct {
+	Action   string `json:"action"`
+	OrderID  string `json:"orderID"`
+	Side     string `json:"side"`
+	Sequence uint64 `json:"sequence"`
+	Price    string `json:"price"`
+	Amount   string `json:"amount"`
+}
+
+// WebsocketMarketAuctionPayload is the price and volume the market would open at if the auction ended now,
+// zeros if nothing would be executed
+type WebsocketMarketAuctionPayload struct {
+	Type   string `json:"type"`
+	Price  string `json:"price"`
+	Volume string `json:"volume"`
+}
+
+// WebsocketMarketStatusPayload announces a change of the market status,
+// Until is the unix time a halted market resumes at
+type WebsocketMarketStatusPayload struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Until  uint64 `json:"until,omitempty"`
 }
 
 type WebsocketLockedBalanceChangePayload struct {
@@ -72,11 +111,20 @@ type NewOrderEvent struct {
 	Order string `json:"order"`
 }
 
+// orders are canceled by ID, Price and Side are not needed by the engine
 type CancelOrderEvent struct {
 	Event
 	ID    string `json:"id"`
-	Price string `json:"price"`
-	Side  string `json:"side"`
+	Price string `json:"price,omitempty"`
+	Side  string `json:"side,omitempty"`
+}
+
+// a closed market rejects new orders, its orders are canceled if CancelOrders is true.
+// A cancel only market only accepts cancels. Both are reopened by EventOpenMarket.
+type CloseMarketEvent struct {
+	Event
+	CancelOrders bool `json:"cancelOrders"`
+	CancelOnly   bool `json:"cancelOnly"`
 }
 
 type ConfirmTransactionEvent struct {
@@ -89,6 +137,7 @@ type ConfirmTransactionEvent struct {
 // channel
 
 const MarketChannelPrefix = "Market"
+const MarketL3ChannelPrefix = "MarketL3"
 const AccountChannelPrefix = "TraderAddress"
 
 func GetAccountChannelID(address string) string {
@@ -99,17 +148,65 @@ func GetMarketChannelID(marketID string) string {
 	return fmt.Sprintf("%s#%s", MarketChannelPrefix, marketID)
 }
 
-func OrderBookChangeMessage(marketID string, sequence uint64, side string, price, amount decimal.Decimal) WebSocketMessage {
+func GetMarketL3ChannelID(marketID string) string {
+	return fmt.Sprintf("%s#%s", MarketL3ChannelPrefix, marketID)
+}
+
+func OrderBookChangeMessage(marketID string, sequence uint64, side string, price, amount decimal.Decimal, checksum uint32) WebSocketMessage {
 	payload := &WebsocketMarketOrderChangePayload{
 		Sequence: sequence,
 		Side:     side,
 		Price:    price.String(),
 		Amount:   amount.String(),
+		Checksum: checksum,
 	}
 
 	return marketChannelMessage(marketID, payload)
 }
 
+func AuctionIndicativeMessage(marketID string, price, volume decimal.Decimal) WebSocketMessage {
+	payload := &WebsocketMarketAuctionPayload{
+		Type:   WsTypeAuctionIndicative,
+		Price:  price.String(),
+		Volume: volume.String(),
+	}
+
+	return marketChannelMessage(marketID, payload)
+}
+
+func NewMarketTradeMessage(trade *Trade) WebSocketMessage {
+	payload := &WebsocketMarketNewMarketTradePayload{
+		Type:  WsTypeNewMarketTrade,
+		Trade: trade,
+	}
+
+	return marketChannelMessage(trade.MarketID, payload)
+}
+
+func MarketStatusMessage(marketID, status string, until uint64) WebSocketMessage {
+	payload := &WebsocketMarketStatusPayload{
+		Type:   WsTypeMarketStatus,
+		Status: status,
+		Until:  until,
+	}
+
+	return marketChannelMessage(marketID, payload)
+}
+
+func OrderBookL3ChangeMessage(marketID string, sequence uint64, event *OrderbookEvent) WebSocketMessage {
+	return WebSocketMessage{
+		ChannelID: GetMarketL3ChannelID(marketID),
+		Payload: &WebsocketMarketL3OrderChangePayload{
+			Action:   event.Action,
+			OrderID:  event.OrderID,
+			Side:     event.Side,
+			Sequence: sequence,
+			Price:    event.Price.String(),
+			Amount:   event.OrderAmount.String(),
+		},
+	}
+}
+
 func marketChannelMessage(marketID string, payload interface{}) WebSocketMessage {
 	return WebSocketMessage{
 		//MessageType: MessageTypeMarket,
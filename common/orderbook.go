@@ -7,6 +7,7 @@ import (
 	"github.com/labstack/gommon/log"
 	"github.com/petar/GoLLRB/llrb"
 	"github.com/shopspring/decimal"
+	"hash/crc32"
 	"strings"
 	"sync"
 	"time"
@@ -17,8 +18,25 @@ type OrderbookEvent struct {
 	OrderID string
 	Price   decimal.Decimal
 	Amount  decimal.Decimal
+
+	// for per order (L3) feeds, OrderAmount is the displayed amount of the order after this event
+	Action      string
+	OrderAmount decimal.Decimal
+
+	// checksum of the book after this event
+	Checksum uint32
 }
 
+// orderbook event actions
+const (
+	OrderbookEventAdd    = "add"
+	OrderbookEventChange = "change"
+	OrderbookEventRemove = "remove"
+
+	// the order moves to the end of its price level, e.g. an iceberg order is refilled
+	OrderbookEventRequeue = "requeue"
+)
+
 type OrderbookPlugin func(event *OrderbookEvent)
 
 type IOrderBook interface {
@@ -38,9 +56,34 @@ type (
 	MatchResult struct {
 		TakerOrder           *MemoryOrder
 		TakerOrderIsDone     bool
+		TakerOrderIsRejected bool
 		MatchItems           []*MatchItem
 		TakerOrderLeftAmount decimal.Decimal
 		OrderBookActivities  []WebSocketMessage
+
+		// why the taker order is rejected by the engine, nil if it is rejected by matching, e.g. a FOK order can't be filled
+		TakerOrderRejectReason error
+		// the taker order is an amended order which was in the orderbook, see Orderbook.AmendOrder
+		TakerOrderIsAmended bool
+		// the taker order is an order in the orderbook canceled without matching, e.g. by a mass cancel
+		TakerOrderIsCanceled bool
+
+		// maker orders canceled or decreased by self trade prevention
+		SelfTradeItems []*SelfTradeItem
+		// taker amount canceled by self trade prevention, same unit as TakerOrder.Amount
+		TakerOrderSelfTradeCanceledAmount decimal.Decimal
+
+		// expired maker orders which are removed instead of being matched
+		ExpiredOrders []*MemoryOrder
+
+		// matching stopped at a price level outside the price band of the book
+		PriceBandReached bool
+
+		// trades of the match items which are not canceled, built by the engine
+		Trades []*Trade
+
+		// gas fee of the taker order before the match, it is marked as paid if the rest of the order rests in the book
+		TakerGasFeeAmount decimal.Decimal
 	}
 
 	MatchItem struct {
@@ -48,6 +91,21 @@ type (
 		MakerOrderIsDone      bool
 		MatchedAmount         decimal.Decimal
 		MatchShouldBeCanceled bool
+
+		// the price of the match if it is not the price of the maker order, e.g. an auction uncross
+		MatchedPrice decimal.Decimal
+
+		// gas fee the maker order pays with this match, saved before the order is marked as paid
+		MakerGasFeeAmount decimal.Decimal
+
+		// set by FeeCalculator.Calculate
+		Fee *MatchFee
+	}
+
+	SelfTradeItem struct {
+		MakerOrder       *MemoryOrder
+		MakerOrderIsDone bool
+		CanceledAmount   decimal.Decimal
 	}
 
 	MemoryOrder struct {
@@ -61,13 +119,47 @@ type (
 		GasFeeAmount decimal.Decimal `json:"gasFeeAmount"`
 		MakerFeeRate decimal.Decimal `json:"makerFeeRate"`
 		TakerFeeRate decimal.Decimal `json:"takerFeeRate"`
+		// share of the taker fee paid to the maker instead of the maker fee, e.g. 0.5 for half, see FeeCalculator.
+		// Unlike the fee rates, the contract reads it in units of 1/RebateRateBase.
+		MakerRebateRate decimal.Decimal `json:"makerRebateRate"`
+		TimeInForce     string          `json:"timeInForce"`
+		IsMakerOnly     bool            `json:"isMakerOnly"`
+		StopPrice       decimal.Decimal `json:"stopPrice"`
+		ExpiredAt       uint64          `json:"expiredAt"`
+
+		// an iceberg order only shows DisplayAmount in the orderbook, the rest is hidden
+		DisplayAmount decimal.Decimal `json:"displayAmount"`
+
+		// the Amount of a market buy order is in quote token unless AmountInBase is true,
+		// a market buy order in base token spends at most QuoteAmountLimit if it is positive
+		AmountInBase     bool            `json:"amountInBase"`
+		QuoteAmountLimit decimal.Decimal `json:"quoteAmountLimit"`
+
+		// managed by priceLevel for iceberg orders
+		visibleAmount decimal.Decimal
+		hiddenAmount  decimal.Decimal
 	}
 
 	SnapshotV2 struct {
 		Sequence uint64      `json:"sequence"`
+		Checksum uint32      `json:"checksum"`
 		Bids     [][2]string `json:"bids"`
 		Asks     [][2]string `json:"asks"`
 	}
+
+	SnapshotL3 struct {
+		Sequence uint64             `json:"sequence"`
+		Bids     []*SnapshotL3Order `json:"bids"`
+		Asks     []*SnapshotL3Order `json:"asks"`
+	}
+
+	// Position is the queue position of the order in its price level, starts from 0
+	SnapshotL3Order struct {
+		ID       string `json:"id"`
+		Price    string `json:"price"`
+		Amount   string `json:"amount"`
+		Position int    `json:"position"`
+	}
 )
 
 func (order *MemoryOrder) QuoteTokenSymbol() string {
@@ -88,10 +180,102 @@ func (order *MemoryOrder) BaseTokenSymbol() string {
 	}
 }
 
+// time in force
+// an empty TimeInForce is treated as GTC
+const (
+	TimeInForceGTC = "GTC"
+	TimeInForceIOC = "IOC"
+	TimeInForceFOK = "FOK"
+)
+
+// self trade prevention modes
+// an empty mode means self trade is allowed
+const (
+	SelfTradePreventionCancelNewest       = "cancel_newest"
+	SelfTradePreventionCancelOldest       = "cancel_oldest"
+	SelfTradePreventionCancelBoth         = "cancel_both"
+	SelfTradePreventionDecrementAndCancel = "decrement_and_cancel"
+)
+
+func IsValidSelfTradePrevention(mode string) bool {
+	switch mode {
+	case "", SelfTradePreventionCancelNewest, SelfTradePreventionCancelOldest, SelfTradePreventionCancelBoth, SelfTradePreventionDecrementAndCancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsQuoteAmountMarketBuy reports whether the Amount of the order is in quote token
+func (order *MemoryOrder) IsQuoteAmountMarketBuy() bool {
+	return order.Type == "market" && order.Side == "buy" && !order.AmountInBase
+}
+
+// CanRestInBook returns false for orders whose unfilled amount must not stay on the orderbook
+func (order *MemoryOrder) CanRestInBook() bool {
+	return order.TimeInForce != TimeInForceIOC && order.TimeInForce != TimeInForceFOK
+}
+
+// IsStopOrder returns true if the order waits for the last trade price to reach its StopPrice
+// a stop market order has type market, a stop limit order has type limit
+func (order *MemoryOrder) IsStopOrder() bool {
+	return order.StopPrice.IsPositive()
+}
+
+// IsExpiredAt returns true if the order is expired at ts (unix seconds)
+// an order without ExpiredAt never expires
+func (order *MemoryOrder) IsExpiredAt(ts uint64) bool {
+	return order.ExpiredAt > 0 && ts >= order.ExpiredAt
+}
+
+func (order *MemoryOrder) IsIceberg() bool {
+	return order.DisplayAmount.IsPositive()
+}
+
+// DisplayedAmount is the amount shown in the orderbook
+func (order *MemoryOrder) DisplayedAmount() decimal.Decimal {
+	if order.IsIceberg() {
+		return order.visibleAmount
+	}
+
+	return order.Amount
+}
+
+// HiddenAmount is the reserve of an iceberg order which is not shown in the orderbook
+func (order *MemoryOrder) HiddenAmount() decimal.Decimal {
+	if order.IsIceberg() {
+		return order.hiddenAmount
+	}
+
+	return decimal.Zero
+}
+
+// LastMatchedPrice returns the price of the last executed match, zero if nothing is executed
+func (matchResult *MatchResult) LastMatchedPrice() decimal.Decimal {
+	for i := len(matchResult.MatchItems) - 1; i >= 0; i-- {
+		item := matchResult.MatchItems[i]
+
+		if !item.MatchShouldBeCanceled && item.MatchedAmount.IsPositive() {
+			return item.Price()
+		}
+	}
+
+	return decimal.Zero
+}
+
+// Price returns the price the match is settled at
+func (item *MatchItem) Price() decimal.Decimal {
+	if item.MatchedPrice.IsPositive() {
+		return item.MatchedPrice
+	}
+
+	return item.MakerOrder.Price
+}
+
 func (matchResult *MatchResult) QuoteTokenTotalMatchedAmt() decimal.Decimal {
 	quoteTokenAmt := decimal.Zero
 	for _, item := range matchResult.MatchItems {
-		quoteTokenAmt = quoteTokenAmt.Add(item.MatchedAmount.Mul(item.MakerOrder.Price))
+		quoteTokenAmt = quoteTokenAmt.Add(item.MatchedAmount.Mul(item.Price()))
 	}
 
 	return quoteTokenAmt
@@ -103,7 +287,7 @@ func (matchResult *MatchResult) TakerTradeFeeInQuoteToken() decimal.Decimal {
 
 func (matchResult *MatchResult) MakerTradeFeeInQuoteToken() (sum decimal.Decimal) {
 	for _, item := range matchResult.MatchItems {
-		sum = sum.Add(item.MatchedAmount.Mul(item.MakerOrder.Price).Mul(item.MakerOrder.MakerFeeRate))
+		sum = sum.Add(item.MatchedAmount.Mul(item.Price()).Mul(item.MakerOrder.MakerFeeRate))
 	}
 
 	return
@@ -129,6 +313,14 @@ func (matchResult *MatchResult) SumOfGasOfMakerOrders() decimal.Decimal {
 	return sum
 }
 
+func (matchResult MatchResult) ExistSelfTrade() bool {
+	return len(matchResult.SelfTradeItems) > 0 || matchResult.TakerOrderSelfTradeCanceledAmount.IsPositive()
+}
+
+func (matchResult MatchResult) ExistExpiredOrder() bool {
+	return len(matchResult.ExpiredOrders) > 0
+}
+
 func (matchResult MatchResult) ExistMatchToBeExecuted() bool {
 	for _, match := range matchResult.MatchItems {
 		if !match.MatchShouldBeCanceled {
@@ -157,18 +349,27 @@ func (p *priceLevel) Len() int {
 	return p.orderMap.Len()
 }
 
-func (p *priceLevel) InsertOrder(order *MemoryOrder) {
+// InsertOrder returns the displayed amount added to this priceLevel
+func (p *priceLevel) InsertOrder(order *MemoryOrder) decimal.Decimal {
 	log.Debug("InsertOrder:", order.ID)
 
 	if _, ok := p.orderMap.Get(order.ID); ok {
 		panic(fmt.Errorf("can't add order which is already in this priceLevel. priceLevel: %s, orderID: %s", p.price.String(), order.ID))
 	}
 
+	if order.IsIceberg() {
+		order.visibleAmount = decimal.Min(order.DisplayAmount, order.Amount)
+		order.hiddenAmount = order.Amount.Sub(order.visibleAmount)
+	}
+
 	p.orderMap.Set(order.ID, order)
-	p.totalAmount = p.totalAmount.Add(order.Amount)
+	p.totalAmount = p.totalAmount.Add(order.DisplayedAmount())
+
+	return order.DisplayedAmount()
 }
 
-func (p *priceLevel) RemoveOrder(o *MemoryOrder) {
+// RemoveOrder returns the displayed amount removed from this priceLevel
+func (p *priceLevel) RemoveOrder(o *MemoryOrder) decimal.Decimal {
 	orderItem, ok := p.orderMap.Get(o.ID)
 
 	if !ok {
@@ -177,7 +378,9 @@ func (p *priceLevel) RemoveOrder(o *MemoryOrder) {
 
 	order := orderItem.(*MemoryOrder)
 	p.orderMap.Delete(order.ID)
-	p.totalAmount = p.totalAmount.Sub(order.Amount)
+	p.totalAmount = p.totalAmount.Sub(order.DisplayedAmount())
+
+	return order.DisplayedAmount()
 }
 
 func (p *priceLevel) GetOrder(id string) (order *MemoryOrder, exist bool) {
@@ -189,14 +392,83 @@ func (p *priceLevel) GetOrder(id string) (order *MemoryOrder, exist bool) {
 	return orderItem.(*MemoryOrder), exist
 }
 
-func (p *priceLevel) ChangeOrder(o *MemoryOrder, changeAmount decimal.Decimal) {
-	_, ok := p.orderMap.Get(o.ID)
+// ChangeOrder returns the displayed amount changed in this priceLevel,
+// and whether the order is moved to the end of the queue
+//
+// An iceberg order consumes its visible amount first, then its hidden amount.
+// When the visible amount is used up, it is refilled from the hidden amount
+// and the order loses its time priority.
+func (p *priceLevel) ChangeOrder(o *MemoryOrder, changeAmount decimal.Decimal) (displayedChangeAmount decimal.Decimal, requeued bool) {
+	orderItem, ok := p.orderMap.Get(o.ID)
 
 	if !ok {
 		panic(fmt.Errorf("can't remove order which is not in this priceLevel. priceLevel: %s", p.price.String()))
 	}
 
-	p.totalAmount = p.totalAmount.Add(changeAmount)
+	order := orderItem.(*MemoryOrder)
+
+	if !order.IsIceberg() {
+		p.totalAmount = p.totalAmount.Add(changeAmount)
+		return changeAmount, false
+	}
+
+	oldVisibleAmount := order.visibleAmount
+
+	if changeAmount.IsNegative() {
+		reduceAmount := changeAmount.Neg()
+
+		if reduceAmount.LessThan(order.visibleAmount) {
+			order.visibleAmount = order.visibleAmount.Sub(reduceAmount)
+		} else {
+			order.hiddenAmount = order.hiddenAmount.Sub(reduceAmount.Sub(order.visibleAmount))
+			order.visibleAmount = decimal.Zero
+		}
+	} else {
+		order.hiddenAmount = order.hiddenAmount.Add(changeAmount)
+	}
+
+	if order.visibleAmount.LessThanOrEqual(decimal.Zero) && order.hiddenAmount.IsPositive() {
+		order.visibleAmount = decimal.Min(order.DisplayAmount, order.hiddenAmount)
+		order.hiddenAmount = order.hiddenAmount.Sub(order.visibleAmount)
+
+		// move to the end of the queue
+		p.orderMap.Delete(order.ID)
+		p.orderMap.Set(order.ID, order)
+		requeued = true
+	}
+
+	displayedChangeAmount = order.visibleAmount.Sub(oldVisibleAmount)
+	p.totalAmount = p.totalAmount.Add(displayedChangeAmount)
+
+	return displayedChangeAmount, requeued
+}
+
+// ReduceOrder returns the displayed amount changed in this priceLevel,
+// the order keeps its position in the queue. order.Amount is expected to be reduced already by the caller.
+//
+// The hidden amount of an iceberg order is reduced first.
+func (p *priceLevel) ReduceOrder(o *MemoryOrder, reduceAmount decimal.Decimal) decimal.Decimal {
+	orderItem, ok := p.orderMap.Get(o.ID)
+
+	if !ok {
+		panic(fmt.Errorf("can't reduce order which is not in this priceLevel. priceLevel: %s", p.price.String()))
+	}
+
+	order := orderItem.(*MemoryOrder)
+
+	if !order.IsIceberg() {
+		p.totalAmount = p.totalAmount.Sub(reduceAmount)
+		return reduceAmount.Neg()
+	}
+
+	hiddenReduceAmount := decimal.Min(order.hiddenAmount, reduceAmount)
+	order.hiddenAmount = order.hiddenAmount.Sub(hiddenReduceAmount)
+
+	visibleReduceAmount := reduceAmount.Sub(hiddenReduceAmount)
+	order.visibleAmount = order.visibleAmount.Sub(visibleReduceAmount)
+	p.totalAmount = p.totalAmount.Sub(visibleReduceAmount)
+
+	return visibleReduceAmount.Neg()
 }
 
 func (p *priceLevel) Less(item llrb.Item) bool {
@@ -208,11 +480,26 @@ func (p *priceLevel) Less(item llrb.Item) bool {
 type Orderbook struct {
 	market string
 
+	selfTradePrevention string
+
+	// decides how a price level is shared by takers, FIFO by default
+	matcher Matcher
+
+	// decides which orders are expired in matching
+	clock func() time.Time
+
+	// takers don't match price levels outside the band, zero means no bound
+	priceBandLower decimal.Decimal
+	priceBandUpper decimal.Decimal
+
 	plugins []OrderbookPlugin
 
 	bidsTree *llrb.LLRB
 	asksTree *llrb.LLRB
 
+	// all orders in the book by ID
+	orders map[string]*MemoryOrder
+
 	lock sync.RWMutex
 
 	Sequence uint64
@@ -223,8 +510,11 @@ func NewOrderbook(market string) *Orderbook {
 	book := &Orderbook{
 		plugins:  make([]OrderbookPlugin, 0, 3),
 		market:   market,
+		matcher:  &FIFOMatcher{},
+		clock:    time.Now,
 		bidsTree: llrb.New(),
 		asksTree: llrb.New(),
+		orders:   make(map[string]*MemoryOrder),
 	}
 
 	return book
@@ -238,6 +528,10 @@ func (book *Orderbook) SnapshotV2() *SnapshotV2 {
 
 	//utils.Debug("== cost in lock, Snapshot : %f", float64(time.Since(startTime))/1000000)
 
+	return book.snapshotV2()
+}
+
+func (book *Orderbook) snapshotV2() *SnapshotV2 {
 	bids := make([][2]string, 0, 0)
 	asks := make([][2]string, 0, 0)
 
@@ -275,6 +569,180 @@ func (book *Orderbook) SnapshotV2() *SnapshotV2 {
 	return res
 }
 
+// SnapshotL3 returns every order in the book, displayed amounts only
+func (book *Orderbook) SnapshotL3() *SnapshotL3 {
+	book.lock.RLock()
+	defer book.lock.RUnlock()
+
+	collect := func(orders []*SnapshotL3Order, pl *priceLevel) []*SnapshotL3Order {
+		position := 0
+
+		iter := pl.orderMap.IterFunc()
+		for kv, ok := iter(); ok; kv, ok = iter() {
+			order := kv.Value.(*MemoryOrder)
+
+			orders = append(orders, &SnapshotL3Order{
+				ID:       order.ID,
+				Price:    pl.price.String(),
+				Amount:   order.DisplayedAmount().String(),
+				Position: position,
+			})
+
+			position++
+		}
+
+		return orders
+	}
+
+	bids := make([]*SnapshotL3Order, 0, 0)
+	asks := make([]*SnapshotL3Order, 0, 0)
+
+	book.asksTree.AscendGreaterOrEqual(newPriceLevel(decimal.Zero), func(i llrb.Item) bool {
+		asks = collect(asks, i.(*priceLevel))
+		return true
+	})
+
+	book.bidsTree.DescendLessOrEqual(newPriceLevel(decimal.New(1, 99)), func(i llrb.Item) bool {
+		bids = collect(bids, i.(*priceLevel))
+		return true
+	})
+
+	return &SnapshotL3{
+		Bids: bids,
+		Asks: asks,
+	}
+}
+
+// Orders returns every order in the book, asks from the lowest price then bids from the highest price
+func (book *Orderbook) Orders() []*MemoryOrder {
+	book.lock.RLock()
+	defer book.lock.RUnlock()
+
+	orders := make([]*MemoryOrder, 0)
+
+	collect := func(i llrb.Item) bool {
+		iter := i.(*priceLevel).orderMap.IterFunc()
+		for kv, ok := iter(); ok; kv, ok = iter() {
+			orders = append(orders, kv.Value.(*MemoryOrder))
+		}
+
+		return true
+	}
+
+	book.asksTree.AscendGreaterOrEqual(newPriceLevel(decimal.Zero), collect)
+	book.bidsTree.DescendLessOrEqual(newPriceLevel(decimal.New(1, 99)), collect)
+
+	return orders
+}
+
+// OrderbookChecksumDepth is the number of price levels on each side covered by the checksum
+const OrderbookChecksumDepth = 25
+
+// SnapshotChecksum is the CRC32 (IEEE) of the top OrderbookChecksumDepth levels of a level 2 snapshot.
+// Levels are interleaved from the best price, bid first, as "bidPrice:bidAmount:askPrice:askAmount:..."
+// Bids must be sorted descending and asks ascending, prices and amounts are decimal strings without trailing zeros.
+func SnapshotChecksum(bids, asks [][2]string) uint32 {
+	parts := make([]string, 0, OrderbookChecksumDepth*4)
+
+	for i := 0; i < OrderbookChecksumDepth; i++ {
+		if i < len(bids) {
+			parts = append(parts, bids[i][0], bids[i][1])
+		}
+
+		if i < len(asks) {
+			parts = append(parts, asks[i][0], asks[i][1])
+		}
+	}
+
+	return crc32.ChecksumIEEE([]byte(strings.Join(parts, ":")))
+}
+
+// Checksum returns the SnapshotChecksum of the book
+func (book *Orderbook) Checksum() uint32 {
+	book.lock.RLock()
+	defer book.lock.RUnlock()
+
+	return book.checksum()
+}
+
+// checksum should be called with book.lock held
+func (book *Orderbook) checksum() uint32 {
+	bids := make([][2]string, 0, OrderbookChecksumDepth)
+	asks := make([][2]string, 0, OrderbookChecksumDepth)
+
+	book.asksTree.AscendGreaterOrEqual(newPriceLevel(decimal.Zero), func(i llrb.Item) bool {
+		pl := i.(*priceLevel)
+		asks = append(asks, [2]string{pl.price.String(), pl.totalAmount.String()})
+		return len(asks) < OrderbookChecksumDepth
+	})
+
+	book.bidsTree.DescendLessOrEqual(newPriceLevel(decimal.New(1, 99)), func(i llrb.Item) bool {
+		pl := i.(*priceLevel)
+		bids = append(bids, [2]string{pl.price.String(), pl.totalAmount.String()})
+		return len(bids) < OrderbookChecksumDepth
+	})
+
+	return SnapshotChecksum(bids, asks)
+}
+
+// AggregatedSnapshotV2 groups price levels into buckets of tickSize, which must be positive.
+// Bids are rounded down and asks are rounded up to the bucket price,
+// at most maxDepth buckets are returned for each side, 0 means no limit.
+func (book *Orderbook) AggregatedSnapshotV2(tickSize decimal.Decimal, maxDepth int) *SnapshotV2 {
+	book.lock.RLock()
+	defer book.lock.RUnlock()
+
+	type bucket struct {
+		price  decimal.Decimal
+		amount decimal.Decimal
+	}
+
+	aggregate := func(buckets []*bucket, price, amount decimal.Decimal) ([]*bucket, bool) {
+		if len(buckets) > 0 && buckets[len(buckets)-1].price.Equal(price) {
+			last := buckets[len(buckets)-1]
+			last.amount = last.amount.Add(amount)
+			return buckets, true
+		}
+
+		if maxDepth > 0 && len(buckets) >= maxDepth {
+			return buckets, false
+		}
+
+		return append(buckets, &bucket{price: price, amount: amount}), true
+	}
+
+	levels := func(buckets []*bucket) [][2]string {
+		levels := make([][2]string, 0, len(buckets))
+		for _, b := range buckets {
+			levels = append(levels, [2]string{b.price.String(), b.amount.String()})
+		}
+		return levels
+	}
+
+	var bids, asks []*bucket
+
+	book.asksTree.AscendGreaterOrEqual(newPriceLevel(decimal.Zero), func(i llrb.Item) bool {
+		pl := i.(*priceLevel)
+
+		var ok bool
+		asks, ok = aggregate(asks, pl.price.Div(tickSize).Ceil().Mul(tickSize), pl.totalAmount)
+		return ok
+	})
+
+	book.bidsTree.DescendLessOrEqual(newPriceLevel(decimal.New(1, 99)), func(i llrb.Item) bool {
+		pl := i.(*priceLevel)
+
+		var ok bool
+		bids, ok = aggregate(bids, pl.price.Div(tickSize).Floor().Mul(tickSize), pl.totalAmount)
+		return ok
+	})
+
+	return &SnapshotV2{
+		Bids: levels(bids),
+		Asks: levels(asks),
+	}
+}
+
 func (book *Orderbook) InsertOrder(order *MemoryOrder) *OrderbookEvent {
 	startTime := time.Now().UTC()
 	book.lock.Lock()
@@ -282,6 +750,10 @@ func (book *Orderbook) InsertOrder(order *MemoryOrder) *OrderbookEvent {
 
 	log.Debug("cost in lock, InsertOrder :", order.ID, float64(time.Since(startTime))/1000000)
 
+	return book.insertOrder(order)
+}
+
+func (book *Orderbook) insertOrder(order *MemoryOrder) *OrderbookEvent {
 	var tree *llrb.LLRB
 	if order.Side == "sell" {
 		tree = book.asksTree
@@ -296,13 +768,17 @@ func (book *Orderbook) InsertOrder(order *MemoryOrder) *OrderbookEvent {
 		tree.InsertNoReplace(price)
 	}
 
-	price.(*priceLevel).InsertOrder(order)
+	displayedAmount := price.(*priceLevel).InsertOrder(order)
+	book.orders[order.ID] = order
 
 	orderBookEvent := &OrderbookEvent{
-		OrderID: order.ID,
-		Side:    order.Side,
-		Amount:  order.Amount,
-		Price:   order.Price,
+		OrderID:     order.ID,
+		Side:        order.Side,
+		Amount:      displayedAmount,
+		Price:       order.Price,
+		Action:      OrderbookEventAdd,
+		OrderAmount: displayedAmount,
+		Checksum:    book.checksum(),
 	}
 
 	book.RunPlugins(orderBookEvent)
@@ -314,6 +790,10 @@ func (book *Orderbook) RemoveOrder(order *MemoryOrder) *OrderbookEvent {
 	book.lock.Lock()
 	defer book.lock.Unlock()
 
+	return book.removeOrder(order)
+}
+
+func (book *Orderbook) removeOrder(order *MemoryOrder) *OrderbookEvent {
 	var tree *llrb.LLRB
 	if order.Side == "sell" {
 		tree = book.asksTree
@@ -334,16 +814,21 @@ func (book *Orderbook) RemoveOrder(order *MemoryOrder) *OrderbookEvent {
 		panic(fmt.Sprintf("pl is nil when RemoveOrder, book: %s, order: %+v", book.market, order))
 	}
 
-	price.RemoveOrder(order)
+	displayedAmount := price.RemoveOrder(order)
 	if price.Len() <= 0 {
 		tree.Delete(price)
 	}
 
+	delete(book.orders, order.ID)
+
 	event := &OrderbookEvent{
-		OrderID: order.ID,
-		Side:    order.Side,
-		Amount:  order.Amount.Mul(decimal.New(-1, 0)),
-		Price:   order.Price,
+		OrderID:     order.ID,
+		Side:        order.Side,
+		Amount:      displayedAmount.Mul(decimal.New(-1, 0)),
+		Price:       order.Price,
+		Action:      OrderbookEventRemove,
+		OrderAmount: decimal.Zero,
+		Checksum:    book.checksum(),
 	}
 
 	book.RunPlugins(event)
@@ -351,10 +836,16 @@ func (book *Orderbook) RemoveOrder(order *MemoryOrder) *OrderbookEvent {
 	return event
 }
 
+// ChangeOrder changes the amount of an order in the book by changeAmount,
+// order.Amount is expected to be changed already by the caller
 func (book *Orderbook) ChangeOrder(order *MemoryOrder, changeAmount decimal.Decimal) *OrderbookEvent {
 	book.lock.Lock()
 	defer book.lock.Unlock()
 
+	return book.changeOrder(order, changeAmount)
+}
+
+func (book *Orderbook) changeOrder(order *MemoryOrder, changeAmount decimal.Decimal) *OrderbookEvent {
 	var tree *llrb.LLRB
 	if order.Side == "sell" {
 		tree = book.asksTree
@@ -365,23 +856,144 @@ func (book *Orderbook) ChangeOrder(order *MemoryOrder, changeAmount decimal.Deci
 	price := tree.Get(newPriceLevel(order.Price))
 
 	if price == nil {
-		fmt.Println("book snapshot:", book.SnapshotV2())
+		fmt.Println("book snapshot:", book.snapshotV2())
 		panic(fmt.Sprintf("can't change order which is not in this orderbook. book: %s, order: %+v", book.market, order))
 	}
 
-	price.(*priceLevel).ChangeOrder(order, changeAmount)
+	displayedChangeAmount, requeued := price.(*priceLevel).ChangeOrder(order, changeAmount)
+	bookOrder, _ := price.(*priceLevel).GetOrder(order.ID)
 
 	event := &OrderbookEvent{
-		OrderID: order.ID,
-		Side:    order.Side,
-		Amount:  changeAmount,
-		Price:   order.Price,
+		OrderID:     order.ID,
+		Side:        order.Side,
+		Amount:      displayedChangeAmount,
+		Price:       order.Price,
+		Action:      OrderbookEventChange,
+		OrderAmount: bookOrder.DisplayedAmount(),
+		Checksum:    book.checksum(),
+	}
+
+	if requeued {
+		event.Action = OrderbookEventRequeue
 	}
 	book.RunPlugins(event)
 
 	return event
 }
 
+// AmendOrder changes the price and amount of an order in the book, events are returned in the sequence they happen.
+//
+// Reducing the amount at the same price keeps the queue position of the order.
+// Otherwise the order is moved to the end of the price level of newPrice, which must not cross the book.
+func (book *Orderbook) AmendOrder(order *MemoryOrder, newPrice, newAmount decimal.Decimal) ([]*OrderbookEvent, error) {
+	if !newPrice.IsPositive() || !newAmount.IsPositive() {
+		return nil, fmt.Errorf("can't amend order %s to price %s amount %s", order.ID, newPrice.String(), newAmount.String())
+	}
+
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	if bookOrder, exist := book.getOrder(order.ID, order.Side, order.Price); !exist || bookOrder != order {
+		return nil, fmt.Errorf("can't amend order %s which is not in this orderbook", order.ID)
+	}
+
+	if newPrice.Equal(order.Price) && newAmount.Equal(order.Amount) {
+		return []*OrderbookEvent{}, nil
+	}
+
+	if newPrice.Equal(order.Price) && newAmount.LessThan(order.Amount) {
+		return []*OrderbookEvent{book.reduceOrder(order, order.Amount.Sub(newAmount))}, nil
+	}
+
+	amendedOrder := *order
+	amendedOrder.Price = newPrice
+
+	if !newPrice.Equal(order.Price) && book.CanMatch(&amendedOrder) {
+		return nil, fmt.Errorf("can't amend order %s to price %s which crosses the orderbook", order.ID, newPrice.String())
+	}
+
+	removeEvent := book.removeOrder(order)
+
+	order.Price = newPrice
+	order.Amount = newAmount
+
+	return []*OrderbookEvent{removeEvent, book.insertOrder(order)}, nil
+}
+
+func (book *Orderbook) reduceOrder(order *MemoryOrder, reduceAmount decimal.Decimal) *OrderbookEvent {
+	var tree *llrb.LLRB
+	if order.Side == "sell" {
+		tree = book.asksTree
+	} else {
+		tree = book.bidsTree
+	}
+
+	order.Amount = order.Amount.Sub(reduceAmount)
+	displayedChangeAmount := tree.Get(newPriceLevel(order.Price)).(*priceLevel).ReduceOrder(order, reduceAmount)
+
+	event := &OrderbookEvent{
+		OrderID:     order.ID,
+		Side:        order.Side,
+		Amount:      displayedChangeAmount,
+		Price:       order.Price,
+		Action:      OrderbookEventChange,
+		OrderAmount: order.DisplayedAmount(),
+		Checksum:    book.checksum(),
+	}
+
+	book.RunPlugins(event)
+
+	return event
+}
+
+func (book *Orderbook) SetSelfTradePrevention(mode string) error {
+	if !IsValidSelfTradePrevention(mode) {
+		return fmt.Errorf("unknown self trade prevention mode: %s", mode)
+	}
+
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	book.selfTradePrevention = mode
+
+	return nil
+}
+
+// isSelfTrade reports whether takerOrder and bookOrder are of the same trader and self trade prevention is on
+func (book *Orderbook) isSelfTrade(takerOrder, bookOrder *MemoryOrder) bool {
+	return book.selfTradePrevention != "" && takerOrder.Trader != "" && strings.EqualFold(takerOrder.Trader, bookOrder.Trader)
+}
+
+// SetClock changes the time used to decide which orders are expired in matching, time.Now by default
+func (book *Orderbook) SetClock(clock func() time.Time) {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	book.clock = clock
+}
+
+// SetPriceBand stops takers at price levels lower than lower or higher than upper, zero means no bound
+func (book *Orderbook) SetPriceBand(lower, upper decimal.Decimal) {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	book.priceBandLower = lower
+	book.priceBandUpper = upper
+}
+
+func (book *Orderbook) isOutsidePriceBand(price decimal.Decimal) bool {
+	return (book.priceBandLower.IsPositive() && price.LessThan(book.priceBandLower)) ||
+		(book.priceBandUpper.IsPositive() && price.GreaterThan(book.priceBandUpper))
+}
+
+// SetMatcher changes how a price level is shared by takers
+func (book *Orderbook) SetMatcher(matcher Matcher) {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	book.matcher = matcher
+}
+
 func (book *Orderbook) UsePlugin(plugin OrderbookPlugin) {
 	book.plugins = append(book.plugins, plugin)
 }
@@ -392,24 +1004,44 @@ func (book *Orderbook) RunPlugins(event *OrderbookEvent) {
 	}
 }
 
+// GetOrder returns the order in the book if its side and price are also matched
 func (book *Orderbook) GetOrder(id string, side string, price decimal.Decimal) (*MemoryOrder, bool) {
 	book.lock.Lock()
 	defer book.lock.Unlock()
 
-	var tree *llrb.LLRB
-	if side == "sell" {
-		tree = book.asksTree
-	} else {
-		tree = book.bidsTree
+	return book.getOrder(id, side, price)
+}
+
+func (book *Orderbook) getOrder(id string, side string, price decimal.Decimal) (*MemoryOrder, bool) {
+	order, exist := book.orders[id]
+	if !exist || order.Side != side || !order.Price.Equal(price) {
+		return nil, false
 	}
 
-	pl := tree.Get(newPriceLevel(price))
+	return order, true
+}
 
-	if pl == nil {
-		return nil, false
+// GetOrderByID returns the order in the book with the id
+func (book *Orderbook) GetOrderByID(id string) (*MemoryOrder, bool) {
+	book.lock.RLock()
+	defer book.lock.RUnlock()
+
+	order, exist := book.orders[id]
+
+	return order, exist
+}
+
+// RemoveOrderByID removes the order with the id from the book, nil is returned if it doesn't exist
+func (book *Orderbook) RemoveOrderByID(id string) (*MemoryOrder, *OrderbookEvent) {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	order, exist := book.orders[id]
+	if !exist {
+		return nil, nil
 	}
 
-	return pl.(*priceLevel).GetOrder(id)
+	return order, book.removeOrder(order)
 }
 
 // MaxBid ...
@@ -473,59 +1105,220 @@ func (book *Orderbook) MatchOrder(takerOrder *MemoryOrder, marketAmountDecimals
 	book.lock.Lock()
 	defer book.lock.Unlock()
 
+	return book.matchOrder(takerOrder, marketAmountDecimals)
+}
+
+func (book *Orderbook) matchOrder(takerOrder *MemoryOrder, marketAmountDecimals int) *MatchResult {
 	matchedResult := make([]*MatchItem, 0)
 
 	totalMatchedAmount := decimal.NewFromFloat(0)
 	leftAmount := takerOrder.Amount
 
-	// This function will be called multi times
-	// Return false to break the loop
-	limitOrderIterator := func(i llrb.Item) bool {
-		pl := i.(*priceLevel)
+	// the rest of the taker can't take anything, e.g. a market buy order which can't buy a unit
+	takerOrderIsDone := false
 
-		if takerOrder.Side == "buy" && pl.price.GreaterThan(takerOrder.Price) {
-			return false
-		} else if takerOrder.Side == "sell" && pl.price.LessThan(takerOrder.Price) {
-			return false
+	selfTradeItems := make([]*SelfTradeItem, 0)
+	takerSelfTradeCanceledAmount := decimal.Zero
+
+	// expired maker orders can't be settled
+	now := uint64(book.clock().Unix())
+	expiredOrders := make([]*MemoryOrder, 0)
+
+	isSelfTrade := func(bookOrder *MemoryOrder) bool {
+		return book.isSelfTrade(takerOrder, bookOrder)
+	}
+
+	// cancel taker or maker instead of matching them
+	// if the taker is canceled, leftAmount becomes zero and the iteration stops
+	preventSelfTrade := func(bookOrder *MemoryOrder) {
+		cancelTaker := func() {
+			takerSelfTradeCanceledAmount = takerSelfTradeCanceledAmount.Add(leftAmount)
+			leftAmount = decimal.Zero
 		}
 
-		iter := pl.orderMap.IterFunc()
-		for kv, ok := iter(); ok; kv, ok = iter() {
-			if leftAmount.LessThanOrEqual(decimal.Zero) {
-				break
+		cancelMaker := func() {
+			selfTradeItems = append(selfTradeItems, &SelfTradeItem{
+				MakerOrder:       bookOrder,
+				MakerOrderIsDone: true,
+				CanceledAmount:   bookOrder.Amount,
+			})
+		}
+
+		switch book.selfTradePrevention {
+		case SelfTradePreventionCancelNewest:
+			cancelTaker()
+		case SelfTradePreventionCancelOldest:
+			cancelMaker()
+		case SelfTradePreventionCancelBoth:
+			cancelMaker()
+			cancelTaker()
+		case SelfTradePreventionDecrementAndCancel:
+			// for market order buy in quote token, leftAmount is quoteCurrencyAmount
+			takerLeftInBase := leftAmount
+			if takerOrder.IsQuoteAmountMarketBuy() {
+				takerLeftInBase = leftAmount.DivRound(bookOrder.Price, int32(marketAmountDecimals)+1).Truncate(int32(marketAmountDecimals))
 			}
 
-			bookOrder := kv.Value.(*MemoryOrder)
+			if takerLeftInBase.GreaterThanOrEqual(bookOrder.Amount) {
+				cancelMaker()
+
+				if takerOrder.IsQuoteAmountMarketBuy() {
+					takerSelfTradeCanceledAmount = takerSelfTradeCanceledAmount.Add(bookOrder.Amount.Mul(bookOrder.Price))
+					leftAmount = leftAmount.Sub(bookOrder.Amount.Mul(bookOrder.Price))
+				} else {
+					takerSelfTradeCanceledAmount = takerSelfTradeCanceledAmount.Add(bookOrder.Amount)
+					leftAmount = leftAmount.Sub(bookOrder.Amount)
+				}
+			} else {
+				selfTradeItems = append(selfTradeItems, &SelfTradeItem{
+					MakerOrder:     bookOrder,
+					CanceledAmount: takerLeftInBase,
+				})
+
+				cancelTaker()
+			}
+		}
+	}
+
+	matchedItems := make(map[string]*MatchItem)
+
+	// quote token spent by the taker, for market buy orders in base token with QuoteAmountLimit
+	quoteAmountSpent := decimal.Zero
+
+	// an iceberg order may be matched twice in a priceLevel, keep one MatchItem for it
+	addMatchedAmount := func(bookOrder *MemoryOrder, matchedAmount decimal.Decimal) {
+		if matchedItem, exist := matchedItems[bookOrder.ID]; exist {
+			matchedItem.MatchedAmount = matchedItem.MatchedAmount.Add(matchedAmount)
+		} else {
+			matchedItem = &MatchItem{
+				MatchedAmount: matchedAmount,
+				MakerOrder:    bookOrder,
+			}
+
+			matchedItems[bookOrder.ID] = matchedItem
+			matchedResult = append(matchedResult, matchedItem)
+		}
+
+		totalMatchedAmount = totalMatchedAmount.Add(matchedAmount)
+		quoteAmountSpent = quoteAmountSpent.Add(matchedAmount.Mul(bookOrder.Price))
+	}
+
+	// the base amount the rest of QuoteAmountLimit can buy at price
+	quoteAmountLimitCanTake := func(price decimal.Decimal) decimal.Decimal {
+		return takerOrder.QuoteAmountLimit.Sub(quoteAmountSpent).DivRound(price, int32(marketAmountDecimals)+1).Truncate(int32(marketAmountDecimals))
+	}
+
+	isQuoteAmountLimited := takerOrder.Type == "market" && takerOrder.Side == "buy" && takerOrder.AmountInBase && takerOrder.QuoteAmountLimit.IsPositive()
+
+	// take at most availableAmount from bookOrder, leftAmount is baseCurrencyAmount
+	limitOrderTake := func(bookOrder *MemoryOrder, availableAmount decimal.Decimal) {
+		if leftAmount.GreaterThanOrEqual(availableAmount) {
+			addMatchedAmount(bookOrder, availableAmount)
+			leftAmount = leftAmount.Sub(availableAmount)
+		} else {
+			addMatchedAmount(bookOrder, leftAmount)
+			leftAmount = decimal.Zero
+		}
+	}
 
-			if leftAmount.GreaterThanOrEqual(bookOrder.Amount) {
-				matchedAmount := bookOrder.Amount
+	marketOrderTake := func(bookOrder *MemoryOrder, availableAmount decimal.Decimal) {
+		if isQuoteAmountLimited {
+			availableAmount = decimal.Min(availableAmount, quoteAmountLimitCanTake(bookOrder.Price))
 
-				matchedItem := &MatchItem{
-					MatchedAmount: matchedAmount,
-					MakerOrder:    bookOrder,
+			if !availableAmount.IsPositive() {
+				return
+			}
+		}
+
+		// for sell and market buy in base token, leftAmount is baseCurrencyAmount
+		if !takerOrder.IsQuoteAmountMarketBuy() {
+			limitOrderTake(bookOrder, availableAmount)
+			return
+		}
+
+		// for market order buy, leftAmount is quoteCurrencyAmount
+		//price = wethAmt / hotAmt
+		makerQuoteCurrencyAmt := availableAmount.Mul(bookOrder.Price)
+
+		if leftAmount.GreaterThanOrEqual(makerQuoteCurrencyAmt) {
+			//can take this whole maker order
+			addMatchedAmount(bookOrder, availableAmount)
+			leftAmount = leftAmount.Sub(makerQuoteCurrencyAmt)
+		} else {
+			// can take part of this order, round down with marketAmountDecimals
+			eatBaseCurrencyAmt := leftAmount.DivRound(bookOrder.Price, int32(marketAmountDecimals)+1).Truncate(int32(marketAmountDecimals))
+
+			addMatchedAmount(bookOrder, eatBaseCurrencyAmt)
+			leftAmount = decimal.Zero
+		}
+	}
+
+	// the base amount leftAmount can take at price
+	takeableAmount := func(price decimal.Decimal) decimal.Decimal {
+		if takerOrder.IsQuoteAmountMarketBuy() {
+			return leftAmount.DivRound(price, int32(marketAmountDecimals)+1).Truncate(int32(marketAmountDecimals))
+		}
+
+		if isQuoteAmountLimited {
+			return decimal.Min(leftAmount, quoteAmountLimitCanTake(price))
+		}
+
+		return leftAmount
+	}
+
+	// displayed amounts are shared by the matcher first, then hidden amounts of iceberg orders are taken in time priority
+	// Return false to break the loop
+	matchPriceLevel := func(pl *priceLevel, take func(*MemoryOrder, decimal.Decimal)) bool {
+		orders := make([]*MemoryOrder, 0, pl.Len())
+		available := make([]decimal.Decimal, 0, pl.Len())
+		totalAvailable := decimal.Zero
+
+		// fill the collected orders, return false if the taker is done in this price level
+		fillCollected := func() bool {
+			takeAmount := takeableAmount(pl.price)
+
+			// the rest of a market buy order can't buy a unit at this price
+			if !takeAmount.IsPositive() {
+				if takerOrder.IsQuoteAmountMarketBuy() {
+					leftAmount = decimal.Zero
+					takerOrderIsDone = true
+				}
+
+				// the rest of the QuoteAmountLimit can't buy a unit, leftAmount is not filled
+				if isQuoteAmountLimited {
+					takerOrderIsDone = true
 				}
 
-				matchedResult = append(matchedResult, matchedItem)
-				totalMatchedAmount = totalMatchedAmount.Add(matchedAmount)
-				leftAmount = leftAmount.Sub(matchedAmount)
+				return false
+			}
+
+			if totalAvailable.LessThanOrEqual(takeAmount) {
+				for i := range orders {
+					take(orders[i], available[i])
+				}
 			} else {
-				eatAmount := leftAmount
-				matchedItem := &MatchItem{
-					MatchedAmount: eatAmount,
-					MakerOrder:    bookOrder,
+				allocations := book.matcher.Allocate(orders, available, takeAmount, marketAmountDecimals)
+
+				for i := range orders {
+					if allocations[i].IsPositive() {
+						take(orders[i], allocations[i])
+					}
+				}
+
+				// the taker is filled in this price level, drop the rest of a market buy order which can't buy a unit
+				if takerOrder.IsQuoteAmountMarketBuy() {
+					leftAmount = decimal.Zero
 				}
 
-				matchedResult = append(matchedResult, matchedItem)
-				totalMatchedAmount = totalMatchedAmount.Add(eatAmount)
-				leftAmount = decimal.Zero
+				return false
 			}
-		}
 
-		return leftAmount.GreaterThan(decimal.Zero)
-	}
+			orders = orders[:0]
+			available = available[:0]
+			totalAvailable = decimal.Zero
 
-	marketOrderIterator := func(i llrb.Item) bool {
-		pl := i.(*priceLevel)
+			return true
+		}
 
 		iter := pl.orderMap.IterFunc()
 		for kv, ok := iter(); ok; kv, ok = iter() {
@@ -534,61 +1327,102 @@ func (book *Orderbook) MatchOrder(takerOrder *MemoryOrder, marketAmountDecimals
 				return false
 			}
 
-			// for marketOrder with price limit
-			if takerOrder.Price.GreaterThan(decimal.Zero) {
-				if takerOrder.Side == "buy" && pl.price.GreaterThan(takerOrder.Price) {
-					utils.Infof("market buy exit early for price bound: %s", takerOrder.Price)
+			// orders behind are not needed
+			if book.matcher.IsTimePriority() && totalAvailable.GreaterThanOrEqual(takeableAmount(pl.price)) {
+				break
+			}
 
-					return false
-				} else if takerOrder.Side == "sell" && pl.price.LessThan(takerOrder.Price) {
-					utils.Infof("market sell exit early for price bound: %s", takerOrder.Price)
+			bookOrder := kv.Value.(*MemoryOrder)
 
-					return false
-				}
+			if bookOrder.IsExpiredAt(now) {
+				expiredOrders = append(expiredOrders, bookOrder)
+				continue
 			}
 
-			memoryOrder := kv.Value.(*MemoryOrder)
+			if isSelfTrade(bookOrder) {
+				// orders ahead of the self order are filled before the taker is decreased or canceled
+				if book.selfTradePrevention != SelfTradePreventionCancelOldest && len(orders) > 0 {
+					if !fillCollected() || leftAmount.LessThanOrEqual(decimal.Zero) {
+						return false
+					}
+				}
 
-			matchedItem := &MatchItem{
-				MakerOrder: memoryOrder,
+				preventSelfTrade(bookOrder)
+				continue
 			}
 
-			// for market order buy, leftAmount is quoteCurrencyAmount
-			if takerOrder.Side == "buy" {
-				//price = wethAmt / hotAmt
-				makerQuoteCurrencyAmt := memoryOrder.Amount.Mul(memoryOrder.Price)
+			orders = append(orders, bookOrder)
+			available = append(available, bookOrder.DisplayedAmount())
+			totalAvailable = totalAvailable.Add(bookOrder.DisplayedAmount())
+		}
 
-				if leftAmount.GreaterThanOrEqual(makerQuoteCurrencyAmt) {
-					//can take this whole maker order
-					matchedItem.MatchedAmount = memoryOrder.Amount
-					leftAmount = leftAmount.Sub(makerQuoteCurrencyAmt)
-				} else {
-					// can take part of this order, round down with marketAmountDecimals
-					eatBaseCurrencyAmt := leftAmount.DivRound(memoryOrder.Price, int32(marketAmountDecimals)+1).Truncate(int32(marketAmountDecimals))
+		if !fillCollected() {
+			return false
+		}
 
-					matchedItem.MatchedAmount = eatBaseCurrencyAmt
-					leftAmount = decimal.Zero
-				}
-			} else {
-				// for sell, leftAmount is baseCurrencyAmount
-				if leftAmount.GreaterThanOrEqual(memoryOrder.Amount) {
-					matchedItem.MatchedAmount = memoryOrder.Amount
-					leftAmount = leftAmount.Sub(memoryOrder.Amount)
-				} else {
-					matchedItem.MatchedAmount = leftAmount
-					leftAmount = decimal.Zero
-				}
+		iter = pl.orderMap.IterFunc()
+		for kv, ok := iter(); ok; kv, ok = iter() {
+			if leftAmount.LessThanOrEqual(decimal.Zero) {
+				return false
 			}
 
-			matchedResult = append(matchedResult, matchedItem)
+			bookOrder := kv.Value.(*MemoryOrder)
 
-			utils.Infof("matchedItem.MatchedAmount: %s", matchedItem.MatchedAmount)
-			totalMatchedAmount = totalMatchedAmount.Add(matchedItem.MatchedAmount)
+			if bookOrder.HiddenAmount().IsPositive() && !bookOrder.IsExpiredAt(now) && !isSelfTrade(bookOrder) {
+				take(bookOrder, bookOrder.HiddenAmount())
+			}
 		}
 
 		return leftAmount.GreaterThan(decimal.Zero)
 	}
 
+	priceBandReached := false
+
+	// This function will be called multi times
+	// Return false to break the loop
+	limitOrderIterator := func(i llrb.Item) bool {
+		pl := i.(*priceLevel)
+
+		if takerOrder.Side == "buy" && pl.price.GreaterThan(takerOrder.Price) {
+			return false
+		} else if takerOrder.Side == "sell" && pl.price.LessThan(takerOrder.Price) {
+			return false
+		}
+
+		if book.isOutsidePriceBand(pl.price) {
+			priceBandReached = true
+			return false
+		}
+
+		return matchPriceLevel(pl, limitOrderTake)
+	}
+
+	marketOrderIterator := func(i llrb.Item) bool {
+		pl := i.(*priceLevel)
+
+		// for marketOrder with price limit
+		if takerOrder.Price.GreaterThan(decimal.Zero) {
+			if takerOrder.Side == "buy" && pl.price.GreaterThan(takerOrder.Price) {
+				utils.Infof("market buy exit early for price bound: %s", takerOrder.Price)
+
+				return false
+			} else if takerOrder.Side == "sell" && pl.price.LessThan(takerOrder.Price) {
+				utils.Infof("market sell exit early for price bound: %s", takerOrder.Price)
+
+				return false
+			}
+		}
+
+		if book.isOutsidePriceBand(pl.price) {
+			utils.Infof("market order exit early for price band: %s", pl.price)
+			priceBandReached = true
+
+			return false
+		}
+
+		return matchPriceLevel(pl, marketOrderTake)
+	}
+
 	// decide iterator
 	var iterator llrb.ItemIterator
 	if takerOrder.Type == "market" {
@@ -604,41 +1438,150 @@ func (book *Orderbook) MatchOrder(takerOrder *MemoryOrder, marketAmountDecimals
 	}
 
 	return &MatchResult{
-		MatchItems: matchedResult,
-		TakerOrder: takerOrder,
+		MatchItems:           matchedResult,
+		TakerOrder:           takerOrder,
+		TakerOrderLeftAmount: leftAmount,
+		TakerOrderIsDone:     takerOrderIsDone,
+
+		SelfTradeItems:                    selfTradeItems,
+		TakerOrderSelfTradeCanceledAmount: takerSelfTradeCanceledAmount,
+
+		ExpiredOrders: expiredOrders,
+
+		PriceBandReached: priceBandReached,
+
+		TakerGasFeeAmount: takerOrder.GasFeeAmount,
 	}
 }
 
+// ExecuteMatch matches the taker order and applies the fills to the book as one change under the book lock.
+// Plugins run for every changed maker order and must not call back into the book.
 func (book *Orderbook) ExecuteMatch(takerOrder *MemoryOrder, marketAmountDecimals int) *MatchResult {
-	result := book.MatchOrder(takerOrder, marketAmountDecimals)
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	result := book.matchOrder(takerOrder, marketAmountDecimals)
 
 	cancelSmallMatchesIfExist(result)
 
+	// reject before any change is made to the book
+	if takerOrderShouldBeRejected(result) {
+		return RejectedMatchResult(takerOrder)
+	}
+
+	book.applyMatch(result)
+
+	return result
+}
+
+// applyMatch changes the maker orders of result in the book, the taker order is left to the caller
+func (book *Orderbook) applyMatch(result *MatchResult) {
+	takerOrder := result.TakerOrder
+
 	for _, item := range result.MatchItems {
 		var e *OrderbookEvent
 
 		// after match, gasFee is paid
 		if !item.MatchShouldBeCanceled && item.MatchedAmount.IsPositive() {
+			item.MakerGasFeeAmount = item.MakerOrder.GasFeeAmount
 			item.MakerOrder.GasFeeAmount = decimal.Zero
 		}
 
 		if makerOrderShouldBeRemovedAfterMatch(takerOrder.GasFeeAmount, takerOrder.TakerFeeRate, item) {
-			e = book.RemoveOrder(item.MakerOrder)
+			e = book.removeOrder(item.MakerOrder)
 			item.MakerOrder.Amount = decimal.Zero
 
 			item.MakerOrderIsDone = true
 		} else {
 			changeAmt := item.MatchedAmount
 
-			e = book.ChangeOrder(item.MakerOrder, changeAmt.Mul(decimal.New(-1, 0)))
 			item.MakerOrder.Amount = item.MakerOrder.Amount.Sub(changeAmt)
+			e = book.changeOrder(item.MakerOrder, changeAmt.Mul(decimal.New(-1, 0)))
 		}
 
-		msg := OrderBookChangeMessage(book.market, book.Sequence, e.Side, e.Price, e.Amount)
+		msg := OrderBookChangeMessage(book.market, book.Sequence, e.Side, e.Price, e.Amount, e.Checksum)
 		result.OrderBookActivities = append(result.OrderBookActivities, msg)
 	}
 
-	return result
+	for _, item := range result.SelfTradeItems {
+		var e *OrderbookEvent
+
+		if item.MakerOrderIsDone {
+			e = book.removeOrder(item.MakerOrder)
+			item.MakerOrder.Amount = decimal.Zero
+		} else {
+			item.MakerOrder.Amount = item.MakerOrder.Amount.Sub(item.CanceledAmount)
+			e = book.changeOrder(item.MakerOrder, item.CanceledAmount.Mul(decimal.New(-1, 0)))
+		}
+
+		msg := OrderBookChangeMessage(book.market, book.Sequence, e.Side, e.Price, e.Amount, e.Checksum)
+		result.OrderBookActivities = append(result.OrderBookActivities, msg)
+	}
+
+	for _, order := range result.ExpiredOrders {
+		e := book.removeOrder(order)
+
+		msg := OrderBookChangeMessage(book.market, book.Sequence, e.Side, e.Price, e.Amount, e.Checksum)
+		result.OrderBookActivities = append(result.OrderBookActivities, msg)
+	}
+}
+
+// a maker only order should never take liquidity,
+// a FOK order should be fully filled or nothing
+func takerOrderShouldBeRejected(result *MatchResult) bool {
+	taker := result.TakerOrder
+
+	if taker.IsMakerOnly {
+		return len(result.MatchItems) > 0 || result.ExistSelfTrade() || result.PriceBandReached
+	}
+
+	if taker.TimeInForce == TimeInForceFOK {
+		if result.TakerOrderLeftAmount.IsPositive() || result.TakerOrderSelfTradeCanceledAmount.IsPositive() {
+			return true
+		}
+
+		for _, item := range result.MatchItems {
+			if item.MatchShouldBeCanceled {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// RejectedMatchResult is the result for an order which is refused without touching the book
+func RejectedMatchResult(takerOrder *MemoryOrder) *MatchResult {
+	return &MatchResult{
+		TakerOrder:           takerOrder,
+		TakerOrderIsDone:     true,
+		TakerOrderIsRejected: true,
+		TakerOrderLeftAmount: takerOrder.Amount,
+		MatchItems:           []*MatchItem{},
+	}
+}
+
+// CanceledMatchResult is the result for an order removed from the book by a cancel without matching
+func CanceledMatchResult(order *MemoryOrder) *MatchResult {
+	return &MatchResult{
+		TakerOrder:           order,
+		TakerOrderIsDone:     true,
+		TakerOrderIsCanceled: true,
+		TakerOrderLeftAmount: order.Amount,
+		MatchItems:           []*MatchItem{},
+	}
+}
+
+// ExpiredMatchResult is the result for an order removed from the book by the expiry sweeper,
+// the order is its own expired order
+func ExpiredMatchResult(order *MemoryOrder) *MatchResult {
+	return &MatchResult{
+		TakerOrder:           order,
+		TakerOrderIsDone:     true,
+		TakerOrderLeftAmount: order.Amount,
+		MatchItems:           []*MatchItem{},
+		ExpiredOrders:        []*MemoryOrder{order},
+	}
 }
 
 // when makerOrder is sell
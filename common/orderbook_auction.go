@@ -0,0 +1,292 @@
+package common
+
+import (
+	"github.com/petar/GoLLRB/llrb"
+	"github.com/shopspring/decimal"
+)
+
+// auctionLevel is a crossed price level with the orders which can be executed in an auction
+type auctionLevel struct {
+	price  decimal.Decimal
+	orders []*MemoryOrder
+	amount decimal.Decimal
+}
+
+// AuctionPrice returns the price the crossed book would be uncrossed at and the volume executed,
+// zeros if the book is not crossed.
+//
+// The price maximizes the executed volume, ties are broken by the least imbalance between the buy
+// and sell amounts at the price, then by the side with more amount: the highest price if buy amount
+// is more, otherwise the lowest price. Full amounts of iceberg orders are counted, expired orders are not.
+func (book *Orderbook) AuctionPrice() (price, volume decimal.Decimal) {
+	book.lock.RLock()
+	defer book.lock.RUnlock()
+
+	price, volume, _, _ = book.auctionPrice()
+
+	return
+}
+
+// Uncross executes the crossed part of the book at AuctionPrice and returns the price and the results.
+//
+// Every buy order executed is the taker of a result, in price time priority. Sell orders are matched
+// in price time priority, all matches are at the auction price. The rules of ExecuteMatch apply with
+// the buy order as the taker: self trade prevention, small match cancels and the gas fee of makers.
+// Plugins run for every change, messages are in OrderBookActivities like ExecuteMatch.
+func (book *Orderbook) Uncross() (price decimal.Decimal, results []*MatchResult) {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	price, volume, bids, asks := book.auctionPrice()
+	if !volume.IsPositive() {
+		return price, results
+	}
+
+	sells := make([]*MemoryOrder, 0)
+	for _, level := range asks {
+		if level.price.LessThanOrEqual(price) {
+			sells = append(sells, level.orders...)
+		}
+	}
+
+	leftVolume := volume
+	sellIndex := 0
+
+	for _, level := range bids {
+		if level.price.LessThan(price) {
+			break
+		}
+
+		for _, buy := range level.orders {
+			// sells removed by earlier results are skipped
+			for sellIndex < len(sells) && !sells[sellIndex].Amount.IsPositive() {
+				sellIndex++
+			}
+
+			if !leftVolume.IsPositive() || sellIndex == len(sells) {
+				return price, results
+			}
+
+			result := &MatchResult{
+				TakerOrder:        buy,
+				MatchItems:        make([]*MatchItem, 0),
+				SelfTradeItems:    make([]*SelfTradeItem, 0),
+				TakerGasFeeAmount: buy.GasFeeAmount,
+			}
+
+			// amount of buy which is neither matched nor canceled
+			leftAmount := buy.Amount
+
+			for _, sell := range sells[sellIndex:] {
+				if !leftAmount.IsPositive() || !leftVolume.IsPositive() {
+					break
+				}
+
+				if book.isSelfTrade(buy, sell) {
+					leftAmount = book.preventUncrossSelfTrade(result, sell, leftAmount)
+					continue
+				}
+
+				matchedAmount := decimal.Min(sell.Amount, leftAmount, leftVolume)
+				leftAmount = leftAmount.Sub(matchedAmount)
+				leftVolume = leftVolume.Sub(matchedAmount)
+
+				result.MatchItems = append(result.MatchItems, &MatchItem{
+					MakerOrder:    sell,
+					MatchedAmount: matchedAmount,
+					MatchedPrice:  price,
+				})
+			}
+
+			cancelSmallMatchesIfExist(result)
+			book.applyMatch(result)
+
+			changeAmount := buy.Amount.Sub(leftAmount)
+			buy.Amount = leftAmount
+
+			if !buy.Amount.IsPositive() || TakerOrderShouldBeRemoved(buy) {
+				result.OrderBookActivities = append(result.OrderBookActivities, book.changeMessage(book.removeOrder(buy)))
+				result.TakerOrderIsDone = true
+			} else if changeAmount.IsPositive() {
+				result.OrderBookActivities = append(result.OrderBookActivities, book.changeMessage(book.changeOrder(buy, changeAmount.Neg())))
+			}
+
+			// if matched, gasFee is paid
+			if !result.TakerOrderIsDone && result.BaseTokenTotalMatchedAmtWithoutCanceledMatch().IsPositive() {
+				buy.GasFeeAmount = decimal.Zero
+			}
+
+			result.TakerOrderLeftAmount = buy.Amount
+			results = append(results, result)
+		}
+	}
+
+	return price, results
+}
+
+// preventUncrossSelfTrade cancels buy or sell of the same trader in an uncross like preventSelfTrade in matchOrder,
+// the buy of result is the taker. It returns the amount of the buy left.
+func (book *Orderbook) preventUncrossSelfTrade(result *MatchResult, sell *MemoryOrder, leftAmount decimal.Decimal) decimal.Decimal {
+	cancelBuy := func() {
+		result.TakerOrderSelfTradeCanceledAmount = result.TakerOrderSelfTradeCanceledAmount.Add(leftAmount)
+		leftAmount = decimal.Zero
+	}
+
+	cancelSell := func() {
+		result.SelfTradeItems = append(result.SelfTradeItems, &SelfTradeItem{
+			MakerOrder:       sell,
+			MakerOrderIsDone: true,
+			CanceledAmount:   sell.Amount,
+		})
+	}
+
+	switch book.selfTradePrevention {
+	case SelfTradePreventionCancelNewest:
+		cancelBuy()
+	case SelfTradePreventionCancelOldest:
+		cancelSell()
+	case SelfTradePreventionCancelBoth:
+		cancelSell()
+		cancelBuy()
+	case SelfTradePreventionDecrementAndCancel:
+		if leftAmount.GreaterThanOrEqual(sell.Amount) {
+			cancelSell()
+
+			result.TakerOrderSelfTradeCanceledAmount = result.TakerOrderSelfTradeCanceledAmount.Add(sell.Amount)
+			leftAmount = leftAmount.Sub(sell.Amount)
+		} else {
+			result.SelfTradeItems = append(result.SelfTradeItems, &SelfTradeItem{
+				MakerOrder:     sell,
+				CanceledAmount: leftAmount,
+			})
+
+			cancelBuy()
+		}
+	}
+
+	return leftAmount
+}
+
+// changeMessage should be called right after the change, before the Sequence moves on
+func (book *Orderbook) changeMessage(e *OrderbookEvent) WebSocketMessage {
+	return OrderBookChangeMessage(book.market, book.Sequence, e.Side, e.Price, e.Amount, e.Checksum)
+}
+
+func (book *Orderbook) auctionPrice() (price, volume decimal.Decimal, bids, asks []*auctionLevel) {
+	now := uint64(book.clock().Unix())
+
+	bids = book.crossedLevels("buy", now)
+	asks = book.crossedLevels("sell", now)
+
+	if len(bids) == 0 || len(asks) == 0 {
+		return
+	}
+
+	candidates := make([]decimal.Decimal, 0, len(bids)+len(asks))
+	for _, level := range bids {
+		candidates = append(candidates, level.price)
+	}
+	for _, level := range asks {
+		candidates = append(candidates, level.price)
+	}
+
+	var imbalance decimal.Decimal
+
+	for _, candidate := range candidates {
+		buyAmount, sellAmount := decimal.Zero, decimal.Zero
+
+		for _, level := range bids {
+			if level.price.GreaterThanOrEqual(candidate) {
+				buyAmount = buyAmount.Add(level.amount)
+			}
+		}
+
+		for _, level := range asks {
+			if level.price.LessThanOrEqual(candidate) {
+				sellAmount = sellAmount.Add(level.amount)
+			}
+		}
+
+		candidateVolume := decimal.Min(buyAmount, sellAmount)
+		candidateImbalance := buyAmount.Sub(sellAmount).Abs()
+
+		var better bool
+		switch {
+		case !candidateVolume.Equal(volume):
+			better = candidateVolume.GreaterThan(volume)
+		case !candidateImbalance.Equal(imbalance):
+			better = candidateImbalance.LessThan(imbalance)
+		case buyAmount.GreaterThan(sellAmount):
+			better = candidate.GreaterThan(price)
+		default:
+			better = candidate.LessThan(price)
+		}
+
+		if better {
+			price, volume, imbalance = candidate, candidateVolume, candidateImbalance
+		}
+	}
+
+	if !volume.IsPositive() {
+		return decimal.Zero, decimal.Zero, bids, asks
+	}
+
+	return
+}
+
+// crossedLevels returns the levels of side which cross the other side, in price priority
+func (book *Orderbook) crossedLevels(side string, now uint64) []*auctionLevel {
+	levels := make([]*auctionLevel, 0)
+
+	collect := func(pl *priceLevel) {
+		level := &auctionLevel{price: pl.price, orders: make([]*MemoryOrder, 0), amount: decimal.Zero}
+
+		iter := pl.orderMap.IterFunc()
+		for kv, ok := iter(); ok; kv, ok = iter() {
+			order := kv.Value.(*MemoryOrder)
+
+			if !order.IsExpiredAt(now) {
+				level.orders = append(level.orders, order)
+				level.amount = level.amount.Add(order.Amount)
+			}
+		}
+
+		if len(level.orders) > 0 {
+			levels = append(levels, level)
+		}
+	}
+
+	if side == "buy" {
+		minAsk := book.asksTree.Min()
+		if minAsk == nil {
+			return levels
+		}
+
+		book.bidsTree.DescendLessOrEqual(newPriceLevel(decimal.New(1, 99)), func(i llrb.Item) bool {
+			pl := i.(*priceLevel)
+			if pl.price.LessThan(minAsk.(*priceLevel).price) {
+				return false
+			}
+
+			collect(pl)
+			return true
+		})
+	} else {
+		maxBid := book.bidsTree.Max()
+		if maxBid == nil {
+			return levels
+		}
+
+		book.asksTree.AscendGreaterOrEqual(newPriceLevel(decimal.Zero), func(i llrb.Item) bool {
+			pl := i.(*priceLevel)
+			if pl.price.GreaterThan(maxBid.(*priceLevel).price) {
+				return false
+			}
+
+			collect(pl)
+			return true
+		})
+	}
+
+	return levels
+}
@@ -0,0 +1,300 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/petar/GoLLRB/llrb"
+	"github.com/shopspring/decimal"
+	"io"
+)
+
+// binary format of an orderbook, all integers are uvarint, strings are length prefixed,
+// decimals are encoded as strings to keep them exact:
+//
+//	magic "HOB" | version | market | selfTradePrevention | sequence
+//	asks levels from the lowest price | bids levels from the highest price
+//
+// every side is a level count followed by the levels, every level is an order count
+// followed by the orders in FIFO sequence.
+const orderbookBinaryMagic = "HOB"
+
+const orderbookBinaryVersion = 1
+
+// MarshalBinary serializes every order of the book with its queue position and the book Sequence
+func (book *Orderbook) MarshalBinary() ([]byte, error) {
+	book.lock.RLock()
+	defer book.lock.RUnlock()
+
+	w := &orderbookWriter{}
+
+	w.buf.WriteString(orderbookBinaryMagic)
+	w.writeUvarint(orderbookBinaryVersion)
+	w.writeString(book.market)
+	w.writeString(book.selfTradePrevention)
+	w.writeUvarint(book.Sequence)
+
+	levels := make([]*priceLevel, 0, book.asksTree.Len())
+	book.asksTree.AscendGreaterOrEqual(newPriceLevel(decimal.Zero), func(i llrb.Item) bool {
+		levels = append(levels, i.(*priceLevel))
+		return true
+	})
+	w.writeLevels(levels)
+
+	levels = make([]*priceLevel, 0, book.bidsTree.Len())
+	book.bidsTree.DescendLessOrEqual(newPriceLevel(decimal.New(1, 99)), func(i llrb.Item) bool {
+		levels = append(levels, i.(*priceLevel))
+		return true
+	})
+	w.writeLevels(levels)
+
+	return w.buf.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the content of the book with data produced by MarshalBinary.
+// Plugins are kept and not triggered. The book is not changed if data is invalid.
+func (book *Orderbook) UnmarshalBinary(data []byte) error {
+	r := &orderbookReader{r: bytes.NewReader(data)}
+
+	magic := make([]byte, len(orderbookBinaryMagic))
+	if _, err := io.ReadFull(r.r, magic); err != nil || string(magic) != orderbookBinaryMagic {
+		return fmt.Errorf("invalid orderbook binary data")
+	}
+
+	if version := r.readUvarint(); r.err == nil && version != orderbookBinaryVersion {
+		return fmt.Errorf("unsupported orderbook binary version: %d", version)
+	}
+
+	market := r.readString()
+	selfTradePrevention := r.readString()
+	sequence := r.readUvarint()
+
+	orders := make(map[string]*MemoryOrder)
+	asksTree := r.readLevels("sell", orders)
+	bidsTree := r.readLevels("buy", orders)
+
+	if r.err != nil {
+		return fmt.Errorf("invalid orderbook binary data: %v", r.err)
+	}
+
+	if r.r.Len() > 0 {
+		return fmt.Errorf("invalid orderbook binary data: %d trailing bytes", r.r.Len())
+	}
+
+	if market != book.market {
+		return fmt.Errorf("can't restore orderbook of market %s into %s", market, book.market)
+	}
+
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	book.selfTradePrevention = selfTradePrevention
+	book.Sequence = sequence
+	book.asksTree = asksTree
+	book.bidsTree = bidsTree
+	book.orders = orders
+
+	return nil
+}
+
+// RestoreOrderbook creates a book from data produced by MarshalBinary
+func RestoreOrderbook(market string, data []byte) (*Orderbook, error) {
+	book := NewOrderbook(market)
+
+	if err := book.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return book, nil
+}
+
+type orderbookWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *orderbookWriter) writeUvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.buf.Write(b[:n])
+}
+
+func (w *orderbookWriter) writeString(s string) {
+	w.writeUvarint(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *orderbookWriter) writeDecimal(d decimal.Decimal) {
+	w.writeString(d.String())
+}
+
+func (w *orderbookWriter) writeBool(b bool) {
+	if b {
+		w.buf.WriteByte(1)
+	} else {
+		w.buf.WriteByte(0)
+	}
+}
+
+func (w *orderbookWriter) writeLevels(levels []*priceLevel) {
+	w.writeUvarint(uint64(len(levels)))
+
+	for _, pl := range levels {
+		w.writeUvarint(uint64(pl.Len()))
+
+		iter := pl.orderMap.IterFunc()
+		for kv, ok := iter(); ok; kv, ok = iter() {
+			w.writeOrder(kv.Value.(*MemoryOrder))
+		}
+	}
+}
+
+func (w *orderbookWriter) writeOrder(order *MemoryOrder) {
+	w.writeString(order.ID)
+	w.writeString(order.MarketID)
+	w.writeDecimal(order.Price)
+	w.writeDecimal(order.Amount)
+	w.writeString(order.Side)
+	w.writeString(order.Type)
+	w.writeString(order.Trader)
+	w.writeDecimal(order.GasFeeAmount)
+	w.writeDecimal(order.MakerFeeRate)
+	w.writeDecimal(order.TakerFeeRate)
+	w.writeDecimal(order.MakerRebateRate)
+	w.writeString(order.TimeInForce)
+	w.writeBool(order.IsMakerOnly)
+	w.writeDecimal(order.StopPrice)
+	w.writeUvarint(order.ExpiredAt)
+	w.writeDecimal(order.DisplayAmount)
+	w.writeDecimal(order.visibleAmount)
+	w.writeDecimal(order.hiddenAmount)
+}
+
+// orderbookReader keeps the first error, reads after an error return zero values
+type orderbookReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *orderbookReader) readUvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, err := binary.ReadUvarint(r.r)
+	r.err = err
+
+	return v
+}
+
+func (r *orderbookReader) readString() string {
+	length := r.readUvarint()
+	if r.err != nil {
+		return ""
+	}
+
+	if length > uint64(r.r.Len()) {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+
+	b := make([]byte, length)
+	_, r.err = io.ReadFull(r.r, b)
+
+	return string(b)
+}
+
+func (r *orderbookReader) readDecimal() decimal.Decimal {
+	s := r.readString()
+	if r.err != nil {
+		return decimal.Zero
+	}
+
+	d, err := decimal.NewFromString(s)
+	r.err = err
+
+	return d
+}
+
+func (r *orderbookReader) readBool() bool {
+	if r.err != nil {
+		return false
+	}
+
+	b, err := r.r.ReadByte()
+	r.err = err
+
+	return b == 1
+}
+
+func (r *orderbookReader) readLevels(side string, orders map[string]*MemoryOrder) *llrb.LLRB {
+	tree := llrb.New()
+
+	levelCount := r.readUvarint()
+	for i := uint64(0); i < levelCount && r.err == nil; i++ {
+		orderCount := r.readUvarint()
+
+		var pl *priceLevel
+		for j := uint64(0); j < orderCount && r.err == nil; j++ {
+			order := r.readOrder()
+			if r.err != nil {
+				break
+			}
+
+			if pl == nil {
+				pl = newPriceLevel(order.Price)
+			}
+
+			if order.Side != side || !order.Price.Equal(pl.price) {
+				r.err = fmt.Errorf("order %s is not in its price level", order.ID)
+				break
+			}
+
+			if _, exist := orders[order.ID]; exist {
+				r.err = fmt.Errorf("duplicated order %s", order.ID)
+				break
+			}
+
+			pl.orderMap.Set(order.ID, order)
+			orders[order.ID] = order
+			pl.totalAmount = pl.totalAmount.Add(order.DisplayedAmount())
+		}
+
+		if r.err != nil {
+			break
+		}
+
+		if pl == nil || tree.Has(pl) {
+			r.err = fmt.Errorf("invalid price level")
+			break
+		}
+
+		tree.InsertNoReplace(pl)
+	}
+
+	return tree
+}
+
+func (r *orderbookReader) readOrder() *MemoryOrder {
+	order := &MemoryOrder{}
+
+	order.ID = r.readString()
+	order.MarketID = r.readString()
+	order.Price = r.readDecimal()
+	order.Amount = r.readDecimal()
+	order.Side = r.readString()
+	order.Type = r.readString()
+	order.Trader = r.readString()
+	order.GasFeeAmount = r.readDecimal()
+	order.MakerFeeRate = r.readDecimal()
+	order.TakerFeeRate = r.readDecimal()
+	order.MakerRebateRate = r.readDecimal()
+	order.TimeInForce = r.readString()
+	order.IsMakerOnly = r.readBool()
+	order.StopPrice = r.readDecimal()
+	order.ExpiredAt = r.readUvarint()
+	order.DisplayAmount = r.readDecimal()
+	order.visibleAmount = r.readDecimal()
+	order.hiddenAmount = r.readDecimal()
+
+	return order
+}
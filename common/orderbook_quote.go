@@ -0,0 +1,102 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// Quote is the expected result of a taker order if it was executed against the book now
+type Quote struct {
+	// filled base token amount and the quote token amount paid or received for it
+	FilledAmount decimal.Decimal `json:"filledAmount"`
+	QuoteAmount  decimal.Decimal `json:"quoteAmount"`
+
+	// VWAP of the fills, the prices of the last and the first fills
+	AveragePrice decimal.Decimal `json:"averagePrice"`
+	WorstPrice   decimal.Decimal `json:"worstPrice"`
+	BestPrice    decimal.Decimal `json:"bestPrice"`
+
+	// how much AveragePrice is worse than BestPrice, 0.01 means 1%
+	Slippage decimal.Decimal `json:"slippage"`
+
+	// taker trade fee in quote token, gas fee excluded, see QuoteWithFees
+	TakerFee decimal.Decimal `json:"takerFee"`
+
+	// amount of the order left after matching, same unit as the order Amount.
+	// Self trade prevention and canceled small matches take their amounts from it like in matching.
+	LeftAmount decimal.Decimal `json:"leftAmount"`
+
+	// amount of the order canceled by self trade prevention, same unit as the order Amount
+	SelfTradeCanceledAmount decimal.Decimal `json:"selfTradeCanceledAmount"`
+
+	// the order would be rejected by matching, e.g. a FOK order can't be fully filled
+	IsRejected bool `json:"isRejected"`
+}
+
+// Quote simulates the execution of a taker order without changing the book.
+// Small matches are canceled and self trades are prevented by the same rules as ExecuteMatch, canceled matches are not filled.
+// The Amount of a market buy order is in quote token unless AmountInBase is true, same as ExecuteMatch.
+// TakerFee is the filled quote amount times the TakerFeeRate of the order.
+func (book *Orderbook) Quote(takerOrder *MemoryOrder, marketAmountDecimals int) *Quote {
+	return book.QuoteWithFees(takerOrder, marketAmountDecimals, nil, 0)
+}
+
+// QuoteWithFees is Quote with the TakerFee calculated by feeCalculator like the fees of executed matches,
+// feeCalculator nil is the same as Quote
+func (book *Orderbook) QuoteWithFees(takerOrder *MemoryOrder, marketAmountDecimals int, feeCalculator *FeeCalculator, quoteTokenDecimals int) *Quote {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	result := book.matchOrder(takerOrder, marketAmountDecimals)
+
+	cancelSmallMatchesIfExist(result)
+
+	quote := &Quote{
+		LeftAmount: takerOrder.Amount,
+	}
+
+	if takerOrderShouldBeRejected(result) {
+		quote.IsRejected = true
+		return quote
+	}
+
+	for _, item := range result.MatchItems {
+		if item.MatchShouldBeCanceled || !item.MatchedAmount.IsPositive() {
+			continue
+		}
+
+		if quote.FilledAmount.IsZero() {
+			quote.BestPrice = item.Price()
+		}
+
+		quote.FilledAmount = quote.FilledAmount.Add(item.MatchedAmount)
+		quote.QuoteAmount = quote.QuoteAmount.Add(item.MatchedAmount.Mul(item.Price()))
+		quote.WorstPrice = item.Price()
+	}
+
+	quote.LeftAmount = result.TakerOrderLeftAmount
+	quote.SelfTradeCanceledAmount = result.TakerOrderSelfTradeCanceledAmount
+
+	if quote.FilledAmount.IsZero() {
+		return quote
+	}
+
+	quote.AveragePrice = quote.QuoteAmount.Div(quote.FilledAmount)
+
+	if feeCalculator != nil {
+		feeCalculator.Calculate(result, quoteTokenDecimals)
+
+		for _, item := range result.MatchItems {
+			quote.TakerFee = quote.TakerFee.Add(item.Fee.TakerFee)
+		}
+	} else {
+		quote.TakerFee = quote.QuoteAmount.Mul(takerOrder.TakerFeeRate)
+	}
+
+	if takerOrder.Side == "buy" {
+		quote.Slippage = quote.AveragePrice.Sub(quote.BestPrice).Div(quote.BestPrice)
+	} else {
+		quote.Slippage = quote.BestPrice.Sub(quote.AveragePrice).Div(quote.BestPrice)
+	}
+
+	return quote
+}
@@ -2,9 +2,13 @@ package common
 
 import (
 	"fmt"
+	"github.com/petar/GoLLRB/llrb"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/suite"
+	"hash/crc32"
+	"sync"
 	"testing"
+	"time"
 )
 
 type orderbookTestSuite struct {
@@ -37,6 +41,378 @@ func (s *orderbookTestSuite) TestSnapshot() {
 	}, s.book.SnapshotV2())
 }
 
+func (s *orderbookTestSuite) TestChecksum() {
+	s.Equal(uint32(0), s.book.Checksum())
+
+	s.book.InsertOrder(NewLimitOrder("o1", "buy", "1.2", "3.4"))
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.3", "1"))
+	bestAsk := NewLimitOrder("o3", "sell", "1.4", "2")
+	s.book.InsertOrder(bestAsk)
+	e := s.book.InsertOrder(NewLimitOrder("o4", "sell", "1.5", "2.50"))
+
+	s.Equal(crc32.ChecksumIEEE([]byte("1.3:1:1.4:2:1.2:3.4:1.5:2.5")), s.book.Checksum())
+	s.Equal(s.book.Checksum(), e.Checksum)
+
+	snapshot := s.book.SnapshotV2()
+	s.Equal(s.book.Checksum(), SnapshotChecksum(snapshot.Bids, snapshot.Asks))
+
+	// only top levels are covered
+	for i := 0; i < OrderbookChecksumDepth; i++ {
+		s.book.InsertOrder(NewLimitOrder(fmt.Sprintf("o-%d", i), "sell", fmt.Sprintf("%d", 100+i), "1"))
+	}
+
+	checksum := s.book.Checksum()
+	e = s.book.InsertOrder(NewLimitOrder("o-far", "sell", "1000", "1"))
+	s.Equal(checksum, e.Checksum)
+
+	e = s.book.RemoveOrder(bestAsk)
+	s.NotEqual(checksum, e.Checksum)
+}
+
+func (s *orderbookTestSuite) TestMarshalAndRestoreOrderbook() {
+	_ = s.book.SetSelfTradePrevention(SelfTradePreventionCancelBoth)
+
+	iceberg := NewLimitOrder("o1", "buy", "1.2", "10")
+	iceberg.DisplayAmount = decimal.NewFromFloat(2)
+	iceberg.Trader = "0xabc"
+	iceberg.ExpiredAt = uint64(time.Now().Unix()) + 3600
+
+	s.book.InsertOrder(iceberg)
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.2", "3"))
+	s.book.InsertOrder(NewLimitOrder("o3", "buy", "1.1", "3"))
+	rebateOrder := NewLimitOrder("o4", "sell", "1.4", "3.4")
+	rebateOrder.MakerRebateRate = decimal.NewFromFloat(0.5)
+	s.book.InsertOrder(rebateOrder)
+	s.book.ExecuteMatch(NewLimitOrder("o5", "sell", "1.2", "1"), amtDecimals)
+	s.book.Sequence = 42
+
+	data, err := s.book.MarshalBinary()
+	s.Nil(err)
+
+	book, err := RestoreOrderbook("test", data)
+	s.Nil(err)
+
+	s.Equal(uint64(42), book.Sequence)
+	s.Equal(SelfTradePreventionCancelBoth, book.selfTradePrevention)
+	s.Equal(s.book.SnapshotL3(), book.SnapshotL3())
+	s.Equal(s.book.SnapshotV2(), book.SnapshotV2())
+
+	// the iceberg order keeps its refill state
+	restoredIceberg, _ := book.GetOrder("o1", "buy", decimal.NewFromFloat(1.2))
+	s.Equal("0xabc", restoredIceberg.Trader)
+	s.Equal(iceberg.ExpiredAt, restoredIceberg.ExpiredAt)
+	s.Equal("9", restoredIceberg.Amount.String())
+	s.Equal("1", restoredIceberg.DisplayedAmount().String())
+	s.Equal("8", restoredIceberg.HiddenAmount().String())
+
+	restoredRebateOrder, _ := book.GetOrderByID("o4")
+	s.Equal("0.5", restoredRebateOrder.MakerRebateRate.String())
+
+	// a restored book matches like the original one
+	result := book.ExecuteMatch(NewLimitOrder("o6", "sell", "1.2", "2"), amtDecimals)
+	s.Equal("o1", result.MatchItems[0].MakerOrder.ID)
+	s.Equal("1", result.MatchItems[0].MatchedAmount.String())
+	s.Equal("o2", result.MatchItems[1].MakerOrder.ID)
+}
+
+func (s *orderbookTestSuite) TestRestoreOrderbookWithInvalidData() {
+	s.book.InsertOrder(NewLimitOrder("o1", "buy", "1.2", "10"))
+	data, _ := s.book.MarshalBinary()
+
+	_, err := RestoreOrderbook("another", data)
+	s.NotNil(err)
+
+	_, err = RestoreOrderbook("test", data[:len(data)-1])
+	s.NotNil(err)
+
+	_, err = RestoreOrderbook("test", append(data, 0))
+	s.NotNil(err)
+
+	_, err = RestoreOrderbook("test", []byte("invalid"))
+	s.NotNil(err)
+
+	unknownVersion := append([]byte{}, data...)
+	unknownVersion[len(orderbookBinaryMagic)] = orderbookBinaryVersion + 1
+	_, err = RestoreOrderbook("test", unknownVersion)
+	s.EqualError(err, fmt.Sprintf("unsupported orderbook binary version: %d", orderbookBinaryVersion+1))
+
+	// the book is not changed by invalid data
+	s.Nil(s.book.UnmarshalBinary(data))
+	s.NotNil(s.book.UnmarshalBinary(data[:len(data)-1]))
+	s.Equal([][2]string{{"1.2", "10"}}, s.book.SnapshotV2().Bids)
+}
+
+func (s *orderbookTestSuite) TestProRataMatch() {
+	s.book.SetMatcher(&ProRataMatcher{})
+
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "1", "60"))
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1", "30"))
+	s.book.InsertOrder(NewLimitOrder("o3", "sell", "1", "10"))
+
+	result := s.book.ExecuteMatch(NewLimitOrder("o4", "buy", "1", "50"), amtDecimals)
+	s.Equal(3, len(result.MatchItems))
+	s.Equal("30", result.MatchItems[0].MatchedAmount.String())
+	s.Equal("15", result.MatchItems[1].MatchedAmount.String())
+	s.Equal("5", result.MatchItems[2].MatchedAmount.String())
+	s.Equal("0", result.TakerOrderLeftAmount.String())
+	s.Equal([][2]string{{"1", "50"}}, s.book.SnapshotV2().Asks)
+}
+
+func (s *orderbookTestSuite) TestProRataMatchRoundingAndMinAllocation() {
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "1", "7"))
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1", "2"))
+	s.book.InsertOrder(NewLimitOrder("o3", "sell", "1", "1"))
+
+	// 3.5, 1, 0.5 are rounded down, the rest is allocated in time priority
+	s.book.SetMatcher(&ProRataMatcher{})
+	result := s.book.MatchOrder(NewLimitOrder("o4", "buy", "1", "5"), 0)
+	s.Equal(2, len(result.MatchItems))
+	s.Equal("o1", result.MatchItems[0].MakerOrder.ID)
+	s.Equal("4", result.MatchItems[0].MatchedAmount.String())
+	s.Equal("o2", result.MatchItems[1].MakerOrder.ID)
+	s.Equal("1", result.MatchItems[1].MatchedAmount.String())
+
+	s.book.SetMatcher(&ProRataMatcher{MinAllocation: decimal.NewFromFloat(2)})
+	result = s.book.MatchOrder(NewLimitOrder("o4", "buy", "1", "5"), 0)
+	s.Equal(1, len(result.MatchItems))
+	s.Equal("o1", result.MatchItems[0].MakerOrder.ID)
+	s.Equal("5", result.MatchItems[0].MatchedAmount.String())
+}
+
+func (s *orderbookTestSuite) TestProRataMatchMarketBuy() {
+	s.book.SetMatcher(&ProRataMatcher{})
+
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "2", "30"))
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "2", "10"))
+	s.book.InsertOrder(NewLimitOrder("o3", "sell", "3", "10"))
+
+	// 21 quote buys 10.5 at price 2, rounded down to 10
+	result := s.book.MatchOrder(NewOrder("o4", "buy", "0", "21", "market"), 0)
+	s.Equal(2, len(result.MatchItems))
+	s.Equal("8", result.MatchItems[0].MatchedAmount.String())
+	s.Equal("2", result.MatchItems[1].MatchedAmount.String())
+	s.Equal("0", result.TakerOrderLeftAmount.String())
+}
+
+func (s *orderbookTestSuite) TestProRataMatchSweepsLevels() {
+	s.book.SetMatcher(&ProRataMatcher{})
+
+	s.book.InsertOrder(NewLimitOrder("o1", "buy", "2", "3"))
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "2", "1"))
+	s.book.InsertOrder(NewLimitOrder("o3", "buy", "1", "6"))
+	s.book.InsertOrder(NewLimitOrder("o4", "buy", "1", "2"))
+
+	result := s.book.MatchOrder(NewLimitOrder("o5", "sell", "1", "8"), amtDecimals)
+	s.Equal(4, len(result.MatchItems))
+	s.Equal("3", result.MatchItems[0].MatchedAmount.String())
+	s.Equal("1", result.MatchItems[1].MatchedAmount.String())
+	s.Equal("3", result.MatchItems[2].MatchedAmount.String())
+	s.Equal("1", result.MatchItems[3].MatchedAmount.String())
+}
+
+func (s *orderbookTestSuite) TestAmendOrderReduceKeepsPriority() {
+	o1 := NewLimitOrder("o1", "buy", "1.2", "10")
+	s.book.InsertOrder(o1)
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.2", "3"))
+
+	events, err := s.book.AmendOrder(o1, decimal.NewFromFloat(1.2), decimal.NewFromFloat(4))
+	s.Nil(err)
+	s.Equal(1, len(events))
+	s.Equal(OrderbookEventChange, events[0].Action)
+	s.Equal("-6", events[0].Amount.String())
+	s.Equal("4", o1.Amount.String())
+
+	s.Equal([]*SnapshotL3Order{
+		{ID: "o1", Price: "1.2", Amount: "4", Position: 0},
+		{ID: "o2", Price: "1.2", Amount: "3", Position: 1},
+	}, s.book.SnapshotL3().Bids)
+
+	events, err = s.book.AmendOrder(o1, decimal.NewFromFloat(1.2), decimal.NewFromFloat(4))
+	s.Nil(err)
+	s.Equal(0, len(events))
+}
+
+func (s *orderbookTestSuite) TestAmendIcebergOrderReducesHiddenAmountFirst() {
+	iceberg := NewLimitOrder("o1", "buy", "1.2", "10")
+	iceberg.DisplayAmount = decimal.NewFromFloat(2)
+	s.book.InsertOrder(iceberg)
+
+	events, err := s.book.AmendOrder(iceberg, decimal.NewFromFloat(1.2), decimal.NewFromFloat(5))
+	s.Nil(err)
+	s.Equal("0", events[0].Amount.String())
+	s.Equal("2", iceberg.DisplayedAmount().String())
+	s.Equal("3", iceberg.HiddenAmount().String())
+
+	events, err = s.book.AmendOrder(iceberg, decimal.NewFromFloat(1.2), decimal.NewFromFloat(1))
+	s.Nil(err)
+	s.Equal("-1", events[0].Amount.String())
+	s.Equal("1", iceberg.DisplayedAmount().String())
+	s.Equal("0", iceberg.HiddenAmount().String())
+	s.Equal([][2]string{{"1.2", "1"}}, s.book.SnapshotV2().Bids)
+}
+
+func (s *orderbookTestSuite) TestAmendOrderRequeue() {
+	o1 := NewLimitOrder("o1", "buy", "1.2", "10")
+	s.book.InsertOrder(o1)
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.2", "3"))
+	s.book.InsertOrder(NewLimitOrder("o3", "sell", "1.5", "3"))
+
+	// size increase
+	events, err := s.book.AmendOrder(o1, decimal.NewFromFloat(1.2), decimal.NewFromFloat(11))
+	s.Nil(err)
+	s.Equal(2, len(events))
+	s.Equal(OrderbookEventRemove, events[0].Action)
+	s.Equal("-10", events[0].Amount.String())
+	s.Equal(OrderbookEventAdd, events[1].Action)
+	s.Equal("11", events[1].Amount.String())
+	s.Equal("o1", s.book.SnapshotL3().Bids[1].ID)
+
+	// price change
+	events, err = s.book.AmendOrder(o1, decimal.NewFromFloat(1.3), decimal.NewFromFloat(5))
+	s.Nil(err)
+	s.Equal(2, len(events))
+	s.Equal("1.2", events[0].Price.String())
+	s.Equal("1.3", events[1].Price.String())
+	s.Equal([][2]string{{"1.3", "5"}, {"1.2", "3"}}, s.book.SnapshotV2().Bids)
+
+	_, err = s.book.AmendOrder(o1, decimal.NewFromFloat(1.5), decimal.NewFromFloat(5))
+	s.NotNil(err)
+
+	_, err = s.book.AmendOrder(o1, decimal.NewFromFloat(1.3), decimal.Zero)
+	s.NotNil(err)
+
+	_, err = s.book.AmendOrder(NewLimitOrder("o4", "buy", "1.3", "5"), decimal.NewFromFloat(1.3), decimal.NewFromFloat(1))
+	s.NotNil(err)
+
+	s.Equal([][2]string{{"1.3", "5"}, {"1.2", "3"}}, s.book.SnapshotV2().Bids)
+}
+
+func (s *orderbookTestSuite) newBaseAmountMarketBuy(id, amount, quoteAmountLimit string) *MemoryOrder {
+	order := NewOrder(id, "buy", "0", amount, "market")
+	order.AmountInBase = true
+	order.QuoteAmountLimit, _ = decimal.NewFromString(quoteAmountLimit)
+
+	return order
+}
+
+func (s *orderbookTestSuite) TestMarketBuyInBaseAmount() {
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "1", "50"))
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1.1", "100"))
+
+	result := s.book.MatchOrder(s.newBaseAmountMarketBuy("o3", "100", "0"), amtDecimals)
+	s.Equal(2, len(result.MatchItems))
+	s.Equal("50", result.MatchItems[0].MatchedAmount.String())
+	s.Equal("50", result.MatchItems[1].MatchedAmount.String())
+	s.Equal("0", result.TakerOrderLeftAmount.String())
+	s.Equal("105", result.QuoteTokenTotalMatchedAmt().String())
+}
+
+func (s *orderbookTestSuite) TestMarketBuyInBaseAmountWithQuoteAmountLimit() {
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "1", "50"))
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1.1", "100"))
+
+	// 30 quote left after the first level buys 27.272 at 1.1
+	result := s.book.MatchOrder(s.newBaseAmountMarketBuy("o3", "100", "80"), amtDecimals)
+	s.Equal(2, len(result.MatchItems))
+	s.Equal("50", result.MatchItems[0].MatchedAmount.String())
+	s.Equal("27.272", result.MatchItems[1].MatchedAmount.String())
+	s.Equal("22.728", result.TakerOrderLeftAmount.String())
+	s.True(result.QuoteTokenTotalMatchedAmt().LessThanOrEqual(decimal.NewFromFloat(80)))
+
+	// the limit is not reached
+	result = s.book.MatchOrder(s.newBaseAmountMarketBuy("o4", "60", "80"), amtDecimals)
+	s.Equal("10", result.MatchItems[1].MatchedAmount.String())
+	s.Equal("0", result.TakerOrderLeftAmount.String())
+}
+
+func (s *orderbookTestSuite) TestMarketBuyInBaseAmountWithQuoteAmountLimitTooSmallForAUnit() {
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "2", "50"))
+
+	// a QuoteAmountLimit of 1 can't buy a unit at 2
+	result := s.book.MatchOrder(s.newBaseAmountMarketBuy("o2", "10", "1"), 0)
+	s.Equal(0, len(result.MatchItems))
+	s.True(result.TakerOrderIsDone)
+	s.Equal("10", result.TakerOrderLeftAmount.String())
+}
+
+func (s *orderbookTestSuite) TestMarketBuyInBaseAmountCancelsSmallMatches() {
+	maker := NewLimitOrder("o1", "sell", "1", "50")
+	maker.GasFeeAmount = decimal.NewFromFloat(5)
+	s.book.InsertOrder(maker)
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1.1", "100"))
+
+	result := s.book.ExecuteMatch(s.newBaseAmountMarketBuy("o3", "1", "0"), amtDecimals)
+	s.Equal(1, len(result.MatchItems))
+	s.True(result.MatchItems[0].MatchShouldBeCanceled)
+	s.Equal("0", result.BaseTokenTotalMatchedAmtWithoutCanceledMatch().String())
+}
+
+func (s *orderbookTestSuite) TestPriceBandStopsTaker() {
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "1", "50"))
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1.1", "50"))
+	s.book.InsertOrder(NewLimitOrder("o3", "sell", "1.2", "50"))
+	s.book.SetPriceBand(decimal.NewFromFloat(0.9), decimal.NewFromFloat(1.1))
+
+	result := s.book.ExecuteMatch(NewOrder("o4", "buy", "0", "200", "market"), amtDecimals)
+	s.Equal(2, len(result.MatchItems))
+	s.True(result.PriceBandReached)
+	s.Equal("1.2", s.book.MinAsk().String())
+
+	// a maker only order reaching the band would take liquidity
+	makerOnly := NewLimitOrder("o6", "buy", "1.2", "10")
+	makerOnly.IsMakerOnly = true
+	result = s.book.ExecuteMatch(makerOnly, amtDecimals)
+	s.True(result.TakerOrderIsRejected)
+	s.Equal("1.2", s.book.MinAsk().String())
+
+	// takers inside the band don't reach it
+	s.book.SetPriceBand(decimal.Zero, decimal.Zero)
+	result = s.book.ExecuteMatch(NewLimitOrder("o5", "buy", "1.2", "10"), amtDecimals)
+	s.Equal(1, len(result.MatchItems))
+	s.False(result.PriceBandReached)
+}
+
+func (s *orderbookTestSuite) TestSnapshotL3() {
+	iceberg := NewLimitOrder("o1", "buy", "1.2", "10")
+	iceberg.DisplayAmount = decimal.NewFromFloat(2)
+
+	s.book.InsertOrder(iceberg)
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.2", "3.4"))
+	s.book.InsertOrder(NewLimitOrder("o3", "buy", "1.3", "3.4"))
+	s.book.InsertOrder(NewLimitOrder("o4", "sell", "1.4", "3.4"))
+
+	s.Equal(&SnapshotL3{
+		Bids: []*SnapshotL3Order{
+			{ID: "o3", Price: "1.3", Amount: "3.4", Position: 0},
+			{ID: "o1", Price: "1.2", Amount: "2", Position: 0},
+			{ID: "o2", Price: "1.2", Amount: "3.4", Position: 1},
+		},
+		Asks: []*SnapshotL3Order{
+			{ID: "o4", Price: "1.4", Amount: "3.4", Position: 0},
+		},
+	}, s.book.SnapshotL3())
+}
+
+func (s *orderbookTestSuite) TestAggregatedSnapshot() {
+	s.book.InsertOrder(NewLimitOrder("o1", "buy", "1.21", "1"))
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.29", "2"))
+	s.book.InsertOrder(NewLimitOrder("o3", "buy", "1.1", "3"))
+	s.book.InsertOrder(NewLimitOrder("o4", "buy", "1.0", "4"))
+	s.book.InsertOrder(NewLimitOrder("o5", "sell", "1.31", "1"))
+	s.book.InsertOrder(NewLimitOrder("o6", "sell", "1.4", "2"))
+	s.book.InsertOrder(NewLimitOrder("o7", "sell", "1.55", "3"))
+
+	s.Equal(&SnapshotV2{
+		Bids: [][2]string{{"1.2", "3"}, {"1.1", "3"}, {"1", "4"}},
+		Asks: [][2]string{{"1.4", "3"}, {"1.6", "3"}},
+	}, s.book.AggregatedSnapshotV2(decimal.NewFromFloat(0.1), 0))
+
+	s.Equal(&SnapshotV2{
+		Bids: [][2]string{{"1.2", "3"}, {"1.1", "3"}},
+		Asks: [][2]string{{"1.4", "3"}, {"1.6", "3"}},
+	}, s.book.AggregatedSnapshotV2(decimal.NewFromFloat(0.1), 2))
+}
+
 func (s *orderbookTestSuite) TestNewOrderbok() {
 	s.Equal(0, s.book.bidsTree.Len())
 	s.Equal(0, s.book.asksTree.Len())
@@ -188,6 +564,593 @@ func (s *orderbookTestSuite) TestCanBeMatched() {
 	s.Equal(canBeMatched4, false)
 }
 
+func (s *orderbookTestSuite) TestExecuteMatchRejectMakerOnlyOrder() {
+	s.book.InsertOrder(NewLimitOrder("o1", "buy", "1.2", "1"))
+
+	taker := NewLimitOrder("o2", "sell", "1.2", "1")
+	taker.IsMakerOnly = true
+
+	result := s.book.ExecuteMatch(taker, amtDecimals)
+	s.True(result.TakerOrderIsRejected)
+	s.True(result.TakerOrderIsDone)
+	s.Equal(0, len(result.MatchItems))
+	s.Equal("1", s.book.bidsTree.Max().(*priceLevel).totalAmount.String())
+}
+
+func (s *orderbookTestSuite) TestExecuteMatchRejectUnfillableFOKOrder() {
+	s.book.InsertOrder(NewLimitOrder("o1", "buy", "1.2", "1"))
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.1", "1"))
+
+	taker := NewLimitOrder("o3", "sell", "1.2", "2")
+	taker.TimeInForce = TimeInForceFOK
+
+	result := s.book.ExecuteMatch(taker, amtDecimals)
+	s.True(result.TakerOrderIsRejected)
+	s.Equal(0, len(result.MatchItems))
+	s.Equal("1", s.book.bidsTree.Max().(*priceLevel).totalAmount.String())
+
+	taker = NewLimitOrder("o4", "sell", "1.1", "2")
+	taker.TimeInForce = TimeInForceFOK
+
+	result = s.book.ExecuteMatch(taker, amtDecimals)
+	s.False(result.TakerOrderIsRejected)
+	s.Equal(2, len(result.MatchItems))
+	s.True(result.TakerOrderLeftAmount.IsZero())
+	s.Nil(s.book.MaxBid())
+}
+
+func (s *orderbookTestSuite) insertSelfTradeOrders() {
+	o1 := NewLimitOrder("o1", "buy", "1.3", "2")
+	o1.Trader = "0xaaa"
+	o2 := NewLimitOrder("o2", "buy", "1.2", "2")
+	o2.Trader = "0xbbb"
+
+	s.book.InsertOrder(o1)
+	s.book.InsertOrder(o2)
+}
+
+func (s *orderbookTestSuite) newSelfTradeTaker(amount string) *MemoryOrder {
+	taker := NewLimitOrder("o3", "sell", "1.2", amount)
+	taker.Trader = "0xAAA"
+	return taker
+}
+
+func (s *orderbookTestSuite) TestSelfTradeAllowedByDefault() {
+	s.insertSelfTradeOrders()
+
+	result := s.book.MatchOrder(s.newSelfTradeTaker("3"), amtDecimals)
+	s.Equal(2, len(result.MatchItems))
+	s.Equal(0, len(result.SelfTradeItems))
+}
+
+func (s *orderbookTestSuite) TestSelfTradePreventionCancelNewest() {
+	s.insertSelfTradeOrders()
+	s.Nil(s.book.SetSelfTradePrevention(SelfTradePreventionCancelNewest))
+
+	result := s.book.MatchOrder(s.newSelfTradeTaker("3"), amtDecimals)
+	s.Equal(0, len(result.MatchItems))
+	s.Equal(0, len(result.SelfTradeItems))
+	s.Equal("3", result.TakerOrderSelfTradeCanceledAmount.String())
+	s.True(result.TakerOrderLeftAmount.IsZero())
+}
+
+func (s *orderbookTestSuite) TestSelfTradePreventionCancelOldest() {
+	s.insertSelfTradeOrders()
+	s.Nil(s.book.SetSelfTradePrevention(SelfTradePreventionCancelOldest))
+
+	result := s.book.ExecuteMatch(s.newSelfTradeTaker("3"), amtDecimals)
+	s.Equal(1, len(result.MatchItems))
+	s.Equal("o2", result.MatchItems[0].MakerOrder.ID)
+	s.Equal(1, len(result.SelfTradeItems))
+	s.Equal("o1", result.SelfTradeItems[0].MakerOrder.ID)
+	s.True(result.SelfTradeItems[0].MakerOrderIsDone)
+	s.True(result.TakerOrderSelfTradeCanceledAmount.IsZero())
+
+	s.Nil(s.book.MaxBid())
+	s.Equal(2, len(result.OrderBookActivities))
+}
+
+func (s *orderbookTestSuite) TestSelfTradePreventionCancelBoth() {
+	s.insertSelfTradeOrders()
+	s.Nil(s.book.SetSelfTradePrevention(SelfTradePreventionCancelBoth))
+
+	result := s.book.ExecuteMatch(s.newSelfTradeTaker("3"), amtDecimals)
+	s.Equal(0, len(result.MatchItems))
+	s.Equal(1, len(result.SelfTradeItems))
+	s.Equal("3", result.TakerOrderSelfTradeCanceledAmount.String())
+
+	s.Equal("1.2", s.book.MaxBid().String())
+}
+
+func (s *orderbookTestSuite) TestSelfTradePreventionDecrementAndCancel() {
+	s.insertSelfTradeOrders()
+	s.Nil(s.book.SetSelfTradePrevention(SelfTradePreventionDecrementAndCancel))
+
+	// taker is bigger, maker is canceled and taker continues with the rest
+	result := s.book.MatchOrder(s.newSelfTradeTaker("3"), amtDecimals)
+	s.Equal(1, len(result.MatchItems))
+	s.Equal("1", result.MatchItems[0].MatchedAmount.String())
+	s.Equal(1, len(result.SelfTradeItems))
+	s.True(result.SelfTradeItems[0].MakerOrderIsDone)
+	s.Equal("2", result.TakerOrderSelfTradeCanceledAmount.String())
+
+	// maker is bigger, maker is decreased and taker is canceled
+	result = s.book.ExecuteMatch(s.newSelfTradeTaker("0.5"), amtDecimals)
+	s.Equal(0, len(result.MatchItems))
+	s.Equal(1, len(result.SelfTradeItems))
+	s.False(result.SelfTradeItems[0].MakerOrderIsDone)
+	s.Equal("0.5", result.SelfTradeItems[0].CanceledAmount.String())
+	s.Equal("0.5", result.TakerOrderSelfTradeCanceledAmount.String())
+	s.Equal("1.5", s.book.bidsTree.Max().(*priceLevel).totalAmount.String())
+}
+
+func (s *orderbookTestSuite) TestSelfTradePreventionFillsOrdersAheadFirst() {
+	other := NewLimitOrder("o1", "sell", "1.2", "10")
+	other.Trader = "0xbbb"
+	self := NewLimitOrder("o2", "sell", "1.2", "10")
+	self.Trader = "0xaaa"
+	s.book.InsertOrder(other)
+	s.book.InsertOrder(self)
+	s.Nil(s.book.SetSelfTradePrevention(SelfTradePreventionCancelNewest))
+
+	taker := NewLimitOrder("o3", "buy", "1.2", "15")
+	taker.Trader = "0xAAA"
+
+	result := s.book.ExecuteMatch(taker, amtDecimals)
+	s.Equal(1, len(result.MatchItems))
+	s.Equal("o1", result.MatchItems[0].MakerOrder.ID)
+	s.Equal("10", result.MatchItems[0].MatchedAmount.String())
+	s.Equal("5", result.TakerOrderSelfTradeCanceledAmount.String())
+	s.True(result.TakerOrderLeftAmount.IsZero())
+	s.Equal("10", s.book.asksTree.Min().(*priceLevel).totalAmount.String())
+}
+
+func (s *orderbookTestSuite) TestSetUnknownSelfTradePrevention() {
+	s.NotNil(s.book.SetSelfTradePrevention("unknown"))
+}
+
+func (s *orderbookTestSuite) TestExpiredMakerOrderIsNotMatched() {
+	expired := NewLimitOrder("o1", "buy", "1.3", "2")
+	expired.ExpiredAt = uint64(time.Now().Unix()) - 1
+	notExpired := NewLimitOrder("o2", "buy", "1.2", "2")
+	notExpired.ExpiredAt = uint64(time.Now().Unix()) + 3600
+
+	s.book.InsertOrder(expired)
+	s.book.InsertOrder(notExpired)
+
+	result := s.book.ExecuteMatch(NewLimitOrder("o3", "sell", "1.2", "1"), amtDecimals)
+	s.Equal(1, len(result.MatchItems))
+	s.Equal("o2", result.MatchItems[0].MakerOrder.ID)
+	s.Equal(1, len(result.ExpiredOrders))
+	s.Equal("o1", result.ExpiredOrders[0].ID)
+
+	s.Equal("1.2", s.book.MaxBid().String())
+}
+
+func (s *orderbookTestSuite) TestIcebergOrderShowsDisplayAmountOnly() {
+	iceberg := NewLimitOrder("o1", "buy", "1.2", "10")
+	iceberg.DisplayAmount = decimal.NewFromFloat(2)
+
+	event := s.book.InsertOrder(iceberg)
+	s.Equal("2", event.Amount.String())
+
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.2", "3"))
+
+	s.Equal([][2]string{{"1.2", "5"}}, s.book.SnapshotV2().Bids)
+}
+
+func (s *orderbookTestSuite) TestMatchIcebergOrderHiddenAmount() {
+	iceberg := NewLimitOrder("o1", "buy", "1.2", "10")
+	iceberg.DisplayAmount = decimal.NewFromFloat(2)
+	s.book.InsertOrder(iceberg)
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.2", "3"))
+
+	// displayed amounts first, then the hidden amount
+	result := s.book.ExecuteMatch(NewLimitOrder("o3", "sell", "1.2", "6"), amtDecimals)
+	s.Equal(2, len(result.MatchItems))
+	s.Equal("o1", result.MatchItems[0].MakerOrder.ID)
+	s.Equal("3", result.MatchItems[0].MatchedAmount.String())
+	s.Equal("o2", result.MatchItems[1].MakerOrder.ID)
+	s.Equal("3", result.MatchItems[1].MatchedAmount.String())
+
+	s.Equal("7", iceberg.Amount.String())
+	s.Equal("2", iceberg.DisplayedAmount().String())
+	s.Equal("5", iceberg.HiddenAmount().String())
+	s.Equal([][2]string{{"1.2", "2"}}, s.book.SnapshotV2().Bids)
+
+	// the whole hidden amount can be taken
+	result = s.book.ExecuteMatch(NewLimitOrder("o4", "sell", "1.2", "7"), amtDecimals)
+	s.Equal(1, len(result.MatchItems))
+	s.Equal("7", result.MatchItems[0].MatchedAmount.String())
+	s.True(result.MatchItems[0].MakerOrderIsDone)
+	s.Nil(s.book.MaxBid())
+}
+
+func (s *orderbookTestSuite) TestIcebergOrderRefillLosesTimePriority() {
+	iceberg := NewLimitOrder("o1", "buy", "1.2", "4")
+	iceberg.DisplayAmount = decimal.NewFromFloat(2)
+	s.book.InsertOrder(iceberg)
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.2", "1"))
+
+	result := s.book.ExecuteMatch(NewLimitOrder("o3", "sell", "1.2", "2"), amtDecimals)
+	s.Equal(1, len(result.MatchItems))
+	s.Equal("o1", result.MatchItems[0].MakerOrder.ID)
+
+	// refilled with 2, displayed amount is not changed
+	s.Equal("0", result.OrderBookActivities[0].Payload.(*WebsocketMarketOrderChangePayload).Amount)
+
+	result = s.book.MatchOrder(NewLimitOrder("o4", "sell", "1.2", "1"), amtDecimals)
+	s.Equal(1, len(result.MatchItems))
+	s.Equal("o2", result.MatchItems[0].MakerOrder.ID)
+}
+
+func (s *orderbookTestSuite) TestQuoteMarketOrders() {
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "1", "50"))
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1.2", "100"))
+
+	// 50 @ 1 + 50 @ 1.2
+	order := s.newBaseAmountMarketBuy("o3", "100", "0")
+	order.TakerFeeRate = decimal.NewFromFloat(0.001)
+	quote := s.book.Quote(order, amtDecimals)
+
+	s.False(quote.IsRejected)
+	s.Equal("100", quote.FilledAmount.String())
+	s.Equal("110", quote.QuoteAmount.String())
+	s.Equal("1.1", quote.AveragePrice.String())
+	s.Equal("1", quote.BestPrice.String())
+	s.Equal("1.2", quote.WorstPrice.String())
+	s.Equal("0.1", quote.Slippage.String())
+	s.Equal("0.11", quote.TakerFee.String())
+	s.Equal("0", quote.LeftAmount.String())
+
+	// 170 quote token buys the whole book, 30 is left
+	quote = s.book.Quote(NewOrder("o4", "buy", "0", "200", "market"), amtDecimals)
+	s.Equal("150", quote.FilledAmount.String())
+	s.Equal("170", quote.QuoteAmount.String())
+	s.Equal("30", quote.LeftAmount.String())
+
+	s.Equal(&SnapshotV2{
+		Bids: [][2]string{},
+		Asks: [][2]string{{"1", "50"}, {"1.2", "100"}},
+	}, s.book.SnapshotV2())
+}
+
+func (s *orderbookTestSuite) TestQuoteWithFees() {
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "1.23", "10"))
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1.3", "5"))
+
+	taker := NewLimitOrder("o3", "buy", "1.3", "15")
+	taker.Trader = "taker"
+	taker.TakerFeeRate = decimal.NewFromFloat(0.003)
+
+	// 12.3 * 0.003 * 0.9 = 0.03321 and 6.5 * 0.003 * 0.9 = 0.01755, rounded down like in matching
+	discounter := &fakeHotFeeDiscounter{discounts: map[string]decimal.Decimal{"taker": decimal.NewFromFloat(0.9)}}
+	quote := s.book.QuoteWithFees(taker, amtDecimals, NewFeeCalculator(discounter), 2)
+	s.Equal("18.8", quote.QuoteAmount.String())
+	s.Equal("0.04", quote.TakerFee.String())
+
+	result := s.book.ExecuteMatch(taker, amtDecimals)
+	NewFeeCalculator(discounter).Calculate(result, 2)
+	s.Equal(quote.TakerFee.String(), result.MatchItems[0].Fee.TakerFee.Add(result.MatchItems[1].Fee.TakerFee).String())
+}
+
+func (s *orderbookTestSuite) TestQuoteSellOrder() {
+	s.book.InsertOrder(NewLimitOrder("o1", "buy", "2", "10"))
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.5", "10"))
+
+	quote := s.book.Quote(NewLimitOrder("o3", "sell", "1", "30"), amtDecimals)
+
+	s.Equal("20", quote.FilledAmount.String())
+	s.Equal("1.75", quote.AveragePrice.String())
+	s.Equal("0.125", quote.Slippage.String())
+	s.Equal("10", quote.LeftAmount.String())
+}
+
+func (s *orderbookTestSuite) TestQuoteCancelsSmallMatches() {
+	maker := NewLimitOrder("o1", "sell", "1", "1")
+	maker.GasFeeAmount = decimal.NewFromFloat(2)
+	s.book.InsertOrder(maker)
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1.1", "10"))
+
+	quote := s.book.Quote(NewLimitOrder("o3", "buy", "1.1", "5"), amtDecimals)
+
+	// the match with o1 doesn't pay its gas fee, its amount is still taken from the order like in matching
+	s.Equal("4", quote.FilledAmount.String())
+	s.Equal("1.1", quote.BestPrice.String())
+	s.Equal("0", quote.LeftAmount.String())
+
+	result := s.book.ExecuteMatch(NewLimitOrder("o3", "buy", "1.1", "5"), amtDecimals)
+	s.Equal(quote.LeftAmount, result.TakerOrderLeftAmount)
+}
+
+func (s *orderbookTestSuite) TestQuoteSelfTradePrevention() {
+	maker := NewLimitOrder("o1", "sell", "1", "10")
+	maker.Trader = "0xaaa"
+	s.book.InsertOrder(maker)
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1.1", "10"))
+	s.Nil(s.book.SetSelfTradePrevention(SelfTradePreventionDecrementAndCancel))
+
+	taker := NewLimitOrder("o3", "buy", "1.1", "15")
+	taker.Trader = "0xAAA"
+
+	// 10 is canceled with o1, 5 is filled by o2
+	quote := s.book.Quote(taker, amtDecimals)
+	s.Equal("5", quote.FilledAmount.String())
+	s.Equal("10", quote.SelfTradeCanceledAmount.String())
+	s.Equal("0", quote.LeftAmount.String())
+	s.Equal("1.1", quote.BestPrice.String())
+}
+
+func (s *orderbookTestSuite) TestQuoteRejectedOrder() {
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "1", "10"))
+
+	order := NewLimitOrder("o2", "buy", "1", "20")
+	order.TimeInForce = TimeInForceFOK
+
+	quote := s.book.Quote(order, amtDecimals)
+
+	s.True(quote.IsRejected)
+	s.True(quote.FilledAmount.IsZero())
+	s.Equal("20", quote.LeftAmount.String())
+}
+
+type fakeHotFeeDiscounter struct {
+	discounts map[string]decimal.Decimal
+	calls     int
+}
+
+func (d *fakeHotFeeDiscounter) GetHotFeeDiscount(address string) decimal.Decimal {
+	d.calls++
+
+	if discount, exist := d.discounts[address]; exist {
+		return discount
+	}
+
+	return decimal.New(1, 0)
+}
+
+func (s *orderbookTestSuite) TestFeeCalculator() {
+	taker := NewLimitOrder("o1", "buy", "1.3", "20")
+	taker.Trader = "taker"
+	taker.TakerFeeRate = decimal.NewFromFloat(0.003)
+	taker.GasFeeAmount = decimal.NewFromFloat(0.5)
+
+	maker1 := NewLimitOrder("o2", "sell", "1.23", "10")
+	maker1.Trader = "maker"
+	maker1.MakerFeeRate = decimal.NewFromFloat(0.001)
+	maker1.GasFeeAmount = decimal.NewFromFloat(0.1)
+
+	// the rebate is capped at the taker fee
+	maker2 := NewLimitOrder("o3", "sell", "1.3", "5")
+	maker2.Trader = "maker"
+	maker2.MakerFeeRate = decimal.NewFromFloat(0.001)
+	maker2.MakerRebateRate = decimal.NewFromFloat(1.5)
+
+	maker3 := NewLimitOrder("o4", "sell", "1.3", "5")
+	maker3.GasFeeAmount = decimal.NewFromFloat(0.1)
+
+	result := &MatchResult{
+		TakerOrder:        taker,
+		TakerGasFeeAmount: taker.GasFeeAmount,
+		MatchItems: []*MatchItem{
+			{MakerOrder: maker1, MatchedAmount: decimal.NewFromFloat(10), MakerGasFeeAmount: maker1.GasFeeAmount},
+			{MakerOrder: maker2, MatchedAmount: decimal.NewFromFloat(5)},
+			{MakerOrder: maker3, MatchedAmount: decimal.NewFromFloat(5), MatchShouldBeCanceled: true},
+		},
+	}
+
+	discounter := &fakeHotFeeDiscounter{discounts: map[string]decimal.Decimal{"taker": decimal.NewFromFloat(0.9)}}
+	NewFeeCalculator(discounter).Calculate(result, 2)
+
+	// 12.3 quote: taker fee 12.3 * 0.003 * 0.9 = 0.03321, maker fee 12.3 * 0.001 = 0.0123, rounded down
+	fee := result.MatchItems[0].Fee
+	s.Equal("0.03", fee.TakerFee.String())
+	s.Equal("0.01", fee.MakerFee.String())
+	s.Equal("0", fee.MakerRebate.String())
+	s.Equal("0.5", fee.TakerGasFee.String())
+	s.Equal("0.1", fee.MakerGasFee.String())
+
+	// 6.5 quote: taker fee 6.5 * 0.003 * 0.9 = 0.01755
+	fee = result.MatchItems[1].Fee
+	s.Equal("0.01", fee.TakerFee.String())
+	s.Equal("0", fee.MakerFee.String())
+	s.Equal("0.01", fee.MakerRebate.String())
+	s.Equal("0", fee.TakerGasFee.String())
+	s.Equal("0", fee.MakerGasFee.String())
+
+	s.Equal(MatchFee{}, *result.MatchItems[2].Fee)
+	s.Equal("0.01", result.TotalMakerRebate().String())
+
+	// every trader is looked up once
+	s.Equal(2, discounter.calls)
+
+	// no discount without a discounter
+	NewFeeCalculator(nil).Calculate(result, 4)
+	s.Equal("0.0369", result.MatchItems[0].Fee.TakerFee.String())
+	s.Equal("0.0195", result.MatchItems[1].Fee.TakerFee.String())
+
+	// rebate rates are truncated to RebateRateBase: 0.0195 * 1 / 100
+	maker2.MakerRebateRate = decimal.NewFromFloat(0.0123)
+	NewFeeCalculator(nil).Calculate(result, 4)
+	s.Equal("0.0001", result.MatchItems[1].Fee.MakerRebate.String())
+}
+
+func (s *orderbookTestSuite) TestOrderByID() {
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "1.2", "10"))
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1.3", "10"))
+
+	order, exist := s.book.GetOrderByID("o1")
+	s.True(exist)
+	s.Equal("1.2", order.Price.String())
+
+	_, exist = s.book.GetOrder("o1", "sell", decimal.NewFromFloat(1.3))
+	s.False(exist)
+
+	// amended orders are found at their new price
+	_, err := s.book.AmendOrder(order, decimal.NewFromFloat(1.4), decimal.NewFromFloat(20))
+	s.Nil(err)
+	order, exist = s.book.GetOrderByID("o1")
+	s.True(exist)
+	s.Equal("1.4", order.Price.String())
+
+	// fully matched orders leave the index
+	s.book.ExecuteMatch(NewLimitOrder("o3", "buy", "1.3", "10"), amtDecimals)
+	_, exist = s.book.GetOrderByID("o2")
+	s.False(exist)
+
+	removed, event := s.book.RemoveOrderByID("o1")
+	s.Equal(order, removed)
+	s.Equal("-20", event.Amount.String())
+
+	removed, event = s.book.RemoveOrderByID("o1")
+	s.Nil(removed)
+	s.Nil(event)
+	s.Equal(0, len(s.book.Orders()))
+}
+
+func (s *orderbookTestSuite) TestRestoredOrderbookIndexesOrderByID() {
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "1.2", "10"))
+
+	data, err := s.book.MarshalBinary()
+	s.Nil(err)
+
+	book, err := RestoreOrderbook("test", data)
+	s.Nil(err)
+
+	order, exist := book.GetOrderByID("o1")
+	s.True(exist)
+	s.Equal("10", order.Amount.String())
+}
+
+func (s *orderbookTestSuite) TestUncrossAtAuctionPrice() {
+	s.book.InsertOrder(NewLimitOrder("b1", "buy", "1.2", "10"))
+	s.book.InsertOrder(NewLimitOrder("b2", "buy", "1.1", "10"))
+	s.book.InsertOrder(NewLimitOrder("b3", "buy", "1.0", "10"))
+	s.book.InsertOrder(NewLimitOrder("a1", "sell", "0.9", "5"))
+	s.book.InsertOrder(NewLimitOrder("a2", "sell", "1.0", "10"))
+	s.book.InsertOrder(NewLimitOrder("a3", "sell", "1.1", "10"))
+
+	// 20 is executed at 1.1, 15 at 1.0
+	price, volume := s.book.AuctionPrice()
+	s.Equal("1.1", price.String())
+	s.Equal("20", volume.String())
+
+	price, results := s.book.Uncross()
+	s.Equal("1.1", price.String())
+	s.Equal(2, len(results))
+
+	s.Equal("b1", results[0].TakerOrder.ID)
+	s.True(results[0].TakerOrderIsDone)
+	s.Equal(2, len(results[0].MatchItems))
+	s.Equal("a1", results[0].MatchItems[0].MakerOrder.ID)
+	s.True(results[0].MatchItems[0].MakerOrderIsDone)
+	s.Equal("5", results[0].MatchItems[1].MatchedAmount.String())
+	s.False(results[0].MatchItems[1].MakerOrderIsDone)
+	s.Equal("11", results[0].QuoteTokenTotalMatchedAmt().String())
+
+	s.Equal("b2", results[1].TakerOrder.ID)
+	s.Equal("a2", results[1].MatchItems[0].MakerOrder.ID)
+	s.Equal("a3", results[1].MatchItems[1].MakerOrder.ID)
+	s.Equal("1.1", results[1].LastMatchedPrice().String())
+	s.Equal(3, len(results[1].OrderBookActivities))
+
+	s.Equal(&SnapshotV2{
+		Bids: [][2]string{{"1", "10"}},
+		Asks: [][2]string{{"1.1", "5"}},
+	}, s.book.SnapshotV2())
+
+	price, volume = s.book.AuctionPrice()
+	s.True(price.IsZero())
+	s.True(volume.IsZero())
+
+	_, results = s.book.Uncross()
+	s.Equal(0, len(results))
+}
+
+func (s *orderbookTestSuite) TestUncrossSelfTradePrevention() {
+	newBook := func(mode string) *Orderbook {
+		book := NewOrderbook("test")
+		s.Nil(book.SetSelfTradePrevention(mode))
+
+		buy := NewLimitOrder("b1", "buy", "1.2", "10")
+		buy.Trader = "0xaaa"
+		buy.GasFeeAmount = decimal.NewFromFloat(0.1)
+		self := NewLimitOrder("a1", "sell", "1.0", "5")
+		self.Trader = "0xAAA"
+		other := NewLimitOrder("a2", "sell", "1.1", "10")
+		other.Trader = "0xbbb"
+		other.GasFeeAmount = decimal.NewFromFloat(0.2)
+
+		book.InsertOrder(buy)
+		book.InsertOrder(self)
+		book.InsertOrder(other)
+
+		return book
+	}
+
+	// the sell of the same trader is canceled, the buy takes the other sell
+	book := newBook(SelfTradePreventionCancelOldest)
+	price, results := book.Uncross()
+	s.Equal("1.1", price.String())
+	s.Equal(1, len(results))
+	s.True(results[0].ExistSelfTrade())
+	s.Equal("a1", results[0].SelfTradeItems[0].MakerOrder.ID)
+	s.Equal("5", results[0].SelfTradeItems[0].CanceledAmount.String())
+	s.Equal(1, len(results[0].MatchItems))
+	s.Equal("a2", results[0].MatchItems[0].MakerOrder.ID)
+	s.True(results[0].TakerOrderIsDone)
+
+	// gas fees are paid after the match
+	s.Equal("0.1", results[0].TakerGasFeeAmount.String())
+	s.Equal("0.2", results[0].MatchItems[0].MakerGasFeeAmount.String())
+	s.True(results[0].MatchItems[0].MakerOrder.GasFeeAmount.IsZero())
+	s.Equal(&SnapshotV2{Bids: [][2]string{}, Asks: [][2]string{}}, book.SnapshotV2())
+
+	// the buy is canceled before it reaches the other sell
+	book = newBook(SelfTradePreventionCancelNewest)
+	_, results = book.Uncross()
+	s.Equal(1, len(results))
+	s.Equal(0, len(results[0].MatchItems))
+	s.Equal("10", results[0].TakerOrderSelfTradeCanceledAmount.String())
+	s.True(results[0].TakerOrderIsDone)
+	s.Equal(&SnapshotV2{
+		Bids: [][2]string{},
+		Asks: [][2]string{{"1", "5"}, {"1.1", "10"}},
+	}, book.SnapshotV2())
+}
+
+func (s *orderbookTestSuite) TestUncrossCancelsSmallMatches() {
+	buy := NewLimitOrder("b1", "buy", "1.1", "10")
+	sell := NewLimitOrder("a1", "sell", "1.0", "1")
+	sell.GasFeeAmount = decimal.NewFromFloat(5)
+	s.book.InsertOrder(buy)
+	s.book.InsertOrder(sell)
+
+	_, results := s.book.Uncross()
+	s.Equal(1, len(results))
+	s.True(results[0].MatchItems[0].MatchShouldBeCanceled)
+	s.True(results[0].LastMatchedPrice().IsZero())
+
+	// the gas of a canceled match is not paid
+	s.Equal("5", sell.GasFeeAmount.String())
+	s.True(results[0].MatchItems[0].MakerGasFeeAmount.IsZero())
+}
+
+func (s *orderbookTestSuite) TestAuctionPriceTieBreak() {
+	s.book.InsertOrder(NewLimitOrder("b1", "buy", "1.1", "10"))
+	s.book.InsertOrder(NewLimitOrder("a1", "sell", "1.0", "10"))
+
+	// no imbalance at both prices
+	price, _ := s.book.AuctionPrice()
+	s.Equal("1", price.String())
+
+	// more buy amount pushes the price up
+	s.book.InsertOrder(NewLimitOrder("b2", "buy", "1.1", "10"))
+	price, volume := s.book.AuctionPrice()
+	s.Equal("1.1", price.String())
+	s.Equal("10", volume.String())
+}
+
 func TestOrderbookTestSuite(t *testing.T) {
 	suite.Run(t, new(orderbookTestSuite))
 }
@@ -253,3 +1216,155 @@ func NewOrder(id, side, price, amount, _type string) *MemoryOrder {
 		Type:   _type,
 	}
 }
+
+type orderbookConcurrencyTestSuite struct {
+	suite.Suite
+	book *Orderbook
+
+	// checksum of the book after every event, indexed by sequence
+	checksums map[uint64]uint32
+}
+
+func (s *orderbookConcurrencyTestSuite) SetupTest() {
+	s.book = NewOrderbook("test")
+	s.checksums = make(map[uint64]uint32)
+
+	// plugins run under the book lock
+	s.book.UsePlugin(func(e *OrderbookEvent) {
+		s.book.Sequence = s.book.Sequence + 1
+		s.checksums[s.book.Sequence] = e.Checksum
+	})
+}
+
+func TestOrderbookConcurrencyTestSuite(t *testing.T) {
+	suite.Run(t, new(orderbookConcurrencyTestSuite))
+}
+
+func (s *orderbookConcurrencyTestSuite) assertLevelsAreConsistent() {
+	for _, tree := range []*llrb.LLRB{s.book.asksTree, s.book.bidsTree} {
+		tree.AscendGreaterOrEqual(newPriceLevel(decimal.Zero), func(i llrb.Item) bool {
+			pl := i.(*priceLevel)
+			s.True(pl.Len() > 0)
+
+			total := decimal.Zero
+			iter := pl.orderMap.IterFunc()
+			for kv, ok := iter(); ok; kv, ok = iter() {
+				total = total.Add(kv.Value.(*MemoryOrder).DisplayedAmount())
+			}
+
+			s.True(total.Equal(pl.totalAmount), "level %s total %s, orders %s", pl.price, pl.totalAmount, total)
+			return true
+		})
+	}
+}
+
+func (s *orderbookConcurrencyTestSuite) TestConcurrentMakersAndTakers() {
+	const makers, takers, ordersPerWorker = 4, 4, 50
+
+	var wg sync.WaitGroup
+	var resultsLock sync.Mutex
+	results := make([]*MatchResult, 0)
+
+	for i := 0; i < makers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < ordersPerWorker; j++ {
+				price := fmt.Sprintf("1.%d", j%5)
+				s.book.InsertOrder(NewLimitOrder(fmt.Sprintf("maker-%d-%d", worker, j), "sell", price, "10"))
+			}
+		}(i)
+	}
+
+	for i := 0; i < takers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < ordersPerWorker; j++ {
+				result := s.book.ExecuteMatch(NewLimitOrder(fmt.Sprintf("taker-%d-%d", worker, j), "buy", "1.4", "7"), 5)
+
+				resultsLock.Lock()
+				results = append(results, result)
+				resultsLock.Unlock()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	s.assertLevelsAreConsistent()
+
+	matchedAmount := decimal.Zero
+	seenSequences := make(map[uint64]bool)
+
+	for _, result := range results {
+		for _, item := range result.MatchItems {
+			if !item.MatchShouldBeCanceled {
+				matchedAmount = matchedAmount.Add(item.MatchedAmount)
+			}
+		}
+
+		// the fills of a match are consecutive changes
+		var lastSequence uint64
+		for _, msg := range result.OrderBookActivities {
+			payload := msg.Payload.(*WebsocketMarketOrderChangePayload)
+
+			s.False(seenSequences[payload.Sequence])
+			seenSequences[payload.Sequence] = true
+
+			if lastSequence > 0 {
+				s.Equal(lastSequence+1, payload.Sequence)
+			}
+			lastSequence = payload.Sequence
+
+			s.Equal(s.checksums[payload.Sequence], payload.Checksum)
+		}
+	}
+
+	restAmount := decimal.Zero
+	for _, order := range s.book.Orders() {
+		restAmount = restAmount.Add(order.Amount)
+	}
+
+	s.Equal("2000", matchedAmount.Add(restAmount).String())
+	s.Equal(uint64(len(s.checksums)), s.book.Sequence)
+	s.Equal(s.checksums[s.book.Sequence], s.book.Checksum())
+}
+
+func (s *orderbookConcurrencyTestSuite) TestConcurrentReadersDuringMatch() {
+	for i := 0; i < 100; i++ {
+		s.book.InsertOrder(NewLimitOrder(fmt.Sprintf("maker-%d", i), "sell", "1.1", "10"))
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			// a reader never sees a half applied match
+			snapshot := s.book.SnapshotV2()
+			if len(snapshot.Asks) > 0 {
+				amount, _ := decimal.NewFromString(snapshot.Asks[0][1])
+				s.True(amount.Mod(decimal.New(25, 0)).IsZero(), "ask amount %s", amount)
+			}
+		}
+	}()
+
+	for i := 0; i < 40; i++ {
+		s.book.ExecuteMatch(NewLimitOrder(fmt.Sprintf("taker-%d", i), "buy", "1.1", "25"), 5)
+	}
+
+	close(done)
+	wg.Wait()
+
+	s.Nil(s.book.MinAsk())
+	s.assertLevelsAreConsistent()
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// Trade is a match of a taker order with a maker order executed by the engine
+type Trade struct {
+	ID           string          `json:"id"`
+	MarketID     string          `json:"marketID"`
+	MakerOrderID string          `json:"makerOrderID"`
+	TakerOrderID string          `json:"takerOrderID"`
+	Price        decimal.Decimal `json:"price"`
+	Amount       decimal.Decimal `json:"amount"`
+
+	// side of the taker order
+	Side string `json:"side"`
+
+	// unix seconds
+	Time uint64 `json:"time"`
+}
+
+func NewTrade(id string, takerOrder *MemoryOrder, item *MatchItem, ts uint64) *Trade {
+	return &Trade{
+		ID:           id,
+		MarketID:     takerOrder.MarketID,
+		MakerOrderID: item.MakerOrder.ID,
+		TakerOrderID: takerOrder.ID,
+		Price:        item.Price(),
+		Amount:       item.MatchedAmount,
+		Side:         takerOrder.Side,
+		Time:         ts,
+	}
+}
@@ -2,12 +2,24 @@ package engine
 
 import (
 	"context"
+	"fmt"
 	"github.com/HydroProtocol/hydro-sdk-backend/common"
+	"github.com/HydroProtocol/hydro-sdk-backend/utils"
+	"github.com/shopspring/decimal"
+	"sort"
 	"sync"
+	"time"
 )
 
+const expirySweepInterval = time.Second
+
+// Engine handles the commands of every market in the goroutine of its MarketHandler.
+// Commands of a market are handled in sequence, markets are handled in parallel.
+// Registered handlers are called by the goroutines of the markets, they should be safe for concurrent use.
+// After ctx is canceled, commands are handled by their callers one market command at a time.
 type Engine struct {
 	marketHandlerMap map[string]*MarketHandler
+	marketsLock      sync.RWMutex
 
 	// Wait for all queue handler exit gracefully
 	Wg sync.WaitGroup
@@ -18,8 +30,34 @@ type Engine struct {
 	dbHandler                  *DBHandler
 	orderBookSnapshotHandler   *OrderBookSnapshotHandler
 	orderBookActivitiesHandler *OrderBookActivitiesHandler
+	orderBookCheckpointHandler *OrderBookCheckpointHandler
+	confirmTransactionHandler  *ConfirmTransactionHandler
+	removedOrdersHandler       *RemovedOrdersHandler
+
+	feeCalculator *common.FeeCalculator
+
+	snapshotAggregations []snapshotAggregation
+
+	// emit per order (L3) messages besides the aggregated level changes
+	l3MessagesEnabled bool
+
+	journal         Journal
+	journalSequence uint64
+
+	// the time of the engine, the time of journal entries when replaying
+	clock     func() time.Time
+	replaying bool
 
+	// guards the journal and the clock
 	lock sync.Mutex
+
+	// commands of all markets run one at a time, see doInAllMarkets
+	barrierLock sync.Mutex
+}
+
+type snapshotAggregation struct {
+	tickSize decimal.Decimal
+	maxDepth int
 }
 
 func NewEngine(ctx context.Context) *Engine {
@@ -27,8 +65,12 @@ func NewEngine(ctx context.Context) *Engine {
 		ctx:              ctx,
 		marketHandlerMap: make(map[string]*MarketHandler),
 		Wg:               sync.WaitGroup{},
+		clock:            time.Now,
 	}
 
+	engine.Wg.Add(1)
+	go engine.runExpirySweeper()
+
 	return engine
 }
 
@@ -42,6 +84,129 @@ func (e *Engine) RegisterOrderBookActivitiesHandler(handler OrderBookActivitiesH
 	e.orderBookActivitiesHandler = &handler
 }
 
+// RegisterRemovedOrdersHandler receives the orders removed from orderbooks without a taker order:
+// expired orders removed by the sweeper, orders canceled by HandleCancelTraderOrders and CloseMarket.
+// The DBHandler gets every one of these orders as the TakerOrder of its own result too,
+// see common.CanceledMatchResult and common.ExpiredMatchResult.
+func (e *Engine) RegisterRemovedOrdersHandler(handler RemovedOrdersHandler) {
+	e.removedOrdersHandler = &handler
+}
+
+// RegisterMarket sets the config of a market, orders of the market are validated by it from now on.
+// Markets which are not registered accept any order.
+func (e *Engine) RegisterMarket(config MarketConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	handler := e.getOrCreateMarketHandler(config.ID)
+	handler.do(func() {
+		handler.setConfig(&config)
+	})
+
+	return nil
+}
+
+// MarketConfig returns the registered config of the market
+func (e *Engine) MarketConfig(marketID string) (MarketConfig, bool) {
+	handler := e.getMarketHandler(marketID)
+	if handler == nil {
+		return MarketConfig{}, false
+	}
+
+	var config *MarketConfig
+	handler.do(func() {
+		config = handler.config
+	})
+
+	if config == nil {
+		return MarketConfig{}, false
+	}
+
+	return *config, true
+}
+
+// ValidateOrder checks the order against its market config without handling it,
+// the error is an *OrderRejectedError if the order is rejected
+func (e *Engine) ValidateOrder(order *common.MemoryOrder) (err error) {
+	handler := e.getMarketHandler(order.MarketID)
+	if handler == nil {
+		return nil
+	}
+
+	handler.do(func() {
+		e.startCommand(nil, handler)
+
+		err = handler.validateOrder(order)
+	})
+
+	return
+}
+
+// Quote simulates the order against its orderbook without changing anything, see common.Orderbook.Quote.
+// The taker fee is calculated by the registered FeeCalculator in registered markets, like the fees of matches.
+// The error is an *OrderRejectedError if the order doesn't fit its market config or status,
+// nothing is filled while the market is halted or in an auction.
+func (e *Engine) Quote(order *common.MemoryOrder) (quote *common.Quote, err error) {
+	handler := e.getMarketHandler(order.MarketID)
+	if handler == nil {
+		return &common.Quote{LeftAmount: order.Amount}, nil
+	}
+
+	handler.do(func() {
+		e.startCommand(nil, handler)
+
+		if err = handler.validateOrder(order); err != nil {
+			return
+		}
+
+		// the order is quoted with the fees it would be accepted with
+		quotedOrder := *order
+		handler.applyDefaultFeeRates(&quotedOrder)
+
+		quote = handler.quote(&quotedOrder, e.feeCalculator)
+	})
+
+	return
+}
+
+// RegisterOrderBookCheckpointHandler makes the engine send a binary checkpoint of every orderbook
+// to the handler every interval until ctx is canceled. Checkpoints can be restored by RestoreOrderbook.
+func (e *Engine) RegisterOrderBookCheckpointHandler(handler OrderBookCheckpointHandler, interval time.Duration) {
+	e.orderBookCheckpointHandler = &handler
+
+	e.Wg.Add(1)
+	go e.runCheckpointer(interval)
+}
+
+// RegisterOrderBookSnapshotAggregation makes the snapshot handler receive an aggregated snapshot
+// of every market besides the raw one, keyed by GetMarketOrderbookAggregatedSnapshotV2Key
+func (e *Engine) RegisterOrderBookSnapshotAggregation(tickSize decimal.Decimal, maxDepth int) error {
+	if !tickSize.IsPositive() {
+		return fmt.Errorf("snapshot aggregation tick size %s is not positive", tickSize.String())
+	}
+
+	if maxDepth < 0 {
+		return fmt.Errorf("snapshot aggregation has negative max depth %d", maxDepth)
+	}
+
+	e.snapshotAggregations = append(e.snapshotAggregations, snapshotAggregation{tickSize: tickSize, maxDepth: maxDepth})
+
+	return nil
+}
+
+// RegisterFeeCalculator makes the engine calculate the fees of matches in registered markets
+// before they are sent to the DBHandler
+func (e *Engine) RegisterFeeCalculator(calculator *common.FeeCalculator) {
+	e.feeCalculator = calculator
+}
+
+// EnableOrderBookL3Messages makes the engine emit add/change/remove messages of every order to the L3 market channel.
+// It should be called before any order is handled.
+func (e *Engine) EnableOrderBookL3Messages() {
+	e.l3MessagesEnabled = true
+}
+
 type DBHandler interface {
 	Update(matchResult common.MatchResult) sync.WaitGroup
 }
@@ -51,26 +216,70 @@ type OrderBookSnapshotHandler interface {
 type OrderBookActivitiesHandler interface {
 	Update(webSocketMessages []common.WebSocketMessage) sync.WaitGroup
 }
+type OrderBookCheckpointHandler interface {
+	Update(marketID string, checkpoint []byte) sync.WaitGroup
+}
+type RemovedOrdersHandler interface {
+	Update(canceledOrders, expiredOrders []*common.MemoryOrder) sync.WaitGroup
+}
 
 func (e *Engine) HandleNewOrder(order *common.MemoryOrder) (matchResult common.MatchResult, hasMatch bool) {
-	e.lock.Lock()
-	defer e.lock.Unlock()
+	handler := e.getOrCreateMarketHandler(order.MarketID)
 
-	// find or create marketHandler if not exist yet
-	if _, exist := e.marketHandlerMap[order.MarketID]; !exist {
-		marketHandler, err := NewMarketHandler(e.ctx, order.MarketID)
-		if err != nil {
-			panic(err)
-		}
+	handler.do(func() {
+		e.startCommand(&JournalEntry{Command: JournalCommandNewOrder, MarketID: order.MarketID, Order: order}, handler)
+
+		matchResult, hasMatch = e.acceptNewOrder(handler, order)
+	})
+
+	return
+}
+
+func (e *Engine) acceptNewOrder(handler *MarketHandler, order *common.MemoryOrder) (matchResult common.MatchResult, hasMatch bool) {
+	if err := handler.validateOrder(order); err != nil {
+		matchResult = handler.rejectNewOrder(order)
+		matchResult.TakerOrderRejectReason = err
+
+		e.triggerDBHandlerIfNotNil(handler, matchResult)
+		e.triggerOrderBookActivityHandlerIfNotNil(matchResult.OrderBookActivities)
 
-		e.marketHandlerMap[order.MarketID] = marketHandler
+		return
 	}
 
-	// feed the handler with this new order
-	handler, _ := e.marketHandlerMap[order.MarketID]
+	handler.applyDefaultFeeRates(order)
+
+	if order.IsStopOrder() && !handler.stopOrderCanBeTriggered(order) {
+		matchResult = handler.handleNewStopOrder(order)
+
+		e.triggerDBHandlerIfNotNil(handler, matchResult)
+		e.triggerOrderBookActivityHandlerIfNotNil(matchResult.OrderBookActivities)
+
+		return
+	}
+
+	matchResult, hasMatch = e.handleNewOrder(handler, order)
+	e.handleTriggeredStopOrders(handler)
+
+	return
+}
+
+// trades of triggered stop orders may trigger more stop orders.
+// A triggered stop order is checked like a new order, it is rejected if it doesn't fit the market status or config now.
+func (e *Engine) handleTriggeredStopOrders(handler *MarketHandler) {
+	for triggered := handler.popTriggeredStopOrders(); len(triggered) > 0; triggered = handler.popTriggeredStopOrders() {
+		for _, stopOrder := range triggered {
+			utils.Debugf("  [Stop Order Triggered] stop price: %s last price: %s (%s)", stopOrder.StopPrice.StringFixed(5), handler.lastTradePrice.StringFixed(5), stopOrder.ID)
+			e.acceptNewOrder(handler, stopOrder)
+		}
+	}
+}
+
+// feed the handler with this new order
+func (e *Engine) handleNewOrder(handler *MarketHandler, order *common.MemoryOrder) (matchResult common.MatchResult, hasMatch bool) {
 	matchResult, hasMatch = handler.handleNewOrder(order)
+	matchResult.OrderBookActivities = append(matchResult.OrderBookActivities, handler.takePendingMessages()...)
 
-	e.triggerDBHandlerIfNotNil(matchResult)
+	e.triggerDBHandlerIfNotNil(handler, matchResult)
 	e.triggerOrderBookSnapshotHandlerIfNotNil(handler)
 	e.triggerOrderBookActivityHandlerIfNotNil(matchResult.OrderBookActivities)
 
@@ -78,62 +287,639 @@ func (e *Engine) HandleNewOrder(order *common.MemoryOrder) (matchResult common.M
 }
 
 func (e *Engine) ReInsertOrder(order *common.MemoryOrder) (msg *common.WebSocketMessage) {
-	e.lock.Lock()
-	defer e.lock.Unlock()
+	handler := e.getOrCreateMarketHandler(order.MarketID)
 
-	if _, exist := e.marketHandlerMap[order.MarketID]; !exist {
-		marketHandler, err := NewMarketHandler(e.ctx, order.MarketID)
-		if err != nil {
-			panic(err)
+	handler.do(func() {
+		e.startCommand(&JournalEntry{Command: JournalCommandReInsertOrder, MarketID: order.MarketID, Order: order}, handler)
+
+		event := handler.insertOrder(order)
+
+		e.triggerOrderBookSnapshotHandlerIfNotNil(handler)
+		e.triggerOrderBookActivityHandlerIfNotEmpty(handler.takePendingMessages())
+
+		if event != nil {
+			changeMsg := common.OrderBookChangeMessage(handler.market, handler.orderbook.Sequence, event.Side, event.Price, event.Amount, event.Checksum)
+			msg = &changeMsg
 		}
+	})
+
+	return
+}
 
-		e.marketHandlerMap[order.MarketID] = marketHandler
+// HandleAmendOrder changes the price and amount of an order in the orderbook.
+//
+// Reducing the amount at the same price keeps the queue position of the order.
+// Otherwise the order is re-queued, it is matched like a new order if newPrice crosses the orderbook.
+func (e *Engine) HandleAmendOrder(order *common.MemoryOrder, newPrice, newAmount decimal.Decimal) (matchResult common.MatchResult, err error) {
+	entry := &JournalEntry{Command: JournalCommandAmendOrder, MarketID: order.MarketID, Order: order, NewPrice: newPrice, NewAmount: newAmount}
+
+	handler := e.getMarketHandler(order.MarketID)
+	if handler == nil {
+		e.startCommand(entry)
+		return matchResult, fmt.Errorf("can't amend order %s of unknown market %s", order.ID, order.MarketID)
 	}
 
-	handler, _ := e.marketHandlerMap[order.MarketID]
-	event := handler.orderbook.InsertOrder(order)
+	handler.do(func() {
+		e.startCommand(entry, handler)
+
+		matchResult, err = e.amendOrder(handler, order, newPrice, newAmount)
+	})
+
+	return
+}
 
+func (e *Engine) amendOrder(handler *MarketHandler, order *common.MemoryOrder, newPrice, newAmount decimal.Decimal) (matchResult common.MatchResult, err error) {
+	bookOrder, exist := handler.orderbook.GetOrderByID(order.ID)
+	if !exist {
+		return matchResult, fmt.Errorf("can't amend order %s which is not in the orderbook", order.ID)
+	}
+
+	amendedOrder := *bookOrder
+	amendedOrder.Price = newPrice
+	amendedOrder.Amount = newAmount
+
+	if err = handler.validateOrder(&amendedOrder); err != nil {
+		return matchResult, err
+	}
+
+	matchResult, err = handler.handleAmendOrder(bookOrder, newPrice, newAmount)
+	if err != nil {
+		return matchResult, err
+	}
+
+	matchResult.OrderBookActivities = append(matchResult.OrderBookActivities, handler.takePendingMessages()...)
+
+	e.triggerDBHandlerIfNotNil(handler, matchResult)
 	e.triggerOrderBookSnapshotHandlerIfNotNil(handler)
+	e.triggerOrderBookActivityHandlerIfNotNil(matchResult.OrderBookActivities)
+
+	e.handleTriggeredStopOrders(handler)
 
+	return matchResult, nil
+}
+
+// HandleCancelOrder cancels the order by its MarketID and ID, other fields are not used
+func (e *Engine) HandleCancelOrder(order *common.MemoryOrder) (msg *common.WebSocketMessage, success bool) {
+	return e.HandleCancelOrderByID(order.MarketID, order.ID)
+}
+
+// HandleCancelOrderByID cancels the order in the orderbook or the stop orders of the market
+func (e *Engine) HandleCancelOrderByID(marketID, orderID string) (msg *common.WebSocketMessage, success bool) {
+	entry := &JournalEntry{Command: JournalCommandCancelOrder, MarketID: marketID, OrderID: orderID}
+
+	handler := e.getMarketHandler(marketID)
+	if handler == nil {
+		e.startCommand(entry)
+		return
+	}
+
+	handler.do(func() {
+		e.startCommand(entry, handler)
+
+		msg, success = e.cancelOrder(handler, orderID)
+	})
+
+	return
+}
+
+func (e *Engine) cancelOrder(handler *MarketHandler, orderID string) (msg *common.WebSocketMessage, success bool) {
+	// a stop order not triggered yet is not in the orderbook
+	if stopOrder, exist := handler.handleCancelStopOrder(orderID); exist {
+		msgs := common.MessagesForUpdateOrder(stopOrder)
+		return &msgs[0], true
+	}
+
+	event := handler.handleCancelOrder(orderID)
 	if event == nil {
 		return
-	} else {
-		msg := common.OrderBookChangeMessage(handler.market, handler.orderbook.Sequence, event.Side, event.Price, event.Amount)
-		return &msg
 	}
+
+	e.triggerOrderBookSnapshotHandlerIfNotNil(handler)
+	e.triggerOrderBookActivityHandlerIfNotEmpty(handler.takePendingMessages())
+
+	changeMsg := common.OrderBookChangeMessage(handler.market, handler.orderbook.Sequence, event.Side, event.Price, event.Amount, event.Checksum)
+
+	return &changeMsg, true
 }
 
-func (e *Engine) HandleCancelOrder(order *common.MemoryOrder) (msg *common.WebSocketMessage, success bool) {
+// HandleCancelTraderOrders cancels all orders of the trader, including stop orders not triggered yet.
+// marketID and side are optional filters, empty means all markets or both sides.
+// Canceled orders are sent to the RemovedOrdersHandler in one batch and to the DB handler one by one,
+// activities are returned and sent in one batch.
+// Canceling in all markets pauses every market until it is done.
+func (e *Engine) HandleCancelTraderOrders(trader, marketID, side string) (canceledOrders []*common.MemoryOrder, activities []common.WebSocketMessage) {
+	entry := &JournalEntry{Command: JournalCommandCancelTrader, MarketID: marketID, Trader: trader, Side: side}
+
+	cancel := func(handlers []*MarketHandler) {
+		e.startCommand(entry, handlers...)
+
+		canceledOrders, activities = e.cancelTraderOrders(handlers, trader, side)
+	}
+
+	if marketID == "" {
+		e.doInAllMarkets(cancel)
+		return
+	}
+
+	handler := e.getMarketHandler(marketID)
+	if handler == nil {
+		cancel(nil)
+		return
+	}
+
+	handler.do(func() {
+		cancel([]*MarketHandler{handler})
+	})
+
+	return
+}
+
+func (e *Engine) cancelTraderOrders(handlers []*MarketHandler, trader, side string) (canceledOrders []*common.MemoryOrder, activities []common.WebSocketMessage) {
+	for _, handler := range handlers {
+		orders, msgs := handler.cancelTraderOrders(trader, side)
+
+		if len(orders) == 0 {
+			continue
+		}
+
+		canceledOrders = append(canceledOrders, orders...)
+		activities = append(activities, msgs...)
+		activities = append(activities, handler.takePendingMessages()...)
+
+		e.triggerDBHandlerWithRemovedOrders(handler, orders, nil)
+		e.triggerOrderBookSnapshotHandlerIfNotNil(handler)
+	}
+
+	if len(canceledOrders) == 0 {
+		return
+	}
+
+	e.triggerRemovedOrdersHandlerIfNotNil(canceledOrders, nil)
+	e.triggerOrderBookActivityHandlerIfNotNil(activities)
+
+	return
+}
+
+// remove expired orders from orderbooks every expirySweepInterval until ctx is canceled
+func (e *Engine) runExpirySweeper() {
+	defer e.Wg.Done()
+
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			utils.Infof("Engine Expiry Sweeper Exit")
+			return
+		case <-ticker.C:
+			e.sweepExpiredOrdersByClock()
+			e.resumeHaltedMarkets()
+		}
+	}
+}
+
+// halted markets are opened when the halt is over, by journal entries when replaying
+func (e *Engine) resumeHaltedMarkets() {
 	e.lock.Lock()
-	defer e.lock.Unlock()
+	replaying := e.replaying
+	e.lock.Unlock()
+
+	if replaying {
+		return
+	}
 
-	handler, _ := e.marketHandlerMap[order.MarketID]
+	for _, handler := range e.sortedMarketHandlers() {
+		handler.do(func() {
+			now := e.startCommand(nil, handler)
+			if !handler.isHaltOverAt(uint64(now.Unix())) {
+				return
+			}
 
-	event := handler.handleCancelOrder(order)
-	if event == nil {
+			e.appendJournal(&JournalEntry{Command: JournalCommandOpenMarket, MarketID: handler.market, Timestamp: now.UnixNano()})
+			e.openMarket(handler)
+		})
+	}
+}
+
+// expired orders are swept by journal entries when replaying
+func (e *Engine) sweepExpiredOrdersByClock() {
+	e.lock.Lock()
+	replaying := e.replaying
+	ts := uint64(e.clock().Unix())
+	e.lock.Unlock()
+
+	if !replaying {
+		e.sweepExpiredOrders(ts)
+	}
+}
+
+// sweepExpiredOrders removes the orders expired at ts market by market,
+// the sweep of a market is recorded only if it removes orders
+func (e *Engine) sweepExpiredOrders(ts uint64) {
+	for _, handler := range e.sortedMarketHandlers() {
+		e.sweepExpiredOrdersOfMarket(handler, ts)
+	}
+}
+
+func (e *Engine) sweepExpiredOrdersOfMarket(handler *MarketHandler, ts uint64) {
+	handler.do(func() {
+		now := e.startCommand(nil, handler)
+
+		if e.removeExpiredOrders(handler, ts) {
+			e.appendJournal(&JournalEntry{Command: JournalCommandSweepExpired, MarketID: handler.market, SweepAt: ts, Timestamp: now.UnixNano()})
+		}
+	})
+}
+
+func (e *Engine) removeExpiredOrders(handler *MarketHandler, ts uint64) bool {
+	expiredOrders, activities := handler.removeExpiredOrders(ts)
+
+	if len(expiredOrders) == 0 {
+		return false
+	}
+
+	activities = append(activities, handler.takePendingMessages()...)
+
+	e.triggerDBHandlerWithRemovedOrders(handler, nil, expiredOrders)
+	e.triggerRemovedOrdersHandlerIfNotNil(nil, expiredOrders)
+	e.triggerOrderBookSnapshotHandlerIfNotNil(handler)
+	e.triggerOrderBookActivityHandlerIfNotNil(activities)
+
+	return true
+}
+
+// startCommand reads the engine clock once for a command and fixes it in the handlers of the command.
+// The entry is recorded with the same time if it is not nil, the command sees this time again when it is replayed.
+// It should be called in the goroutines of the handlers.
+func (e *Engine) startCommand(entry *JournalEntry, handlers ...*MarketHandler) time.Time {
+	now := e.now()
+
+	for _, handler := range handlers {
+		handler.setTime(now)
+	}
+
+	if entry != nil {
+		entry.Timestamp = now.UnixNano()
+		e.appendJournal(entry)
+	}
+
+	return now
+}
+
+func (e *Engine) now() time.Time {
+	e.lock.Lock()
+	clock := e.clock
+	e.lock.Unlock()
+
+	return clock()
+}
+
+// send checkpoints every interval until ctx is canceled
+func (e *Engine) runCheckpointer(interval time.Duration) {
+	defer e.Wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			utils.Infof("Engine Checkpointer Exit")
+			return
+		case <-ticker.C:
+			e.Checkpoint()
+		}
+	}
+}
+
+// Checkpoint sends a binary checkpoint of every orderbook to the checkpoint handler
+func (e *Engine) Checkpoint() {
+	if e.orderBookCheckpointHandler == nil {
 		return
-	} else {
+	}
+
+	for _, handler := range e.sortedMarketHandlers() {
+		var checkpoint []byte
+		var err error
+
+		handler.do(func() {
+			checkpoint, err = handler.orderbook.MarshalBinary()
+		})
+
+		if err != nil {
+			utils.Errorf("checkpoint orderbook error, market: %s, err: %v", handler.market, err)
+			continue
+		}
+
+		(*e.orderBookCheckpointHandler).Update(handler.market, checkpoint)
+	}
+}
+
+// RestoreOrderbook replaces the orderbook of the market with a checkpoint in one shot.
+// It is faster than calling ReInsertOrder for every order on restart.
+// Stop orders are not in the orderbook, they should still be handled by HandleNewOrder.
+func (e *Engine) RestoreOrderbook(marketID string, checkpoint []byte) (err error) {
+	handler := e.getOrCreateMarketHandler(marketID)
+
+	handler.do(func() {
+		e.startCommand(&JournalEntry{Command: JournalCommandRestoreMarket, MarketID: marketID, Checkpoint: checkpoint}, handler)
+
+		if err = handler.restoreOrderbook(checkpoint); err != nil {
+			return
+		}
+
 		e.triggerOrderBookSnapshotHandlerIfNotNil(handler)
+	})
+
+	return
+}
+
+// SnapshotL3 returns every order in the orderbook of the market, nil if the market doesn't exist
+func (e *Engine) SnapshotL3(marketID string) (snapshot *common.SnapshotL3) {
+	handler := e.getMarketHandler(marketID)
+	if handler == nil {
+		return nil
+	}
+
+	handler.do(func() {
+		snapshot = handler.orderbook.SnapshotL3()
+		snapshot.Sequence = handler.orderbook.Sequence
+	})
+
+	return
+}
+
+// SetSelfTradePrevention decides what happens when a taker order meets a maker order of the same trader in this market
+func (e *Engine) SetSelfTradePrevention(marketID string, mode string) (err error) {
+	handler := e.getOrCreateMarketHandler(marketID)
+
+	handler.do(func() {
+		err = handler.setSelfTradePrevention(mode)
+	})
 
-		msg := common.OrderBookChangeMessage(handler.market, handler.orderbook.Sequence, event.Side, event.Price, event.Amount)
-		return &msg, true
+	return
+}
+
+// SetMatcher decides how a price level is shared by takers in this market
+func (e *Engine) SetMatcher(marketID string, matcher common.Matcher) {
+	handler := e.getOrCreateMarketHandler(marketID)
+
+	handler.do(func() {
+		handler.orderbook.SetMatcher(matcher)
+	})
+}
+
+// OpenMarket creates the orderbook of the market if it doesn't exist yet, a closed or cancel only market is reopened.
+// If the market is in an auction, the orderbook is uncrossed at the auction price and continuous trading starts.
+// Every buy order executed by the uncross is the taker of a MatchResult sent to the DB handler.
+func (e *Engine) OpenMarket(marketID string) {
+	handler := e.getOrCreateMarketHandler(marketID)
+
+	handler.do(func() {
+		e.startCommand(&JournalEntry{Command: JournalCommandOpenMarket, MarketID: marketID}, handler)
+
+		e.openMarket(handler)
+	})
+}
+
+func (e *Engine) openMarket(handler *MarketHandler) {
+	handler.setStatus(common.MarketStatusTrading)
+
+	if !handler.inAuction {
+		e.triggerOrderBookActivityHandlerIfNotEmpty(handler.takePendingMessages())
+		return
+	}
+
+	for _, matchResult := range handler.uncross() {
+		e.triggerDBHandlerIfNotNil(handler, matchResult)
+		e.triggerOrderBookActivityHandlerIfNotNil(matchResult.OrderBookActivities)
 	}
+
+	e.triggerOrderBookSnapshotHandlerIfNotNil(handler)
+	e.triggerOrderBookActivityHandlerIfNotEmpty(handler.takePendingMessages())
+
+	e.handleTriggeredStopOrders(handler)
 }
 
-func (e *Engine) triggerDBHandlerIfNotNil(matchResult common.MatchResult) {
+// StartAuction makes the market collect orders without matching until OpenMarket.
+// Market, IOC and FOK orders are rejected in the auction. The price and volume the market would open at
+// are sent to the activity handler whenever the orderbook is changed.
+func (e *Engine) StartAuction(marketID string) {
+	handler := e.getOrCreateMarketHandler(marketID)
+
+	handler.do(func() {
+		e.startCommand(&JournalEntry{Command: JournalCommandStartAuction, MarketID: marketID}, handler)
+
+		handler.startAuction()
+
+		e.triggerOrderBookActivityHandlerIfNotEmpty(handler.takePendingMessages())
+	})
+}
+
+// CloseMarket rejects new orders of the market until OpenMarket. Orders in the orderbook and stop orders
+// are canceled if cancelOrders is true, they are sent like the orders canceled by HandleCancelTraderOrders.
+// The orderbook is kept, its final snapshot is sent to the snapshot handler.
+func (e *Engine) CloseMarket(marketID string, cancelOrders bool) (canceledOrders []*common.MemoryOrder) {
+	handler := e.getOrCreateMarketHandler(marketID)
+
+	handler.do(func() {
+		e.startCommand(&JournalEntry{Command: JournalCommandCloseMarket, MarketID: marketID, CancelOrders: cancelOrders}, handler)
+
+		handler.close(common.MarketStatusClosed)
+
+		var activities []common.WebSocketMessage
+		if cancelOrders {
+			canceledOrders, activities = handler.cancelAllOrders()
+		}
+
+		activities = append(activities, handler.takePendingMessages()...)
+
+		if len(canceledOrders) > 0 {
+			e.triggerDBHandlerWithRemovedOrders(handler, canceledOrders, nil)
+			e.triggerRemovedOrdersHandlerIfNotNil(canceledOrders, nil)
+		}
+
+		e.triggerOrderBookSnapshotHandlerIfNotNil(handler)
+		e.triggerOrderBookActivityHandlerIfNotEmpty(activities)
+	})
+
+	return
+}
+
+// SetMarketCancelOnly rejects new orders and amends of the market until OpenMarket, orders can still be canceled
+func (e *Engine) SetMarketCancelOnly(marketID string) {
+	handler := e.getOrCreateMarketHandler(marketID)
+
+	handler.do(func() {
+		e.startCommand(&JournalEntry{Command: JournalCommandCancelOnly, MarketID: marketID}, handler)
+
+		handler.close(common.MarketStatusCancelOnly)
+
+		e.triggerOrderBookActivityHandlerIfNotEmpty(handler.takePendingMessages())
+	})
+}
+
+// GetOrder returns a copy of the order in the orderbook or the stop orders of the market
+func (e *Engine) GetOrder(marketID, orderID string) (orderCopy *common.MemoryOrder, exist bool) {
+	handler := e.getMarketHandler(marketID)
+	if handler == nil {
+		return nil, false
+	}
+
+	handler.do(func() {
+		order, inBook := handler.orderbook.GetOrderByID(orderID)
+		if !inBook {
+			order, inBook = handler.stopOrderBook.get(orderID)
+		}
+
+		if inBook {
+			copied := *order
+			orderCopy, exist = &copied, true
+		}
+	})
+
+	return
+}
+
+// doInAllMarkets pauses the goroutines of all markets, then runs f with the markets in a fixed sequence.
+// Every command of a market recorded before f is handled before f, every command recorded after f is handled
+// after it, so f is recorded once for all markets. Markets can't be created until f returns.
+func (e *Engine) doInAllMarkets(f func(handlers []*MarketHandler)) {
+	// two callers pausing markets in different sequences would wait for each other
+	e.barrierLock.Lock()
+	defer e.barrierLock.Unlock()
+
+	e.marketsLock.RLock()
+	defer e.marketsLock.RUnlock()
+
+	handlers := e.sortedMarketHandlersLocked()
+
+	resume := make(chan struct{})
+	defer close(resume)
+
+	for _, handler := range handlers {
+		handler.pause(resume)
+	}
+
+	f(handlers)
+}
+
+// getMarketHandler returns the handler of the market, nil if it doesn't exist
+func (e *Engine) getMarketHandler(marketID string) *MarketHandler {
+	e.marketsLock.RLock()
+	defer e.marketsLock.RUnlock()
+
+	return e.marketHandlerMap[marketID]
+}
+
+// find or create marketHandler if not exist yet, the goroutine of a new handler runs until ctx is canceled
+func (e *Engine) getOrCreateMarketHandler(marketID string) *MarketHandler {
+	if handler := e.getMarketHandler(marketID); handler != nil {
+		return handler
+	}
+
+	e.marketsLock.Lock()
+	defer e.marketsLock.Unlock()
+
+	if handler, exist := e.marketHandlerMap[marketID]; exist {
+		return handler
+	}
+
+	marketHandler, err := NewMarketHandler(e.ctx, marketID)
+	if err != nil {
+		panic(err)
+	}
+
+	if e.l3MessagesEnabled {
+		marketHandler.enableL3Messages()
+	}
+
+	marketHandler.setClock(e.now)
+
+	e.marketHandlerMap[marketID] = marketHandler
+
+	e.Wg.Add(1)
+	go marketHandler.run(&e.Wg)
+
+	return marketHandler
+}
+
+// markets in a fixed sequence to make the journal replayable
+func (e *Engine) sortedMarketHandlers() []*MarketHandler {
+	e.marketsLock.RLock()
+	defer e.marketsLock.RUnlock()
+
+	return e.sortedMarketHandlersLocked()
+}
+
+func (e *Engine) sortedMarketHandlersLocked() []*MarketHandler {
+	marketIDs := make([]string, 0, len(e.marketHandlerMap))
+	for marketID := range e.marketHandlerMap {
+		marketIDs = append(marketIDs, marketID)
+	}
+
+	sort.Strings(marketIDs)
+
+	handlers := make([]*MarketHandler, 0, len(marketIDs))
+	for _, marketID := range marketIDs {
+		handlers = append(handlers, e.marketHandlerMap[marketID])
+	}
+
+	return handlers
+}
+
+func (e *Engine) triggerDBHandlerIfNotNil(handler *MarketHandler, matchResult common.MatchResult) {
 	if e.dbHandler != nil {
+		e.calculateFees(handler, &matchResult)
 		(*e.dbHandler).Update(matchResult)
 	}
 }
 
+func (e *Engine) calculateFees(handler *MarketHandler, matchResult *common.MatchResult) {
+	if e.feeCalculator == nil || handler.config == nil || len(matchResult.MatchItems) == 0 {
+		return
+	}
+
+	e.feeCalculator.Calculate(matchResult, handler.config.QuoteTokenDecimals)
+}
+
+// every order removed without a taker order is the taker order of its own result
+func (e *Engine) triggerDBHandlerWithRemovedOrders(handler *MarketHandler, canceledOrders, expiredOrders []*common.MemoryOrder) {
+	for _, order := range canceledOrders {
+		e.triggerDBHandlerIfNotNil(handler, *common.CanceledMatchResult(order))
+	}
+
+	for _, order := range expiredOrders {
+		e.triggerDBHandlerIfNotNil(handler, *common.ExpiredMatchResult(order))
+	}
+}
+
+func (e *Engine) triggerRemovedOrdersHandlerIfNotNil(canceledOrders, expiredOrders []*common.MemoryOrder) {
+	if e.removedOrdersHandler != nil {
+		(*e.removedOrdersHandler).Update(canceledOrders, expiredOrders)
+	}
+}
+
 func (e *Engine) triggerOrderBookSnapshotHandlerIfNotNil(handler *MarketHandler) {
 	if e.orderBookSnapshotHandler != nil {
 		snapshot := handler.orderbook.SnapshotV2()
 		snapshot.Sequence = handler.orderbook.Sequence
+		snapshot.Checksum = common.SnapshotChecksum(snapshot.Bids, snapshot.Asks)
 
 		snapshotKey := common.GetMarketOrderbookSnapshotV2Key(handler.market)
 
 		(*e.orderBookSnapshotHandler).Update(snapshotKey, snapshot)
+
+		for _, aggregation := range e.snapshotAggregations {
+			aggregatedSnapshot := handler.orderbook.AggregatedSnapshotV2(aggregation.tickSize, aggregation.maxDepth)
+			aggregatedSnapshot.Sequence = handler.orderbook.Sequence
+			aggregatedSnapshot.Checksum = common.SnapshotChecksum(aggregatedSnapshot.Bids, aggregatedSnapshot.Asks)
+
+			aggregatedSnapshotKey := common.GetMarketOrderbookAggregatedSnapshotV2Key(handler.market, aggregation.tickSize.String(), aggregation.maxDepth)
+
+			(*e.orderBookSnapshotHandler).Update(aggregatedSnapshotKey, aggregatedSnapshot)
+		}
 	}
 }
 
@@ -142,3 +928,9 @@ func (e *Engine) triggerOrderBookActivityHandlerIfNotNil(msgs []common.WebSocket
 		(*e.orderBookActivitiesHandler).Update(msgs)
 	}
 }
+
+func (e *Engine) triggerOrderBookActivityHandlerIfNotEmpty(msgs []common.WebSocketMessage) {
+	if len(msgs) > 0 {
+		e.triggerOrderBookActivityHandlerIfNotNil(msgs)
+	}
+}
@@ -1,13 +1,20 @@
 package engine
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/HydroProtocol/hydro-sdk-backend/common"
 	"github.com/labstack/gommon/log"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/suite"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 )
 
 type engineTestSuite struct {
@@ -389,6 +396,686 @@ func (s *engineTestSuite) TestHandleOrdersKeepBigRemainingOrder() {
 	s.NotNil(handler.orderbook.MinAsk())
 }
 
+func (s *engineTestSuite) TestIOCOrderRemainingIsNotAddedToBook() {
+	e := NewEngine(context.Background())
+
+	orderSell := common.MemoryOrder{
+		ID:       "fake-id1",
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(1.0),
+		Amount:   decimal.NewFromFloat(50.0),
+		Side:     "sell",
+		Type:     "limit",
+	}
+	orderBuy := common.MemoryOrder{
+		ID:          "fake-id2",
+		MarketID:    "HOT-WETH",
+		Price:       decimal.NewFromFloat(1.0),
+		Amount:      decimal.NewFromFloat(100.0),
+		Side:        "buy",
+		Type:        "limit",
+		TimeInForce: common.TimeInForceIOC,
+	}
+
+	e.HandleNewOrder(&orderSell)
+	matchRst, hasMatch := e.HandleNewOrder(&orderBuy)
+
+	s.True(hasMatch)
+	s.True(matchRst.TakerOrderIsDone)
+	s.False(matchRst.TakerOrderIsRejected)
+	s.True(matchRst.TakerOrderLeftAmount.Equal(decimal.NewFromFloat(50)))
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.Nil(handler.orderbook.MaxBid())
+	s.Nil(handler.orderbook.MinAsk())
+}
+
+func (s *engineTestSuite) TestFOKOrderIsRejectedWhenNotFullyFillable() {
+	e := NewEngine(context.Background())
+
+	orderSell := common.MemoryOrder{
+		ID:       "fake-id1",
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(1.0),
+		Amount:   decimal.NewFromFloat(50.0),
+		Side:     "sell",
+		Type:     "limit",
+	}
+	orderBuy := common.MemoryOrder{
+		ID:          "fake-id2",
+		MarketID:    "HOT-WETH",
+		Price:       decimal.NewFromFloat(1.0),
+		Amount:      decimal.NewFromFloat(100.0),
+		Side:        "buy",
+		Type:        "limit",
+		TimeInForce: common.TimeInForceFOK,
+	}
+
+	e.HandleNewOrder(&orderSell)
+	matchRst, hasMatch := e.HandleNewOrder(&orderBuy)
+
+	s.False(hasMatch)
+	s.True(matchRst.TakerOrderIsRejected)
+	s.Equal(0, len(matchRst.MatchItems))
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.Nil(handler.orderbook.MaxBid())
+
+	sellOrder, _ := handler.orderbook.GetOrder("fake-id1", "sell", decimal.NewFromFloat(1))
+	s.True(sellOrder.Amount.Equal(decimal.NewFromFloat(50)))
+}
+
+func (s *engineTestSuite) TestMakerOnlyOrder() {
+	e := NewEngine(context.Background())
+
+	orderSell := common.MemoryOrder{
+		ID:          "fake-id1",
+		MarketID:    "HOT-WETH",
+		Price:       decimal.NewFromFloat(1.0),
+		Amount:      decimal.NewFromFloat(50.0),
+		Side:        "sell",
+		Type:        "limit",
+		IsMakerOnly: true,
+	}
+	orderBuy := common.MemoryOrder{
+		ID:          "fake-id2",
+		MarketID:    "HOT-WETH",
+		Price:       decimal.NewFromFloat(1.0),
+		Amount:      decimal.NewFromFloat(100.0),
+		Side:        "buy",
+		Type:        "limit",
+		IsMakerOnly: true,
+	}
+
+	// maker only order which doesn't cross stays on book
+	matchRst, _ := e.HandleNewOrder(&orderSell)
+	s.False(matchRst.TakerOrderIsRejected)
+
+	// maker only order which crosses is rejected
+	matchRst, hasMatch := e.HandleNewOrder(&orderBuy)
+	s.False(hasMatch)
+	s.True(matchRst.TakerOrderIsRejected)
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.Nil(handler.orderbook.MaxBid())
+	s.NotNil(handler.orderbook.MinAsk())
+}
+
+func (s *engineTestSuite) TestSelfTradePrevention() {
+	e := NewEngine(context.Background())
+	s.Nil(e.SetSelfTradePrevention("HOT-WETH", common.SelfTradePreventionCancelOldest))
+	s.NotNil(e.SetSelfTradePrevention("HOT-WETH", "unknown"))
+
+	orderSell := common.MemoryOrder{
+		ID:       "fake-id1",
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(1.0),
+		Amount:   decimal.NewFromFloat(100.0),
+		Side:     "sell",
+		Type:     "limit",
+		Trader:   "0xaaa",
+	}
+	orderBuy := common.MemoryOrder{
+		ID:       "fake-id2",
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(1.0),
+		Amount:   decimal.NewFromFloat(100.0),
+		Side:     "buy",
+		Type:     "limit",
+		Trader:   "0xaaa",
+	}
+
+	e.HandleNewOrder(&orderSell)
+	matchRst, hasMatch := e.HandleNewOrder(&orderBuy)
+
+	s.False(hasMatch)
+	s.Equal(1, len(matchRst.SelfTradeItems))
+	s.Equal("fake-id1", matchRst.SelfTradeItems[0].MakerOrder.ID)
+	s.True(orderSell.Amount.IsZero())
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.Nil(handler.orderbook.MinAsk())
+	s.NotNil(handler.orderbook.MaxBid())
+}
+
+func (s *engineTestSuite) newLimitOrder(id, side string, price, amount float64) *common.MemoryOrder {
+	return &common.MemoryOrder{
+		ID:       id,
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(price),
+		Amount:   decimal.NewFromFloat(amount),
+		Side:     side,
+		Type:     "limit",
+	}
+}
+
+func (s *engineTestSuite) TestStopOrdersAreTriggeredInCascade() {
+	e := NewEngine(context.Background())
+
+	e.HandleNewOrder(s.newLimitOrder("sell-1", "sell", 1.0, 100))
+	e.HandleNewOrder(s.newLimitOrder("sell-2", "sell", 1.1, 100))
+
+	stop1 := s.newLimitOrder("stop-1", "buy", 1.1, 50)
+	stop1.StopPrice = decimal.NewFromFloat(1.0)
+	stop2 := s.newLimitOrder("stop-2", "buy", 1.1, 20)
+	stop2.StopPrice = decimal.NewFromFloat(1.1)
+
+	matchRst, hasMatch := e.HandleNewOrder(stop1)
+	s.False(hasMatch)
+	s.Equal("stop-1", matchRst.TakerOrder.ID)
+	e.HandleNewOrder(stop2)
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.Equal(2, handler.stopOrderBook.len())
+	s.Nil(handler.orderbook.MaxBid())
+
+	// trade at 1.0 triggers stop-1, which trades at 1.1 and triggers stop-2
+	_, hasMatch = e.HandleNewOrder(s.newLimitOrder("buy-1", "buy", 1.0, 100))
+	s.True(hasMatch)
+
+	s.Equal(0, handler.stopOrderBook.len())
+	s.True(handler.lastTradePrice.Equal(decimal.NewFromFloat(1.1)))
+
+	sellOrder, _ := handler.orderbook.GetOrder("sell-2", "sell", decimal.NewFromFloat(1.1))
+	s.True(sellOrder.Amount.Equal(decimal.NewFromFloat(30)))
+	s.Nil(handler.orderbook.MaxBid())
+}
+
+func (s *engineTestSuite) TestStopOrderIsTriggeredImmediatelyWhenCrossed() {
+	e := NewEngine(context.Background())
+
+	e.HandleNewOrder(s.newLimitOrder("sell-1", "sell", 1.0, 100))
+	e.HandleNewOrder(s.newLimitOrder("buy-1", "buy", 1.0, 10))
+
+	stop := s.newLimitOrder("stop-1", "sell", 0.9, 50)
+	stop.StopPrice = decimal.NewFromFloat(1.0)
+
+	e.HandleNewOrder(stop)
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.Equal(0, handler.stopOrderBook.len())
+	s.True(handler.orderbook.MinAsk().Equal(decimal.NewFromFloat(0.9)))
+}
+
+func (s *engineTestSuite) TestTriggeredStopOrderIsValidated() {
+	e := NewEngine(context.Background())
+	dbHandler := &matchResultsDBHandler{}
+	e.RegisterDBHandler(dbHandler)
+
+	config := s.hotWethConfig()
+	config.PriceBandRate = decimal.NewFromFloat(0.1)
+	s.Nil(e.RegisterMarket(config))
+
+	e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.0, 10))
+	e.HandleNewOrder(s.newLimitOrder("fake-id2", "buy", 1.0, 1))
+
+	// the price is in the band of 1.0 when the stop order is placed
+	stopOrder := s.newLimitOrder("fake-id3", "buy", 0.91, 10)
+	stopOrder.StopPrice = decimal.NewFromFloat(1.05)
+	matchRst, _ := e.HandleNewOrder(stopOrder)
+	s.False(matchRst.TakerOrderIsRejected)
+
+	// it is out of the band of 1.1 when the stop order is triggered
+	e.HandleNewOrder(s.newLimitOrder("fake-id4", "sell", 1.1, 10))
+	e.HandleNewOrder(s.newLimitOrder("fake-id5", "buy", 1.1, 10))
+
+	matchRst = dbHandler.results[len(dbHandler.results)-1]
+	s.Equal("fake-id3", matchRst.TakerOrder.ID)
+	s.True(matchRst.TakerOrderIsRejected)
+	s.True(errors.Is(matchRst.TakerOrderRejectReason, ErrPriceOutsideBand))
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.Equal(0, handler.stopOrderBook.len())
+	s.Nil(handler.orderbook.MaxBid())
+}
+
+func (s *engineTestSuite) TestCancelStopOrder() {
+	e := NewEngine(context.Background())
+
+	stop := s.newLimitOrder("stop-1", "buy", 1.1, 50)
+	stop.StopPrice = decimal.NewFromFloat(1.0)
+	e.HandleNewOrder(stop)
+
+	msg, success := e.HandleCancelOrder(stop)
+	s.True(success)
+	s.Equal(common.GetAccountChannelID(stop.Trader), msg.ChannelID)
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.Equal(0, handler.stopOrderBook.len())
+
+	// trades no longer trigger the canceled order
+	e.HandleNewOrder(s.newLimitOrder("sell-1", "sell", 1.0, 100))
+	e.HandleNewOrder(s.newLimitOrder("buy-1", "buy", 1.0, 10))
+	s.Nil(handler.orderbook.MaxBid())
+}
+
+type fakeRemovedOrdersHandler struct {
+	canceledOrders [][]*common.MemoryOrder
+	expiredOrders  []*common.MemoryOrder
+}
+
+func (handler *fakeRemovedOrdersHandler) Update(canceledOrders, expiredOrders []*common.MemoryOrder) sync.WaitGroup {
+	if len(canceledOrders) > 0 {
+		handler.canceledOrders = append(handler.canceledOrders, canceledOrders)
+	}
+	handler.expiredOrders = append(handler.expiredOrders, expiredOrders...)
+	return sync.WaitGroup{}
+}
+
+// takerOrdersDBHandler reads the taker order of every result like the DBHandler of the api does
+type takerOrdersDBHandler struct {
+	takerOrderIDs []string
+	lastResult    common.MatchResult
+}
+
+func (handler *takerOrdersDBHandler) Update(matchRst common.MatchResult) sync.WaitGroup {
+	handler.takerOrderIDs = append(handler.takerOrderIDs, matchRst.TakerOrder.ID)
+	handler.lastResult = matchRst
+	return sync.WaitGroup{}
+}
+
+func (s *engineTestSuite) TestSweepExpiredOrders() {
+	e := NewEngine(context.Background())
+	removedOrdersHandler := &fakeRemovedOrdersHandler{}
+	e.RegisterRemovedOrdersHandler(removedOrdersHandler)
+	dbHandler := &takerOrdersDBHandler{}
+	e.RegisterDBHandler(dbHandler)
+
+	now := uint64(time.Now().Unix())
+
+	order1 := s.newLimitOrder("fake-id1", "sell", 1.0, 100)
+	order1.ExpiredAt = now + 10
+	order2 := s.newLimitOrder("fake-id2", "sell", 1.1, 100)
+	order2.ExpiredAt = now + 20
+	order3 := s.newLimitOrder("fake-id3", "sell", 1.2, 100)
+
+	e.HandleNewOrder(order1)
+	e.HandleNewOrder(order2)
+	e.HandleNewOrder(order3)
+
+	// fully matched orders are skipped by the sweeper
+	e.HandleNewOrder(s.newLimitOrder("fake-id4", "buy", 1.0, 100))
+
+	e.sweepExpiredOrders(now + 9)
+	s.Equal(0, len(removedOrdersHandler.expiredOrders))
+
+	e.sweepExpiredOrders(now + 20)
+	s.Equal(1, len(removedOrdersHandler.expiredOrders))
+	s.Equal("fake-id2", removedOrdersHandler.expiredOrders[0].ID)
+
+	// an expired order is the taker order of its own result
+	s.Equal([]string{"fake-id1", "fake-id2", "fake-id3", "fake-id4", "fake-id2"}, dbHandler.takerOrderIDs)
+	s.True(dbHandler.lastResult.TakerOrderIsDone)
+	s.Equal("100", dbHandler.lastResult.TakerOrderLeftAmount.String())
+	s.Equal([]*common.MemoryOrder{order2}, dbHandler.lastResult.ExpiredOrders)
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.True(handler.orderbook.MinAsk().Equal(decimal.NewFromFloat(1.2)))
+}
+
+func (s *engineTestSuite) TestExpiryIndexKeepsOrdersInTheOrderbook() {
+	e := NewEngine(context.Background())
+
+	now := uint64(time.Now().Unix())
+
+	for i, price := range []float64{1.0, 1.1, 1.2} {
+		order := s.newLimitOrder(fmt.Sprintf("fake-id%d", i+1), "sell", price, 100)
+		order.ExpiredAt = now + 10
+		e.HandleNewOrder(order)
+	}
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.Equal(3, handler.expiryIndex.Len())
+
+	// matched, canceled and amended orders don't stay in the index
+	e.HandleNewOrder(s.newLimitOrder("fake-id4", "buy", 1.0, 100))
+	e.HandleCancelOrder(s.newLimitOrder("fake-id2", "sell", 1.1, 100))
+	_, err := e.HandleAmendOrder(s.newLimitOrder("fake-id3", "sell", 1.2, 100), decimal.NewFromFloat(1.3), decimal.NewFromFloat(100))
+	s.Nil(err)
+	s.Equal(1, handler.expiryIndex.Len())
+	s.Equal("fake-id3", handler.expiryIndex.orders[0].ID)
+
+	e.sweepExpiredOrders(now + 10)
+	s.Equal(0, handler.expiryIndex.Len())
+	s.Nil(handler.orderbook.MinAsk())
+}
+
+func (s *engineTestSuite) TestExpiredOrderIsRejected() {
+	e := NewEngine(context.Background())
+
+	order := s.newLimitOrder("fake-id1", "sell", 1.0, 100)
+	order.ExpiredAt = uint64(time.Now().Unix()) - 1
+
+	matchRst, _ := e.HandleNewOrder(order)
+	s.True(matchRst.TakerOrderIsRejected)
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.Nil(handler.orderbook.MinAsk())
+}
+
+func (s *engineTestSuite) TestExpirySweeperExitsWithContext() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := NewEngine(ctx)
+
+	cancel()
+	e.Wg.Wait()
+}
+
+func (s *engineTestSuite) TestProRataMatcher() {
+	e := NewEngine(context.Background())
+	e.SetMatcher("HOT-WETH", &common.ProRataMatcher{MinAllocation: decimal.NewFromFloat(1)})
+
+	e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.0, 75))
+	e.HandleNewOrder(s.newLimitOrder("fake-id2", "sell", 1.0, 25))
+
+	matchRst, hasMatch := e.HandleNewOrder(s.newLimitOrder("fake-id3", "buy", 1.0, 40))
+	s.True(hasMatch)
+	s.Equal(2, len(matchRst.MatchItems))
+	s.Equal("30", matchRst.MatchItems[0].MatchedAmount.String())
+	s.Equal("10", matchRst.MatchItems[1].MatchedAmount.String())
+	s.True(matchRst.TakerOrderIsDone)
+}
+
+func (s *engineTestSuite) hotWethConfig() MarketConfig {
+	return MarketConfig{
+		ID:                 "HOT-WETH",
+		BaseTokenAddress:   "0x4c4fa7e8ea4cfcfc93deae2c0cff142a1dd3a218",
+		BaseTokenDecimals:  18,
+		QuoteTokenAddress:  "0x5c4a4d4cb3fdbdeb3ee1d5f8ae4c4fe1cb4fbdd5",
+		QuoteTokenDecimals: 18,
+		PriceDecimals:      2,
+		AmountDecimals:     1,
+		MinOrderSize:       decimal.NewFromFloat(1),
+		MakerFeeRate:       decimal.NewFromFloat(0.001),
+		TakerFeeRate:       decimal.NewFromFloat(0.003),
+	}
+}
+
+func (s *engineTestSuite) TestRegisterMarket() {
+	e := NewEngine(context.Background())
+
+	s.NotNil(e.RegisterMarket(MarketConfig{}))
+	s.NotNil(e.RegisterMarket(MarketConfig{ID: "HOT-WETH", AmountDecimals: -1}))
+
+	_, exist := e.MarketConfig("HOT-WETH")
+	s.False(exist)
+
+	s.Nil(e.RegisterMarket(s.hotWethConfig()))
+
+	config, exist := e.MarketConfig("HOT-WETH")
+	s.True(exist)
+	s.Equal(s.hotWethConfig(), config)
+	s.Equal(1, e.marketHandlerMap["HOT-WETH"].marketAmountDecimals)
+}
+
+func (s *engineTestSuite) TestRejectOrdersAgainstMarketConfig() {
+	e := NewEngine(context.Background())
+	s.Nil(e.RegisterMarket(s.hotWethConfig()))
+
+	assertRejected := func(order *common.MemoryOrder, reason error) {
+		err := e.ValidateOrder(order)
+
+		var rejectedErr *OrderRejectedError
+		s.True(errors.As(err, &rejectedErr))
+		s.Equal(order.ID, rejectedErr.OrderID)
+		s.True(errors.Is(err, reason))
+
+		matchRst, hasMatch := e.HandleNewOrder(order)
+		s.False(hasMatch)
+		s.True(matchRst.TakerOrderIsRejected)
+		s.Equal(err, matchRst.TakerOrderRejectReason)
+	}
+
+	assertRejected(s.newLimitOrder("fake-id1", "sell", 1.001, 10), ErrPriceDecimalsExceed)
+	assertRejected(s.newLimitOrder("fake-id2", "sell", 1, 10.01), ErrAmountDecimalsExceed)
+	assertRejected(s.newLimitOrder("fake-id3", "sell", 1, 0.5), ErrOrderSizeTooSmall)
+	assertRejected(s.newLimitOrder("fake-id4", "sell", 0, 10), ErrInvalidOrderPrice)
+	assertRejected(s.newLimitOrder("fake-id5", "sell", 1, 0), ErrInvalidOrderAmount)
+	assertRejected(s.newLimitOrder("fake-id6", "short", 1, 10), ErrInvalidOrderSide)
+
+	stopOrder := s.newLimitOrder("fake-id7", "buy", 1, 10)
+	stopOrder.StopPrice = decimal.NewFromFloat(1.005)
+	assertRejected(stopOrder, ErrPriceDecimalsExceed)
+
+	s.Equal(0, len(e.SnapshotL3("HOT-WETH").Asks))
+
+	// the amount of a market buy order is in quote token
+	marketBuy := s.newLimitOrder("fake-id8", "buy", 0, 0.001)
+	marketBuy.Type = "market"
+	s.Nil(e.ValidateOrder(marketBuy))
+
+	s.Nil(e.ValidateOrder(s.newLimitOrder("fake-id9", "sell", 1.01, 1.5)))
+
+	// markets not registered are not validated
+	notRegistered := s.newLimitOrder("fake-id10", "sell", 1.001, 0.01)
+	notRegistered.MarketID = "ABC-WETH"
+	s.Nil(e.ValidateOrder(notRegistered))
+}
+
+func (s *engineTestSuite) TestRejectOrdersBelowMinNotional() {
+	e := NewEngine(context.Background())
+
+	config := s.hotWethConfig()
+	config.MinNotional = decimal.NewFromFloat(-1)
+	s.NotNil(e.RegisterMarket(config))
+
+	config.MinNotional = decimal.NewFromFloat(5)
+	s.Nil(e.RegisterMarket(config))
+
+	// 2 × 2 is less than 5 though the amount is more than the min order size
+	err := e.ValidateOrder(s.newLimitOrder("fake-id1", "sell", 2, 2))
+	s.True(errors.Is(err, ErrNotionalTooSmall))
+
+	matchRst, _ := e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 2, 2))
+	s.True(matchRst.TakerOrderIsRejected)
+	s.True(errors.Is(matchRst.TakerOrderRejectReason, ErrNotionalTooSmall))
+
+	s.Nil(e.ValidateOrder(s.newLimitOrder("fake-id2", "sell", 2, 2.5)))
+
+	// the amount of a market buy order in quote token is its value
+	marketBuy := s.newLimitOrder("fake-id3", "buy", 0, 4.9)
+	marketBuy.Type = "market"
+	s.True(errors.Is(e.ValidateOrder(marketBuy), ErrNotionalTooSmall))
+
+	marketBuy.Amount = decimal.NewFromFloat(5)
+	s.Nil(e.ValidateOrder(marketBuy))
+
+	// a market sell has no price to value it
+	marketSell := s.newLimitOrder("fake-id4", "sell", 0, 1)
+	marketSell.Type = "market"
+	s.Nil(e.ValidateOrder(marketSell))
+}
+
+func (s *engineTestSuite) TestAmendOrder() {
+	e := NewEngine(context.Background())
+
+	e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.0, 100))
+	e.HandleNewOrder(s.newLimitOrder("fake-id2", "sell", 1.0, 100))
+	e.HandleNewOrder(s.newLimitOrder("fake-id3", "buy", 0.9, 100))
+
+	matchRst, err := e.HandleAmendOrder(s.newLimitOrder("fake-id1", "sell", 1.0, 100), decimal.NewFromFloat(1.0), decimal.NewFromFloat(60))
+	s.Nil(err)
+	s.True(matchRst.TakerOrderIsAmended)
+	s.Equal(3, len(matchRst.OrderBookActivities))
+	s.Equal("-40", matchRst.OrderBookActivities[0].Payload.(*common.WebsocketMarketOrderChangePayload).Amount)
+	s.Equal("fake-id1", e.SnapshotL3("HOT-WETH").Asks[0].ID)
+
+	// re-queued order crosses the orderbook
+	matchRst, err = e.HandleAmendOrder(s.newLimitOrder("fake-id3", "buy", 0.9, 100), decimal.NewFromFloat(1.0), decimal.NewFromFloat(80))
+	s.Nil(err)
+	s.True(matchRst.TakerOrderIsAmended)
+	s.Equal("-100", matchRst.OrderBookActivities[0].Payload.(*common.WebsocketMarketOrderChangePayload).Amount)
+	s.Equal(2, len(matchRst.MatchItems))
+	s.Equal("60", matchRst.MatchItems[0].MatchedAmount.String())
+	s.Equal("20", matchRst.MatchItems[1].MatchedAmount.String())
+	s.True(matchRst.TakerOrderIsDone)
+
+	snapshot := e.SnapshotL3("HOT-WETH")
+	s.Equal(0, len(snapshot.Bids))
+	s.Equal([]*common.SnapshotL3Order{{ID: "fake-id2", Price: "1", Amount: "80", Position: 0}}, snapshot.Asks)
+
+	_, err = e.HandleAmendOrder(s.newLimitOrder("fake-id3", "buy", 0.9, 100), decimal.NewFromFloat(1.0), decimal.NewFromFloat(80))
+	s.NotNil(err)
+}
+
+func (s *engineTestSuite) TestAmendOrderIsValidated() {
+	e := NewEngine(context.Background())
+	s.Nil(e.RegisterMarket(s.hotWethConfig()))
+
+	e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.0, 100))
+
+	_, err := e.HandleAmendOrder(s.newLimitOrder("fake-id1", "sell", 1.0, 100), decimal.NewFromFloat(1.001), decimal.NewFromFloat(60))
+	s.True(errors.Is(err, ErrPriceDecimalsExceed))
+	s.Equal("100", e.SnapshotL3("HOT-WETH").Asks[0].Amount)
+}
+
+func (s *engineTestSuite) TestMarketBuyInBaseAmount() {
+	e := NewEngine(context.Background())
+	s.Nil(e.RegisterMarket(s.hotWethConfig()))
+
+	e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.0, 100))
+
+	marketBuy := s.newLimitOrder("fake-id2", "buy", 2, 40.05)
+	marketBuy.Type = "market"
+	marketBuy.AmountInBase = true
+	s.True(errors.Is(e.ValidateOrder(marketBuy), ErrAmountDecimalsExceed))
+
+	marketBuy.Amount = decimal.NewFromFloat(40)
+	matchRst, hasMatch := e.HandleNewOrder(marketBuy)
+	s.True(hasMatch)
+	s.Equal("40", matchRst.MatchItems[0].MatchedAmount.String())
+	s.Equal("0", marketBuy.Amount.String())
+	s.True(matchRst.TakerOrderIsDone)
+	s.Equal("60", e.SnapshotL3("HOT-WETH").Asks[0].Amount)
+}
+
+func (s *engineTestSuite) TestMarketBuyTooSmallForAUnit() {
+	e := NewEngine(context.Background())
+
+	e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 2, 10))
+
+	// 1 quote token can't buy a unit at 2
+	marketBuy := s.newLimitOrder("fake-id2", "buy", 3, 1)
+	marketBuy.Type = "market"
+	matchRst, hasMatch := e.HandleNewOrder(marketBuy)
+	s.False(hasMatch)
+	s.Equal(0, len(matchRst.MatchItems))
+	s.True(matchRst.TakerOrderIsDone)
+	s.True(matchRst.TakerOrderLeftAmount.IsZero())
+	s.Equal("10", e.SnapshotL3("HOT-WETH").Asks[0].Amount)
+	s.Equal(0, len(e.SnapshotL3("HOT-WETH").Bids))
+}
+
+type fakeCheckpointHandler struct {
+	checkpoints map[string][]byte
+}
+
+func (handler *fakeCheckpointHandler) Update(marketID string, checkpoint []byte) sync.WaitGroup {
+	handler.checkpoints[marketID] = checkpoint
+	return sync.WaitGroup{}
+}
+
+func (s *engineTestSuite) TestCheckpointAndRestore() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := NewEngine(ctx)
+	checkpointHandler := &fakeCheckpointHandler{checkpoints: make(map[string][]byte)}
+	e.RegisterOrderBookCheckpointHandler(checkpointHandler, time.Hour)
+
+	now := uint64(time.Now().Unix())
+
+	order1 := s.newLimitOrder("fake-id1", "sell", 1.0, 100)
+	order1.ExpiredAt = now + 10
+
+	e.HandleNewOrder(order1)
+	e.HandleNewOrder(s.newLimitOrder("fake-id2", "sell", 1.0, 100))
+	e.HandleNewOrder(s.newLimitOrder("fake-id3", "buy", 1.0, 40))
+	e.Checkpoint()
+
+	cancel()
+	e.Wg.Wait()
+
+	restored := NewEngine(context.Background())
+	removedOrdersHandler := &fakeRemovedOrdersHandler{}
+	restored.RegisterRemovedOrdersHandler(removedOrdersHandler)
+
+	s.Nil(restored.RestoreOrderbook("HOT-WETH", checkpointHandler.checkpoints["HOT-WETH"]))
+	s.NotNil(restored.RestoreOrderbook("HOT-WETH", []byte("invalid")))
+	s.Equal(e.SnapshotL3("HOT-WETH"), restored.SnapshotL3("HOT-WETH"))
+
+	// expired orders in the checkpoint are swept
+	restored.sweepExpiredOrders(now + 10)
+	s.Equal(1, len(removedOrdersHandler.expiredOrders))
+	s.Equal("fake-id1", removedOrdersHandler.expiredOrders[0].ID)
+	s.Equal("60", removedOrdersHandler.expiredOrders[0].Amount.String())
+}
+
+type fakeSnapshotHandler struct {
+	snapshots map[string]*common.SnapshotV2
+}
+
+func (handler *fakeSnapshotHandler) Update(key string, snapshot *common.SnapshotV2) sync.WaitGroup {
+	handler.snapshots[key] = snapshot
+	return sync.WaitGroup{}
+}
+
+func (s *engineTestSuite) TestAggregatedSnapshot() {
+	e := NewEngine(context.Background())
+	snapshotHandler := &fakeSnapshotHandler{snapshots: make(map[string]*common.SnapshotV2)}
+	e.RegisterOrderBookSnapshotHandler(snapshotHandler)
+	s.Nil(e.RegisterOrderBookSnapshotAggregation(decimal.NewFromFloat(0.1), 10))
+	s.NotNil(e.RegisterOrderBookSnapshotAggregation(decimal.Zero, 10))
+	s.NotNil(e.RegisterOrderBookSnapshotAggregation(decimal.NewFromFloat(-0.1), 10))
+	s.NotNil(e.RegisterOrderBookSnapshotAggregation(decimal.NewFromFloat(0.1), -1))
+
+	e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.01, 100))
+	e.HandleNewOrder(s.newLimitOrder("fake-id2", "sell", 1.02, 100))
+
+	snapshot := snapshotHandler.snapshots[common.GetMarketOrderbookSnapshotV2Key("HOT-WETH")]
+	s.Equal(2, len(snapshot.Asks))
+
+	aggregatedSnapshot := snapshotHandler.snapshots[common.GetMarketOrderbookAggregatedSnapshotV2Key("HOT-WETH", "0.1", 10)]
+	s.Equal([][2]string{{"1.1", "200"}}, aggregatedSnapshot.Asks)
+	s.Equal(snapshot.Sequence, aggregatedSnapshot.Sequence)
+	s.Equal(2, len(snapshotHandler.snapshots))
+}
+
+func (s *engineTestSuite) TestOrderbookChecksum() {
+	e := NewEngine(context.Background())
+
+	_, _ = e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.0, 100))
+	matchRst, _ := e.HandleNewOrder(s.newLimitOrder("fake-id2", "buy", 1.0, 40))
+
+	payload := matchRst.OrderBookActivities[0].Payload.(*common.WebsocketMarketOrderChangePayload)
+	s.Equal(common.SnapshotChecksum(nil, [][2]string{{"1", "60"}}), payload.Checksum)
+	s.Equal(e.marketHandlerMap["HOT-WETH"].orderbook.Checksum(), payload.Checksum)
+}
+
+func (s *engineTestSuite) TestL3Messages() {
+	e := NewEngine(context.Background())
+	e.EnableOrderBookL3Messages()
+
+	_, _ = e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.0, 100))
+	matchRst, _ := e.HandleNewOrder(s.newLimitOrder("fake-id2", "buy", 1.0, 40))
+
+	l3Payloads := make([]*common.WebsocketMarketL3OrderChangePayload, 0)
+	for _, msg := range matchRst.OrderBookActivities {
+		if msg.ChannelID == common.GetMarketL3ChannelID("HOT-WETH") {
+			l3Payloads = append(l3Payloads, msg.Payload.(*common.WebsocketMarketL3OrderChangePayload))
+		}
+	}
+
+	s.Equal(1, len(l3Payloads))
+	s.Equal(common.OrderbookEventChange, l3Payloads[0].Action)
+	s.Equal("fake-id1", l3Payloads[0].OrderID)
+	s.Equal("60", l3Payloads[0].Amount)
+	s.Equal(uint64(2), l3Payloads[0].Sequence)
+
+	snapshot := e.SnapshotL3("HOT-WETH")
+	s.Equal(uint64(2), snapshot.Sequence)
+	s.Equal(1, len(snapshot.Asks))
+	s.Nil(e.SnapshotL3("NOT-EXIST"))
+}
+
 type FakeDBHandler struct {
 }
 
@@ -417,3 +1104,875 @@ func (s *engineTestSuite) TestNewEngineWithDBHandler() {
 	s.False(hasMatch, "should have no match")
 	s.Equal(0, len(matchRst.MatchItems), "should have no match")
 }
+
+type bufferJournal struct {
+	buf bytes.Buffer
+}
+
+func (j *bufferJournal) Append(entry *JournalEntry) error {
+	return json.NewEncoder(&j.buf).Encode(entry)
+}
+
+type jsonDBHandler struct {
+	results [][]byte
+}
+
+func (handler *jsonDBHandler) Update(matchRst common.MatchResult) sync.WaitGroup {
+	bts, _ := json.Marshal(matchRst)
+	handler.results = append(handler.results, bts)
+	return sync.WaitGroup{}
+}
+
+func (s *engineTestSuite) TestReplayJournal() {
+	e := NewEngine(context.Background())
+	journal := &bufferJournal{}
+	e.RegisterJournal(journal)
+	dbHandler := &jsonDBHandler{}
+	e.RegisterDBHandler(dbHandler)
+	snapshotHandler := &fakeSnapshotHandler{snapshots: make(map[string]*common.SnapshotV2)}
+	e.RegisterOrderBookSnapshotHandler(snapshotHandler)
+
+	now := uint64(time.Now().Unix())
+
+	e.OpenMarket("HOT-WETH")
+	expiring := s.newLimitOrder("fake-id1", "sell", 1.3, 100)
+	expiring.ExpiredAt = now + 10
+	e.HandleNewOrder(expiring)
+	e.HandleNewOrder(s.newLimitOrder("fake-id2", "sell", 1.1, 100))
+	e.HandleNewOrder(s.newLimitOrder("fake-id3", "sell", 1.2, 100))
+	e.HandleNewOrder(s.newLimitOrder("fake-id4", "buy", 1.15, 150))
+	e.HandleCancelOrder(s.newLimitOrder("fake-id3", "sell", 1.2, 100))
+	e.HandleNewOrder(s.newLimitOrder("fake-id5", "buy", 1.0, 100))
+	_, _ = e.HandleAmendOrder(s.newLimitOrder("fake-id5", "buy", 1.0, 100), decimal.NewFromFloat(1.05), decimal.NewFromFloat(80))
+	e.sweepExpiredOrders(now + 10)
+
+	// sweeps without expired orders are not recorded
+	e.sweepExpiredOrders(now + 10)
+
+	replayed := NewEngine(context.Background())
+	replayedDBHandler := &jsonDBHandler{}
+	replayed.RegisterDBHandler(replayedDBHandler)
+	replayedSnapshotHandler := &fakeSnapshotHandler{snapshots: make(map[string]*common.SnapshotV2)}
+	replayed.RegisterOrderBookSnapshotHandler(replayedSnapshotHandler)
+
+	s.Nil(replayed.Replay(bytes.NewReader(journal.buf.Bytes())))
+
+	s.Equal(len(dbHandler.results), len(replayedDBHandler.results))
+	for i := range dbHandler.results {
+		s.Equal(string(dbHandler.results[i]), string(replayedDBHandler.results[i]))
+	}
+
+	key := common.GetMarketOrderbookSnapshotV2Key("HOT-WETH")
+	snapshot, _ := json.Marshal(snapshotHandler.snapshots[key])
+	replayedSnapshot, _ := json.Marshal(replayedSnapshotHandler.snapshots[key])
+	s.Equal(string(snapshot), string(replayedSnapshot))
+
+	s.Equal(e.journalSequence, replayed.journalSequence)
+	s.False(replayed.replaying)
+}
+
+func (s *engineTestSuite) TestReplayJournalWithMovingClock() {
+	e := NewEngine(context.Background())
+	journal := &bufferJournal{}
+	e.RegisterJournal(journal)
+	dbHandler := &jsonDBHandler{}
+	e.RegisterDBHandler(dbHandler)
+
+	// every read of the clock is a second later
+	now := time.Unix(1500000000, 0)
+	e.clock = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	expiring := s.newLimitOrder("fake-id1", "sell", 1.0, 10)
+	expiring.ExpiredAt = uint64(now.Unix()) + 3
+	e.HandleNewOrder(expiring)
+	e.HandleNewOrder(s.newLimitOrder("fake-id2", "sell", 1.1, 10))
+	e.HandleNewOrder(s.newLimitOrder("fake-id3", "buy", 1.1, 5))
+	matchRst, _ := e.HandleNewOrder(s.newLimitOrder("fake-id4", "buy", 1.1, 5))
+
+	// the trade time is the time of the command in the journal
+	var entry JournalEntry
+	lines := bytes.Split(bytes.TrimSpace(journal.buf.Bytes()), []byte("\n"))
+	s.Nil(json.Unmarshal(lines[len(lines)-1], &entry))
+	s.Equal(uint64(time.Unix(0, entry.Timestamp).Unix()), matchRst.Trades[0].Time)
+
+	replayed := NewEngine(context.Background())
+	replayedDBHandler := &jsonDBHandler{}
+	replayed.RegisterDBHandler(replayedDBHandler)
+
+	s.Nil(replayed.Replay(bytes.NewReader(journal.buf.Bytes())))
+
+	s.Equal(len(dbHandler.results), len(replayedDBHandler.results))
+	for i := range dbHandler.results {
+		s.Equal(string(dbHandler.results[i]), string(replayedDBHandler.results[i]))
+	}
+}
+
+func (s *engineTestSuite) TestReplayJournalWithSequenceGap() {
+	journal := &bufferJournal{}
+	_ = journal.Append(&JournalEntry{Sequence: 1, Command: JournalCommandOpenMarket, MarketID: "HOT-WETH"})
+	_ = journal.Append(&JournalEntry{Sequence: 3, Command: JournalCommandOpenMarket, MarketID: "HOT-DAI"})
+
+	e := NewEngine(context.Background())
+	err := e.Replay(&journal.buf)
+
+	s.NotNil(err)
+	s.Contains(e.marketHandlerMap, "HOT-WETH")
+	s.NotContains(e.marketHandlerMap, "HOT-DAI")
+}
+
+func (s *engineTestSuite) TestFileJournal() {
+	path := filepath.Join(s.T().TempDir(), "engine.journal")
+	journal, err := OpenFileJournal(path)
+	s.Nil(err)
+
+	e := NewEngine(context.Background())
+	e.RegisterJournal(journal)
+	e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.1, 100))
+	s.Nil(journal.Close())
+
+	file, err := os.Open(path)
+	s.Nil(err)
+	defer file.Close()
+
+	replayed := NewEngine(context.Background())
+	s.Nil(replayed.Replay(file))
+	s.True(replayed.marketHandlerMap["HOT-WETH"].orderbook.MinAsk().Equal(decimal.NewFromFloat(1.1)))
+}
+
+func (s *engineTestSuite) TestQuote() {
+	e := NewEngine(context.Background())
+
+	quote, err := e.Quote(s.newLimitOrder("fake-id1", "buy", 1.1, 10))
+	s.Nil(err)
+	s.True(quote.FilledAmount.IsZero())
+	s.Equal("10", quote.LeftAmount.String())
+
+	s.Nil(e.RegisterMarket(s.hotWethConfig()))
+	e.HandleNewOrder(s.newLimitOrder("fake-id2", "sell", 1, 10))
+	e.HandleNewOrder(s.newLimitOrder("fake-id3", "sell", 1.1, 10))
+
+	order := s.newLimitOrder("fake-id4", "buy", 1.1, 15)
+	order.TakerFeeRate = decimal.NewFromFloat(0.003)
+
+	quote, err = e.Quote(order)
+	s.Nil(err)
+	s.Equal("15", quote.FilledAmount.String())
+	s.Equal("15.5", quote.QuoteAmount.String())
+	s.Equal("1.1", quote.WorstPrice.String())
+	s.Equal("0.0465", quote.TakerFee.String())
+
+	// nothing is executed
+	s.Equal([][2]string{{"1", "10"}, {"1.1", "10"}}, e.marketHandlerMap["HOT-WETH"].orderbook.SnapshotV2().Asks)
+
+	_, err = e.Quote(s.newLimitOrder("fake-id5", "buy", 1.001, 10))
+	s.True(errors.Is(err, ErrPriceDecimalsExceed))
+
+	// self trades are canceled like in matching
+	s.Nil(e.SetSelfTradePrevention("HOT-WETH", common.SelfTradePreventionCancelNewest))
+	maker := s.newLimitOrder("fake-id6", "sell", 1, 10)
+	maker.Trader = "0xaaa"
+	e.HandleNewOrder(maker)
+
+	order = s.newLimitOrder("fake-id10", "buy", 1, 15)
+	order.Trader = "0xAAA"
+	quote, err = e.Quote(order)
+	s.Nil(err)
+	s.Equal("10", quote.FilledAmount.String())
+	s.Equal("5", quote.SelfTradeCanceledAmount.String())
+	s.True(quote.LeftAmount.IsZero())
+
+	expiredOrder := s.newLimitOrder("fake-id7", "buy", 1.1, 15)
+	expiredOrder.ExpiredAt = uint64(time.Now().Unix()) - 1
+	quote, err = e.Quote(expiredOrder)
+	s.Nil(err)
+	s.True(quote.IsRejected)
+
+	// nothing is filled in an auction, orders which can't rest are rejected
+	e.StartAuction("HOT-WETH")
+	quote, err = e.Quote(s.newLimitOrder("fake-id8", "buy", 1.1, 15))
+	s.Nil(err)
+	s.False(quote.IsRejected)
+	s.True(quote.FilledAmount.IsZero())
+	s.Equal("15", quote.LeftAmount.String())
+
+	iocOrder := s.newLimitOrder("fake-id9", "buy", 1.1, 15)
+	iocOrder.TimeInForce = common.TimeInForceIOC
+	quote, err = e.Quote(iocOrder)
+	s.Nil(err)
+	s.True(quote.IsRejected)
+}
+
+func (s *engineTestSuite) TestDefaultFeeRates() {
+	e := NewEngine(context.Background())
+	s.Nil(e.RegisterMarket(s.hotWethConfig()))
+
+	order := s.newLimitOrder("fake-id1", "sell", 1, 10)
+	e.HandleNewOrder(order)
+	s.Equal("0.001", order.MakerFeeRate.String())
+	s.Equal("0.003", order.TakerFeeRate.String())
+
+	// fee rates of the order are kept
+	order = s.newLimitOrder("fake-id2", "sell", 1, 10)
+	order.MakerFeeRate = decimal.NewFromFloat(0.002)
+	e.HandleNewOrder(order)
+	s.Equal("0.002", order.MakerFeeRate.String())
+	s.Equal("0.003", order.TakerFeeRate.String())
+
+	// quotes are made with the default fee rates without changing the order
+	order = s.newLimitOrder("fake-id3", "buy", 1, 10)
+	quote, err := e.Quote(order)
+	s.Nil(err)
+	s.Equal("0.03", quote.TakerFee.String())
+	s.True(order.TakerFeeRate.IsZero())
+}
+
+func (s *engineTestSuite) TestCancelTraderOrders() {
+	e := NewEngine(context.Background())
+	removedOrdersHandler := &fakeRemovedOrdersHandler{}
+	e.RegisterRemovedOrdersHandler(removedOrdersHandler)
+	dbHandler := &takerOrdersDBHandler{}
+	e.RegisterDBHandler(dbHandler)
+
+	newOrder := func(id, marketID, trader, side string, price, amount float64) *common.MemoryOrder {
+		order := s.newLimitOrder(id, side, price, amount)
+		order.MarketID = marketID
+		order.Trader = trader
+		e.HandleNewOrder(order)
+		return order
+	}
+
+	newOrder("mm-1", "HOT-WETH", "mm", "sell", 1.1, 100)
+	newOrder("mm-2", "HOT-WETH", "mm", "sell", 1.2, 100)
+	newOrder("mm-3", "HOT-WETH", "mm", "buy", 0.9, 100)
+	newOrder("mm-4", "HOT-DAI", "mm", "sell", 1.1, 100)
+	newOrder("other-1", "HOT-WETH", "other", "sell", 1.1, 100)
+
+	stop := s.newLimitOrder("mm-5", "buy", 1.3, 10)
+	stop.Trader = "mm"
+	stop.StopPrice = decimal.NewFromFloat(1.25)
+	e.HandleNewOrder(stop)
+
+	// mm-1 is fully matched and leaves the index
+	newOrder("taker-1", "HOT-WETH", "taker", "buy", 1.1, 100)
+
+	canceledOrders, activities := e.HandleCancelTraderOrders("mm", "HOT-WETH", "sell")
+	s.Equal(1, len(canceledOrders))
+	s.Equal("mm-2", canceledOrders[0].ID)
+	s.Equal(3, len(activities))
+
+	canceledOrders, _ = e.HandleCancelTraderOrders("mm", "", "")
+	s.Equal(3, len(canceledOrders))
+	s.Equal("mm-4", canceledOrders[0].ID)
+	s.Equal("mm-3", canceledOrders[1].ID)
+	s.Equal("mm-5", canceledOrders[2].ID)
+
+	s.Equal(2, len(removedOrdersHandler.canceledOrders))
+	s.Equal(canceledOrders, removedOrdersHandler.canceledOrders[1])
+
+	canceledOrders, activities = e.HandleCancelTraderOrders("mm", "", "")
+	s.Equal(0, len(canceledOrders))
+	s.Equal(0, len(activities))
+	s.Equal(2, len(removedOrdersHandler.canceledOrders))
+
+	// every canceled order is the taker order of its own result
+	s.Equal([]string{"mm-2", "mm-4", "mm-3", "mm-5"}, dbHandler.takerOrderIDs[7:])
+	s.True(dbHandler.lastResult.TakerOrderIsCanceled)
+	s.True(dbHandler.lastResult.TakerOrderIsDone)
+
+	hotWeth := e.marketHandlerMap["HOT-WETH"]
+	s.Equal(0, hotWeth.stopOrderBook.len())
+	s.Nil(hotWeth.orderbook.MaxBid())
+	s.Equal(1, len(hotWeth.orderbook.Orders()))
+	s.Nil(e.marketHandlerMap["HOT-DAI"].orderbook.MinAsk())
+
+	// addresses match in any case
+	newOrder("mixed-case-1", "HOT-WETH", "0xAbCd", "sell", 1.3, 100)
+	mixedCaseStop := s.newLimitOrder("mixed-case-2", "buy", 1.5, 10)
+	mixedCaseStop.Trader = "0xABCD"
+	mixedCaseStop.StopPrice = decimal.NewFromFloat(1.45)
+	e.HandleNewOrder(mixedCaseStop)
+
+	canceledOrders, _ = e.HandleCancelTraderOrders("0xabcd", "", "")
+	s.Equal(2, len(canceledOrders))
+	s.Equal("mixed-case-1", canceledOrders[0].ID)
+	s.Equal("mixed-case-2", canceledOrders[1].ID)
+}
+
+func (s *engineTestSuite) TestCancelOrderByID() {
+	e := NewEngine(context.Background())
+	e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.1, 100))
+
+	order, exist := e.GetOrder("HOT-WETH", "fake-id1")
+	s.True(exist)
+	s.Equal("1.1", order.Price.String())
+
+	// the copy doesn't change the book
+	order.Amount = decimal.Zero
+	order, _ = e.GetOrder("HOT-WETH", "fake-id1")
+	s.Equal("100", order.Amount.String())
+
+	_, success := e.HandleCancelOrderByID("ABC-WETH", "fake-id1")
+	s.False(success)
+
+	// price and side of the canceled order are not used
+	msg, success := e.HandleCancelOrder(s.newLimitOrder("fake-id1", "buy", 2, 1))
+	s.True(success)
+	s.Equal("-100", msg.Payload.(*common.WebsocketMarketOrderChangePayload).Amount)
+
+	_, exist = e.GetOrder("HOT-WETH", "fake-id1")
+	s.False(exist)
+	s.Nil(e.marketHandlerMap["HOT-WETH"].orderbook.MinAsk())
+
+	_, success = e.HandleCancelOrderByID("HOT-WETH", "fake-id1")
+	s.False(success)
+}
+
+type fakeActivitiesHandler struct {
+	msgs []common.WebSocketMessage
+}
+
+func (handler *fakeActivitiesHandler) Update(msgs []common.WebSocketMessage) sync.WaitGroup {
+	handler.msgs = append(handler.msgs, msgs...)
+	return sync.WaitGroup{}
+}
+
+func (handler *fakeActivitiesHandler) lastAuctionPayload() *common.WebsocketMarketAuctionPayload {
+	for i := len(handler.msgs) - 1; i >= 0; i-- {
+		if payload, ok := handler.msgs[i].Payload.(*common.WebsocketMarketAuctionPayload); ok {
+			return payload
+		}
+	}
+
+	return nil
+}
+
+func (s *engineTestSuite) TestOpeningAuction() {
+	e := NewEngine(context.Background())
+	activitiesHandler := &fakeActivitiesHandler{}
+	e.RegisterOrderBookActivitiesHandler(activitiesHandler)
+	dbHandler := &jsonDBHandler{}
+	e.RegisterDBHandler(dbHandler)
+
+	e.StartAuction("HOT-WETH")
+	s.Equal("0", activitiesHandler.lastAuctionPayload().Volume)
+
+	// orders collect without matching
+	matchRst, hasMatch := e.HandleNewOrder(s.newLimitOrder("fake-id1", "buy", 1.2, 10))
+	s.False(hasMatch)
+	s.False(matchRst.TakerOrderIsDone)
+	e.HandleNewOrder(s.newLimitOrder("fake-id2", "sell", 1.0, 15))
+
+	payload := activitiesHandler.lastAuctionPayload()
+	s.Equal("1", payload.Price)
+	s.Equal("10", payload.Volume)
+
+	e.HandleNewOrder(s.newLimitOrder("fake-id3", "buy", 1.1, 10))
+	payload = activitiesHandler.lastAuctionPayload()
+	s.Equal("1.1", payload.Price)
+	s.Equal("15", payload.Volume)
+
+	// orders which can't rest are rejected
+	marketOrder := s.newLimitOrder("fake-id4", "buy", 2, 10)
+	marketOrder.Type = "market"
+	matchRst, _ = e.HandleNewOrder(marketOrder)
+	s.True(matchRst.TakerOrderIsRejected)
+
+	handler := e.marketHandlerMap["HOT-WETH"]
+	s.True(handler.orderbook.MaxBid().Equal(decimal.NewFromFloat(1.2)))
+	s.True(handler.orderbook.MinAsk().Equal(decimal.NewFromFloat(1.0)))
+
+	results := len(dbHandler.results)
+	e.OpenMarket("HOT-WETH")
+
+	// fake-id1 and fake-id3 take fake-id2 at 1.1
+	s.Equal(results+2, len(dbHandler.results))
+	s.Equal("1.1", handler.lastTradePrice.String())
+	s.Equal([][2]string{{"1.1", "5"}}, handler.orderbook.SnapshotV2().Bids)
+	s.Nil(handler.orderbook.MinAsk())
+
+	// continuous trading starts
+	_, hasMatch = e.HandleNewOrder(s.newLimitOrder("fake-id5", "sell", 1.1, 5))
+	s.True(hasMatch)
+	s.Nil(handler.orderbook.MaxBid())
+}
+
+func (handler *fakeActivitiesHandler) marketStatusPayloads() []*common.WebsocketMarketStatusPayload {
+	payloads := make([]*common.WebsocketMarketStatusPayload, 0)
+
+	for _, msg := range handler.msgs {
+		if payload, ok := msg.Payload.(*common.WebsocketMarketStatusPayload); ok {
+			payloads = append(payloads, payload)
+		}
+	}
+
+	return payloads
+}
+
+func (s *engineTestSuite) TestPriceBandAndVolatilityHalt() {
+	e := NewEngine(context.Background())
+	activitiesHandler := &fakeActivitiesHandler{}
+	e.RegisterOrderBookActivitiesHandler(activitiesHandler)
+
+	now := time.Unix(1500000000, 0)
+	e.clock = func() time.Time { return now }
+
+	config := s.hotWethConfig()
+	config.PriceBandRate = decimal.NewFromFloat(0.1)
+	config.ReferencePrice = decimal.NewFromFloat(1)
+	config.VolatilityHaltDuration = time.Minute
+	s.Nil(e.RegisterMarket(config))
+
+	matchRst, _ := e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.2, 10))
+	s.True(matchRst.TakerOrderIsRejected)
+	s.True(errors.Is(matchRst.TakerOrderRejectReason, ErrPriceOutsideBand))
+
+	e.HandleNewOrder(s.newLimitOrder("fake-id2", "sell", 1.05, 10))
+	e.HandleNewOrder(s.newLimitOrder("fake-id3", "sell", 1.1, 10))
+
+	// the market order can't buy beyond 1.1 after the reference price changes
+	config.ReferencePrice = decimal.NewFromFloat(0.99)
+	s.Nil(e.RegisterMarket(config))
+
+	marketBuy := s.newLimitOrder("fake-id4", "buy", 2, 100)
+	marketBuy.Type = "market"
+	marketBuy.TimeInForce = common.TimeInForceIOC
+	matchRst, hasMatch := e.HandleNewOrder(marketBuy)
+	s.True(hasMatch)
+	s.True(matchRst.PriceBandReached)
+	s.Equal(1, len(matchRst.MatchItems))
+
+	handler := e.marketHandlerMap["HOT-WETH"]
+	s.True(handler.inAuction)
+
+	payloads := activitiesHandler.marketStatusPayloads()
+	s.Equal(1, len(payloads))
+	s.Equal(common.MarketStatusHalted, payloads[0].Status)
+	s.Equal(uint64(now.Add(time.Minute).Unix()), payloads[0].Until)
+
+	// orders collect without matching during the halt
+	_, hasMatch = e.HandleNewOrder(s.newLimitOrder("fake-id5", "buy", 1.1, 5))
+	s.False(hasMatch)
+
+	e.resumeHaltedMarkets()
+	s.True(handler.inAuction)
+
+	now = now.Add(time.Minute)
+	e.resumeHaltedMarkets()
+	s.False(handler.inAuction)
+	s.Equal("1.1", handler.lastTradePrice.String())
+	s.Nil(handler.orderbook.MaxBid())
+
+	payloads = activitiesHandler.marketStatusPayloads()
+	s.Equal(2, len(payloads))
+	s.Equal(common.MarketStatusTrading, payloads[1].Status)
+}
+
+func (s *engineTestSuite) TestOrderOutsidePriceBand() {
+	e := NewEngine(context.Background())
+	activitiesHandler := &fakeActivitiesHandler{}
+	e.RegisterOrderBookActivitiesHandler(activitiesHandler)
+
+	config := s.hotWethConfig()
+	config.PriceBandRate = decimal.NewFromFloat(0.1)
+	config.ReferencePrice = decimal.NewFromFloat(1)
+	s.Nil(e.RegisterMarket(config))
+
+	e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.05, 10))
+
+	// the best ask is outside the band after the reference price changes
+	config.ReferencePrice = decimal.NewFromFloat(0.9)
+	s.Nil(e.RegisterMarket(config))
+
+	// the market order doesn't match and its rest doesn't cross the orderbook
+	marketBuy := s.newLimitOrder("fake-id3", "buy", 2, 100)
+	marketBuy.Type = "market"
+	matchRst, hasMatch := e.HandleNewOrder(marketBuy)
+	s.False(hasMatch)
+	s.True(matchRst.PriceBandReached)
+	s.True(matchRst.TakerOrderIsDone)
+	s.Equal(0, len(matchRst.MatchItems))
+	s.Nil(e.marketHandlerMap["HOT-WETH"].orderbook.MaxBid())
+	s.Equal(0, len(activitiesHandler.marketStatusPayloads()))
+
+	// the market is halted from this path too
+	config.VolatilityHaltDuration = time.Minute
+	s.Nil(e.RegisterMarket(config))
+
+	matchRst, _ = e.HandleNewOrder(s.newLimitOrder("fake-id4", "buy", 2, 100))
+	s.True(matchRst.TakerOrderIsRejected)
+
+	marketBuy = s.newLimitOrder("fake-id5", "buy", 2, 100)
+	marketBuy.Type = "market"
+	matchRst, _ = e.HandleNewOrder(marketBuy)
+	s.True(matchRst.PriceBandReached)
+	s.True(e.marketHandlerMap["HOT-WETH"].inAuction)
+	s.Nil(e.marketHandlerMap["HOT-WETH"].orderbook.MaxBid())
+
+	payloads := activitiesHandler.marketStatusPayloads()
+	s.Equal(1, len(payloads))
+	s.Equal(common.MarketStatusHalted, payloads[0].Status)
+}
+
+type matchResultsDBHandler struct {
+	results []common.MatchResult
+}
+
+func (handler *matchResultsDBHandler) Update(matchRst common.MatchResult) sync.WaitGroup {
+	handler.results = append(handler.results, matchRst)
+	return sync.WaitGroup{}
+}
+
+func (s *engineTestSuite) TestFeeCalculator() {
+	e := NewEngine(context.Background())
+	dbHandler := &matchResultsDBHandler{}
+	e.RegisterDBHandler(dbHandler)
+	e.RegisterFeeCalculator(common.NewFeeCalculator(nil))
+
+	config := s.hotWethConfig()
+	config.QuoteTokenDecimals = 4
+	s.Nil(e.RegisterMarket(config))
+
+	maker := s.newLimitOrder("fake-id1", "sell", 1.23, 20)
+	maker.MakerFeeRate = decimal.NewFromFloat(0.001)
+	maker.GasFeeAmount = decimal.NewFromFloat(0.1)
+	e.HandleNewOrder(maker)
+
+	// the rest of the taker rests in the book, its gas fee is still charged with the match
+	taker := s.newLimitOrder("fake-id2", "buy", 1.23, 10)
+	taker.TakerFeeRate = decimal.NewFromFloat(0.003)
+	taker.GasFeeAmount = decimal.NewFromFloat(0.2)
+
+	// quotes are calculated by the fee calculator too
+	quote, err := e.Quote(taker)
+	s.Nil(err)
+	s.Equal("0.0369", quote.TakerFee.String())
+
+	e.HandleNewOrder(taker)
+
+	matchRst := dbHandler.results[len(dbHandler.results)-1]
+	s.Equal(1, len(matchRst.MatchItems))
+	s.Equal("0.0369", matchRst.MatchItems[0].Fee.TakerFee.String())
+	s.Equal("0.0123", matchRst.MatchItems[0].Fee.MakerFee.String())
+	s.Equal("0.2", matchRst.MatchItems[0].Fee.TakerGasFee.String())
+	s.Equal("0.1", matchRst.MatchItems[0].Fee.MakerGasFee.String())
+
+	// the maker has paid its gas fee
+	taker = s.newLimitOrder("fake-id3", "buy", 1.5, 20)
+	taker.GasFeeAmount = decimal.NewFromFloat(0.2)
+	e.HandleNewOrder(taker)
+
+	matchRst = dbHandler.results[len(dbHandler.results)-1]
+	s.Equal(1, len(matchRst.MatchItems))
+	s.Equal("0.2", matchRst.MatchItems[0].Fee.TakerGasFee.String())
+	s.Equal("0", matchRst.MatchItems[0].Fee.MakerGasFee.String())
+}
+
+func (s *engineTestSuite) TestTrades() {
+	e := NewEngine(context.Background())
+
+	now := time.Unix(1500000000, 0)
+	e.clock = func() time.Time { return now }
+
+	e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.0, 10))
+	e.HandleNewOrder(s.newLimitOrder("fake-id2", "sell", 1.1, 10))
+
+	matchRst, _ := e.HandleNewOrder(s.newLimitOrder("fake-id3", "buy", 1.1, 15))
+	s.Equal(2, len(matchRst.Trades))
+
+	trade := matchRst.Trades[0]
+	s.Equal("HOT-WETH", trade.MarketID)
+	s.Equal("fake-id1", trade.MakerOrderID)
+	s.Equal("fake-id3", trade.TakerOrderID)
+	s.Equal("1", trade.Price.String())
+	s.Equal("10", trade.Amount.String())
+	s.Equal("buy", trade.Side)
+	s.Equal(uint64(now.Unix()), trade.Time)
+	s.Equal("1.1", matchRst.Trades[1].Price.String())
+	s.Equal("5", matchRst.Trades[1].Amount.String())
+	s.NotEqual(trade.ID, matchRst.Trades[1].ID)
+
+	var tradeMsgs []*common.WebsocketMarketNewMarketTradePayload
+	for _, msg := range matchRst.OrderBookActivities {
+		if payload, ok := msg.Payload.(*common.WebsocketMarketNewMarketTradePayload); ok {
+			s.Equal(common.GetMarketChannelID("HOT-WETH"), msg.ChannelID)
+			tradeMsgs = append(tradeMsgs, payload)
+		}
+	}
+
+	s.Equal(2, len(tradeMsgs))
+	s.Equal(trade, tradeMsgs[0].Trade)
+
+	// trades of an uncross have different IDs
+	e.StartAuction("HOT-WETH")
+	e.HandleNewOrder(s.newLimitOrder("fake-id4", "buy", 1.2, 2))
+	e.HandleNewOrder(s.newLimitOrder("fake-id5", "buy", 1.2, 3))
+
+	dbHandler := &matchResultsDBHandler{}
+	e.RegisterDBHandler(dbHandler)
+	e.OpenMarket("HOT-WETH")
+
+	s.Equal(2, len(dbHandler.results))
+	s.Equal("1.1", dbHandler.results[0].Trades[0].Price.String())
+	s.NotEqual(dbHandler.results[0].Trades[0].ID, dbHandler.results[1].Trades[0].ID)
+}
+
+func (s *engineTestSuite) TestCloseMarket() {
+	e := NewEngine(context.Background())
+	journal := &bufferJournal{}
+	e.RegisterJournal(journal)
+	activitiesHandler := &fakeActivitiesHandler{}
+	e.RegisterOrderBookActivitiesHandler(activitiesHandler)
+	removedOrdersHandler := &fakeRemovedOrdersHandler{}
+	e.RegisterRemovedOrdersHandler(removedOrdersHandler)
+	dbHandler := &takerOrdersDBHandler{}
+	e.RegisterDBHandler(dbHandler)
+	snapshotHandler := &fakeSnapshotHandler{snapshots: make(map[string]*common.SnapshotV2)}
+	e.RegisterOrderBookSnapshotHandler(snapshotHandler)
+
+	e.HandleNewOrder(s.newLimitOrder("fake-id1", "sell", 1.2, 10))
+	e.HandleNewOrder(s.newLimitOrder("fake-id2", "buy", 1.0, 10))
+
+	assertRejected := func(order *common.MemoryOrder, reason error) {
+		matchRst, _ := e.HandleNewOrder(order)
+		s.True(matchRst.TakerOrderIsRejected)
+		s.True(errors.Is(matchRst.TakerOrderRejectReason, reason))
+	}
+
+	// orders are canceled but not placed in a cancel only market
+	e.SetMarketCancelOnly("HOT-WETH")
+	assertRejected(s.newLimitOrder("fake-id3", "buy", 1.2, 10), ErrMarketCancelOnly)
+	_, err := e.HandleAmendOrder(s.newLimitOrder("fake-id2", "buy", 1.0, 10), decimal.NewFromFloat(1.1), decimal.NewFromFloat(5))
+	s.True(errors.Is(err, ErrMarketCancelOnly))
+
+	_, success := e.HandleCancelOrderByID("HOT-WETH", "fake-id2")
+	s.True(success)
+
+	// the orderbook is kept by default
+	e.CloseMarket("HOT-WETH", false)
+	assertRejected(s.newLimitOrder("fake-id4", "buy", 1.2, 10), ErrMarketClosed)
+	s.Equal(1, len(e.SnapshotL3("HOT-WETH").Asks))
+
+	e.OpenMarket("HOT-WETH")
+	e.HandleNewOrder(s.newLimitOrder("fake-id5", "buy", 1.0, 10))
+
+	stopOrder := s.newLimitOrder("fake-id6", "buy", 1.5, 10)
+	stopOrder.StopPrice = decimal.NewFromFloat(1.5)
+	e.HandleNewOrder(stopOrder)
+
+	results := len(dbHandler.takerOrderIDs)
+	canceledOrders := e.CloseMarket("HOT-WETH", true)
+	s.Equal(3, len(canceledOrders))
+	s.Equal("fake-id5", canceledOrders[0].ID)
+	s.Equal("fake-id1", canceledOrders[1].ID)
+	s.Equal("fake-id6", canceledOrders[2].ID)
+	s.Equal([]string{"fake-id5", "fake-id1", "fake-id6"}, dbHandler.takerOrderIDs[results:])
+	s.Equal([][]*common.MemoryOrder{canceledOrders}, removedOrdersHandler.canceledOrders)
+
+	snapshot := snapshotHandler.snapshots[common.GetMarketOrderbookSnapshotV2Key("HOT-WETH")]
+	s.Equal(0, len(snapshot.Bids))
+	s.Equal(0, len(snapshot.Asks))
+
+	var statuses []string
+	for _, payload := range activitiesHandler.marketStatusPayloads() {
+		statuses = append(statuses, payload.Status)
+	}
+	s.Equal([]string{
+		common.MarketStatusCancelOnly,
+		common.MarketStatusClosed,
+		common.MarketStatusTrading,
+		common.MarketStatusClosed,
+	}, statuses)
+
+	// the status is replayed
+	replayed := NewEngine(context.Background())
+	s.Nil(replayed.Replay(bytes.NewReader(journal.buf.Bytes())))
+	s.Equal(common.MarketStatusClosed, replayed.marketHandlerMap["HOT-WETH"].status)
+	s.Equal(0, len(replayed.SnapshotL3("HOT-WETH").Asks))
+}
+
+// sliceQueue pops its messages in sequence, then cancels the engine and exits the consumer
+type sliceQueue struct {
+	msgs   [][]byte
+	cancel context.CancelFunc
+}
+
+func (q *sliceQueue) Push(msg []byte) error {
+	q.msgs = append(q.msgs, msg)
+	return nil
+}
+
+func (q *sliceQueue) Pop() ([]byte, error) {
+	if len(q.msgs) == 0 {
+		q.cancel()
+		return nil, common.EXIT
+	}
+
+	msg := q.msgs[0]
+	q.msgs = q.msgs[1:]
+
+	return msg, nil
+}
+
+type fakeConfirmTransactionHandler struct {
+	events []common.ConfirmTransactionEvent
+}
+
+func (handler *fakeConfirmTransactionHandler) Update(event common.ConfirmTransactionEvent) sync.WaitGroup {
+	handler.events = append(handler.events, event)
+	return sync.WaitGroup{}
+}
+
+func (s *engineTestSuite) TestEventConsumer() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := NewEngine(ctx)
+	dbHandler := &matchResultsDBHandler{}
+	e.RegisterDBHandler(dbHandler)
+	confirmHandler := &fakeConfirmTransactionHandler{}
+	e.RegisterConfirmTransactionHandler(confirmHandler)
+
+	newOrderEventOfMarket := func(marketID string, order *common.MemoryOrder) []byte {
+		orderJSON, _ := json.Marshal(order)
+		bts, _ := json.Marshal(common.NewOrderEvent{
+			Event: common.Event{Type: common.EventNewOrder, MarketID: marketID},
+			Order: string(orderJSON),
+		})
+		return bts
+	}
+
+	newOrderEvent := func(order *common.MemoryOrder) []byte {
+		return newOrderEventOfMarket(order.MarketID, order)
+	}
+
+	event := func(v interface{}) []byte {
+		bts, _ := json.Marshal(v)
+		return bts
+	}
+
+	otherMarketOrder := s.newLimitOrder("fake-id4", "sell", 1.0, 10)
+	otherMarketOrder.MarketID = "HOT-DAI"
+	otherMarketEvent := newOrderEventOfMarket("HOT-WETH", otherMarketOrder)
+
+	poisonMsgs := [][]byte{
+		[]byte("not json"),
+		event(common.Event{Type: "EVENT/UNKNOWN", MarketID: "HOT-WETH"}),
+		event(common.Event{Type: common.EventCancelOrder}),
+		otherMarketEvent,
+	}
+
+	queue := &sliceQueue{cancel: cancel}
+	_ = queue.Push(newOrderEvent(s.newLimitOrder("fake-id1", "sell", 1.0, 10)))
+	_ = queue.Push(newOrderEvent(s.newLimitOrder("fake-id2", "sell", 1.1, 10)))
+	_ = queue.Push(poisonMsgs[0])
+	_ = queue.Push(newOrderEvent(s.newLimitOrder("fake-id3", "buy", 1.0, 5)))
+	_ = queue.Push(poisonMsgs[1])
+	_ = queue.Push(poisonMsgs[2])
+	_ = queue.Push(event(common.CancelOrderEvent{
+		Event: common.Event{Type: common.EventCancelOrder, MarketID: "HOT-WETH"},
+		ID:    "fake-id2",
+	}))
+	_ = queue.Push(poisonMsgs[3])
+	_ = queue.Push(event(common.ConfirmTransactionEvent{
+		Event: common.Event{Type: common.EventConfirmTransaction, MarketID: "HOT-WETH"},
+		Hash:  "0x123",
+	}))
+	_ = queue.Push(event(common.CloseMarketEvent{
+		Event:      common.Event{Type: common.EventCloseMarket, MarketID: "HOT-WETH"},
+		CancelOnly: true,
+	}))
+
+	deadLetterQueue := &sliceQueue{}
+	e.StartEventConsumer(queue, deadLetterQueue)
+	e.Wg.Wait()
+
+	s.Equal(poisonMsgs, deadLetterQueue.msgs)
+
+	s.Equal(3, len(dbHandler.results))
+	s.Equal("fake-id1", dbHandler.results[2].MatchItems[0].MakerOrder.ID)
+
+	snapshot := e.SnapshotL3("HOT-WETH")
+	s.Equal(1, len(snapshot.Asks))
+	s.Equal("fake-id1", snapshot.Asks[0].ID)
+	s.Nil(e.SnapshotL3("HOT-DAI"))
+
+	s.Equal(1, len(confirmHandler.events))
+	s.Equal("0x123", confirmHandler.events[0].Hash)
+	s.Equal(common.MarketStatusCancelOnly, e.marketHandlerMap["HOT-WETH"].status)
+}
+
+func (s *engineTestSuite) TestMarketsRunConcurrently() {
+	e := NewEngine(context.Background())
+	journal := &bufferJournal{}
+	e.RegisterJournal(journal)
+
+	marketIDs := []string{"HOT-DAI", "HOT-WETH", "WETH-DAI", "ZRX-WETH"}
+
+	var wg sync.WaitGroup
+	for _, marketID := range marketIDs {
+		wg.Add(1)
+
+		go func(marketID string) {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				order := s.newLimitOrder(fmt.Sprintf("%s-%d", marketID, i), []string{"sell", "buy"}[i%2], 1.0+float64(i%5)/10, 10)
+				order.MarketID = marketID
+				order.Trader = []string{"trader-1", "trader-2"}[i%3%2]
+				e.HandleNewOrder(order)
+
+				if i == 25 {
+					e.HandleCancelTraderOrders("trader-2", "", "")
+				}
+			}
+		}(marketID)
+	}
+
+	wg.Wait()
+
+	replayed := NewEngine(context.Background())
+	s.Nil(replayed.Replay(bytes.NewReader(journal.buf.Bytes())))
+
+	for _, marketID := range marketIDs {
+		s.Equal(e.SnapshotL3(marketID), replayed.SnapshotL3(marketID))
+	}
+
+	s.Equal(e.journalSequence, replayed.journalSequence)
+}
+
+func BenchmarkEngineMarkets(b *testing.B) {
+	for _, markets := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("markets-%d", markets), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			e := NewEngine(ctx)
+
+			var wg sync.WaitGroup
+			for m := 0; m < markets; m++ {
+				wg.Add(1)
+
+				go func(marketID string) {
+					defer wg.Done()
+
+					// every buy order is matched by the sell order before it
+					for i := 0; i < b.N/markets; i++ {
+						e.HandleNewOrder(&common.MemoryOrder{
+							ID:       fmt.Sprintf("%s-%d", marketID, i),
+							MarketID: marketID,
+							Price:    decimal.NewFromFloat(1.0),
+							Amount:   decimal.NewFromFloat(10),
+							Side:     []string{"sell", "buy"}[i%2],
+							Type:     "limit",
+						})
+					}
+				}(fmt.Sprintf("MARKET-%d", m))
+			}
+
+			wg.Wait()
+
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "orders/s")
+		})
+	}
+}
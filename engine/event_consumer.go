@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HydroProtocol/hydro-sdk-backend/common"
+	"github.com/HydroProtocol/hydro-sdk-backend/utils"
+	"sync"
+	"time"
+)
+
+// how long the consumer waits after the queue fails, e.g. the connection is lost
+const eventQueueRetryInterval = time.Second
+
+// ErrInvalidEvent is returned by HandleEvent for events which can't be decoded or don't fit their market
+var ErrInvalidEvent = errors.New("invalid engine event")
+
+type ConfirmTransactionHandler interface {
+	Update(event common.ConfirmTransactionEvent) sync.WaitGroup
+}
+
+// RegisterConfirmTransactionHandler receives the EventConfirmTransaction events of the event consumer,
+// they are dropped if it is not registered
+func (e *Engine) RegisterConfirmTransactionHandler(handler ConfirmTransactionHandler) {
+	e.confirmTransactionHandler = &handler
+}
+
+// StartEventConsumer pops the events of the engine from queue, usually HYDRO_ENGINE_EVENTS_QUEUE_KEY,
+// and handles them in sequence until the engine ctx is canceled or Pop returns common.EXIT.
+//
+// Events which can't be decoded or handled are pushed to deadLetterQueue if it is not nil, then dropped.
+// Engine.Wg is done when the consumer exits.
+func (e *Engine) StartEventConsumer(queue, deadLetterQueue common.IQueue) {
+	e.Wg.Add(1)
+	go e.runEventConsumer(queue, deadLetterQueue)
+}
+
+func (e *Engine) runEventConsumer(queue, deadLetterQueue common.IQueue) {
+	defer e.Wg.Done()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			utils.Infof("Engine Event Consumer Exit")
+			return
+		default:
+			msg, err := queue.Pop()
+
+			if err == common.EXIT {
+				utils.Infof("Engine Event Consumer Exit")
+				return
+			} else if err != nil {
+				utils.Errorf("pop engine event error: %v", err)
+
+				select {
+				case <-e.ctx.Done():
+				case <-time.After(eventQueueRetryInterval):
+				}
+
+				continue
+			}
+
+			// nothing popped
+			if len(msg) == 0 {
+				continue
+			}
+
+			if err := e.handleEventSafely(msg); err != nil {
+				utils.Errorf("drop engine event %s: %v", string(msg), err)
+
+				if deadLetterQueue != nil {
+					if err := deadLetterQueue.Push(msg); err != nil {
+						utils.Errorf("push engine event to dead letter queue error: %v", err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// a panic of the engine drops the event instead of killing the consumer
+func (e *Engine) handleEventSafely(msg []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handle engine event panic: %v", r)
+		}
+	}()
+
+	return e.HandleEvent(msg)
+}
+
+// HandleEvent decodes an engine event by its type and calls the engine
+func (e *Engine) HandleEvent(msg []byte) error {
+	var event common.Event
+	if err := json.Unmarshal(msg, &event); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+	}
+
+	if event.MarketID == "" && event.Type != common.EventRestartEngine {
+		return fmt.Errorf("%w: %s event without market", ErrInvalidEvent, event.Type)
+	}
+
+	switch event.Type {
+	case common.EventNewOrder:
+		var newOrderEvent common.NewOrderEvent
+		if err := json.Unmarshal(msg, &newOrderEvent); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+		}
+
+		var order common.MemoryOrder
+		if err := json.Unmarshal([]byte(newOrderEvent.Order), &order); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+		}
+
+		if order.MarketID != event.MarketID {
+			return fmt.Errorf("%w: order %s of market %s in event of market %s", ErrInvalidEvent, order.ID, order.MarketID, event.MarketID)
+		}
+
+		e.HandleNewOrder(&order)
+	case common.EventCancelOrder:
+		var cancelOrderEvent common.CancelOrderEvent
+		if err := json.Unmarshal(msg, &cancelOrderEvent); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+		}
+
+		// canceling an order which is already matched or canceled is not an error
+		e.HandleCancelOrderByID(event.MarketID, cancelOrderEvent.ID)
+	case common.EventOpenMarket:
+		e.OpenMarket(event.MarketID)
+	case common.EventCloseMarket:
+		var closeMarketEvent common.CloseMarketEvent
+		if err := json.Unmarshal(msg, &closeMarketEvent); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+		}
+
+		if closeMarketEvent.CancelOnly {
+			e.SetMarketCancelOnly(event.MarketID)
+		} else {
+			e.CloseMarket(event.MarketID, closeMarketEvent.CancelOrders)
+		}
+	case common.EventConfirmTransaction:
+		var confirmTransactionEvent common.ConfirmTransactionEvent
+		if err := json.Unmarshal(msg, &confirmTransactionEvent); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+		}
+
+		if e.confirmTransactionHandler != nil {
+			(*e.confirmTransactionHandler).Update(confirmTransactionEvent)
+		}
+	case common.EventRestartEngine:
+		// the engine state is rebuilt by the app, e.g. from checkpoints and the journal
+		utils.Infof("engine restart event is ignored by the event consumer")
+	default:
+		return fmt.Errorf("%w: unknown event type %s", ErrInvalidEvent, event.Type)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"container/heap"
+	"github.com/HydroProtocol/hydro-sdk-backend/common"
+)
+
+// expiryIndex is a min heap of orders ordered by ExpiredAt, indexed by order ID.
+// Orders are added by MarketHandler.insertOrder and removed by orderbook remove events,
+// an order added again replaces its entry.
+type expiryIndex struct {
+	orders    []*common.MemoryOrder
+	positions map[string]int
+}
+
+func (idx *expiryIndex) Len() int { return len(idx.orders) }
+
+func (idx *expiryIndex) Less(i, j int) bool { return idx.orders[i].ExpiredAt < idx.orders[j].ExpiredAt }
+
+func (idx *expiryIndex) Swap(i, j int) {
+	idx.orders[i], idx.orders[j] = idx.orders[j], idx.orders[i]
+	idx.positions[idx.orders[i].ID] = i
+	idx.positions[idx.orders[j].ID] = j
+}
+
+func (idx *expiryIndex) Push(x interface{}) {
+	order := x.(*common.MemoryOrder)
+	idx.positions[order.ID] = len(idx.orders)
+	idx.orders = append(idx.orders, order)
+}
+
+func (idx *expiryIndex) Pop() interface{} {
+	n := len(idx.orders)
+	order := idx.orders[n-1]
+	idx.orders[n-1] = nil
+	idx.orders = idx.orders[0 : n-1]
+	delete(idx.positions, order.ID)
+	return order
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{
+		orders:    make([]*common.MemoryOrder, 0),
+		positions: make(map[string]int),
+	}
+}
+
+func (idx *expiryIndex) add(order *common.MemoryOrder) {
+	idx.remove(order.ID)
+
+	if order.ExpiredAt > 0 {
+		heap.Push(idx, order)
+	}
+}
+
+func (idx *expiryIndex) remove(orderID string) {
+	if position, exist := idx.positions[orderID]; exist {
+		heap.Remove(idx, position)
+	}
+}
+
+// popExpired removes and returns all indexed orders expired at ts
+func (idx *expiryIndex) popExpired(ts uint64) []*common.MemoryOrder {
+	expired := make([]*common.MemoryOrder, 0)
+
+	for idx.Len() > 0 && idx.orders[0].IsExpiredAt(ts) {
+		expired = append(expired, heap.Pop(idx).(*common.MemoryOrder))
+	}
+
+	return expired
+}
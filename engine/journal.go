@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/HydroProtocol/hydro-sdk-backend/common"
+	"github.com/shopspring/decimal"
+	"io"
+	"os"
+	"time"
+)
+
+// commands recorded in the engine journal
+const (
+	JournalCommandNewOrder      = "newOrder"
+	JournalCommandCancelOrder   = "cancelOrder"
+	JournalCommandCancelTrader  = "cancelTraderOrders"
+	JournalCommandReInsertOrder = "reInsertOrder"
+	JournalCommandAmendOrder    = "amendOrder"
+	JournalCommandOpenMarket    = "openMarket"
+	JournalCommandStartAuction  = "startAuction"
+	JournalCommandCloseMarket   = "closeMarket"
+	JournalCommandCancelOnly    = "cancelOnly"
+	JournalCommandSweepExpired  = "sweepExpiredOrders"
+	JournalCommandRestoreMarket = "restoreOrderbook"
+)
+
+// JournalEntry is a command that reached the engine.
+// Sequence is global in the engine, Timestamp is the engine clock in nanoseconds when the command is handled.
+type JournalEntry struct {
+	Sequence  uint64 `json:"sequence"`
+	Timestamp int64  `json:"timestamp"`
+	Command   string `json:"command"`
+	MarketID  string `json:"marketID"`
+
+	Order *common.MemoryOrder `json:"order,omitempty"`
+
+	// for cancelOrder, entries with Order are canceled by Order.ID
+	OrderID string `json:"orderID,omitempty"`
+
+	// for amendOrder
+	NewPrice  decimal.Decimal `json:"newPrice"`
+	NewAmount decimal.Decimal `json:"newAmount"`
+
+	// for cancelTraderOrders, MarketID and Side are optional
+	Trader string `json:"trader,omitempty"`
+	Side   string `json:"side,omitempty"`
+
+	// for closeMarket
+	CancelOrders bool `json:"cancelOrders,omitempty"`
+
+	// for sweepExpiredOrders
+	SweepAt uint64 `json:"sweepAt,omitempty"`
+
+	// for restoreOrderbook
+	Checkpoint []byte `json:"checkpoint,omitempty"`
+}
+
+// Journal records every command of the engine in sequence.
+// Append must persist or copy the entry before it returns, the order in it is changed by the engine later.
+type Journal interface {
+	Append(entry *JournalEntry) error
+}
+
+// FileJournal appends entries to a file, one JSON entry per line
+type FileJournal struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func OpenFileJournal(path string) (*FileJournal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileJournal{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (j *FileJournal) Append(entry *JournalEntry) error {
+	return j.encoder.Encode(entry)
+}
+
+func (j *FileJournal) Close() error {
+	return j.file.Close()
+}
+
+// RegisterJournal makes the engine record every command to the journal.
+// It should be called before any command is handled.
+func (e *Engine) RegisterJournal(journal Journal) {
+	e.journal = journal
+}
+
+// appendJournal should be called in the goroutine of the market of the entry, with the Timestamp the command
+// is handled at, see startCommand. Entries of different markets are recorded in the sequence they reach the journal.
+func (e *Engine) appendJournal(entry *JournalEntry) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.journalSequence = e.journalSequence + 1
+
+	entry.Sequence = e.journalSequence
+
+	if e.journal == nil {
+		return
+	}
+
+	if err := e.journal.Append(entry); err != nil {
+		panic(fmt.Errorf("append engine journal error: %v", err))
+	}
+}
+
+// Replay handles every command in a journal written by FileJournal with the clock at the time it was recorded.
+// Replaying a journal into a fresh engine with the same config produces the same orderbooks and handler outputs.
+// The engine should not handle other commands until Replay returns.
+func (e *Engine) Replay(r io.Reader) error {
+	e.lock.Lock()
+	e.replaying = true
+	e.lock.Unlock()
+
+	defer func() {
+		e.lock.Lock()
+		e.replaying = false
+		e.clock = time.Now
+		e.lock.Unlock()
+	}()
+
+	decoder := json.NewDecoder(r)
+
+	for {
+		var entry JournalEntry
+
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		e.lock.Lock()
+		if entry.Sequence != e.journalSequence+1 {
+			e.lock.Unlock()
+			return fmt.Errorf("unexpected journal sequence %d, expected %d", entry.Sequence, e.journalSequence+1)
+		}
+
+		timestamp := entry.Timestamp
+		e.clock = func() time.Time {
+			return time.Unix(0, timestamp)
+		}
+		e.lock.Unlock()
+
+		if err := e.replayEntry(&entry); err != nil {
+			return fmt.Errorf("replay journal entry %d error: %v", entry.Sequence, err)
+		}
+	}
+}
+
+func (e *Engine) replayEntry(entry *JournalEntry) error {
+	if entry.Order == nil && (entry.Command == JournalCommandNewOrder ||
+		entry.Command == JournalCommandReInsertOrder || entry.Command == JournalCommandAmendOrder) {
+		return fmt.Errorf("command %s without order", entry.Command)
+	}
+
+	switch entry.Command {
+	case JournalCommandNewOrder:
+		e.HandleNewOrder(entry.Order)
+	case JournalCommandCancelOrder:
+		if entry.Order != nil {
+			e.HandleCancelOrderByID(entry.MarketID, entry.Order.ID)
+		} else {
+			e.HandleCancelOrderByID(entry.MarketID, entry.OrderID)
+		}
+	case JournalCommandCancelTrader:
+		e.HandleCancelTraderOrders(entry.Trader, entry.MarketID, entry.Side)
+	case JournalCommandReInsertOrder:
+		e.ReInsertOrder(entry.Order)
+	case JournalCommandAmendOrder:
+		// a rejected amend is recorded too
+		_, _ = e.HandleAmendOrder(entry.Order, entry.NewPrice, entry.NewAmount)
+	case JournalCommandOpenMarket:
+		e.OpenMarket(entry.MarketID)
+	case JournalCommandStartAuction:
+		e.StartAuction(entry.MarketID)
+	case JournalCommandCloseMarket:
+		e.CloseMarket(entry.MarketID, entry.CancelOrders)
+	case JournalCommandCancelOnly:
+		e.SetMarketCancelOnly(entry.MarketID)
+	case JournalCommandSweepExpired:
+		handler := e.getMarketHandler(entry.MarketID)
+		if handler == nil {
+			return fmt.Errorf("sweep of unknown market %s", entry.MarketID)
+		}
+
+		e.sweepExpiredOrdersOfMarket(handler, entry.SweepAt)
+	case JournalCommandRestoreMarket:
+		// a failed restore is recorded too
+		_ = e.RestoreOrderbook(entry.MarketID, entry.Checkpoint)
+	default:
+		return fmt.Errorf("unknown journal command %s", entry.Command)
+	}
+
+	return nil
+}
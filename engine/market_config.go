@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HydroProtocol/hydro-sdk-backend/common"
+	"github.com/shopspring/decimal"
+	"time"
+)
+
+// MarketConfig describes a market registered by Engine.RegisterMarket
+type MarketConfig struct {
+	ID string
+
+	BaseTokenAddress   string
+	BaseTokenDecimals  int
+	QuoteTokenAddress  string
+	QuoteTokenDecimals int
+
+	// max decimal places of order prices and base token amounts
+	PriceDecimals  int
+	AmountDecimals int
+
+	// min base token amount of an order, zero means no limit
+	MinOrderSize decimal.Decimal
+
+	// min quote token value of an order, price × amount, zero means no limit
+	MinNotional decimal.Decimal
+
+	// default fee rates of the market, set on accepted orders whose fee rates are zero
+	MakerFeeRate decimal.Decimal
+	TakerFeeRate decimal.Decimal
+
+	// limit orders priced more than PriceBandRate away from the reference price are rejected,
+	// takers stop matching at the band. The reference is ReferencePrice if it is positive,
+	// otherwise the last trade price. Zero PriceBandRate means no band.
+	PriceBandRate  decimal.Decimal
+	ReferencePrice decimal.Decimal
+
+	// a taker stopped by the band halts matching for VolatilityHaltDuration, zero means no halt
+	VolatilityHaltDuration time.Duration
+}
+
+func (c *MarketConfig) validate() error {
+	if c.ID == "" {
+		return fmt.Errorf("market config without ID")
+	}
+
+	if c.PriceDecimals < 0 || c.AmountDecimals < 0 || c.BaseTokenDecimals < 0 || c.QuoteTokenDecimals < 0 {
+		return fmt.Errorf("market %s config has negative decimals", c.ID)
+	}
+
+	if c.MinOrderSize.IsNegative() || c.MinNotional.IsNegative() || c.MakerFeeRate.IsNegative() || c.TakerFeeRate.IsNegative() {
+		return fmt.Errorf("market %s config has negative min order size, min notional or fee rates", c.ID)
+	}
+
+	if c.PriceBandRate.IsNegative() || c.ReferencePrice.IsNegative() || c.VolatilityHaltDuration < 0 {
+		return fmt.Errorf("market %s config has negative price band", c.ID)
+	}
+
+	return nil
+}
+
+// reasons of OrderRejectedError
+var (
+	ErrInvalidOrderMarket   = errors.New("order market mismatch")
+	ErrInvalidOrderSide     = errors.New("invalid order side")
+	ErrInvalidOrderType     = errors.New("invalid order type")
+	ErrInvalidOrderPrice    = errors.New("invalid order price")
+	ErrInvalidOrderAmount   = errors.New("invalid order amount")
+	ErrPriceDecimalsExceed  = errors.New("price exceeds market price decimals")
+	ErrAmountDecimalsExceed = errors.New("amount exceeds market amount decimals")
+	ErrOrderSizeTooSmall    = errors.New("order size is less than market min order size")
+	ErrNotionalTooSmall     = errors.New("order value is less than market min notional")
+	ErrPriceOutsideBand     = errors.New("price is outside market price band")
+	ErrMarketClosed         = errors.New("market is closed")
+	ErrMarketCancelOnly     = errors.New("market only accepts cancels")
+)
+
+// OrderRejectedError is returned when an order doesn't fit its market config or status,
+// Reason is one of the errors above and can be checked with errors.Is
+type OrderRejectedError struct {
+	OrderID  string
+	MarketID string
+	Reason   error
+}
+
+func (e *OrderRejectedError) Error() string {
+	return fmt.Sprintf("order %s of market %s is rejected: %v", e.OrderID, e.MarketID, e.Reason)
+}
+
+func (e *OrderRejectedError) Unwrap() error {
+	return e.Reason
+}
+
+// priceBand returns the bounds of the band around reference, zeros if there is no band
+func (c *MarketConfig) priceBand(lastTradePrice decimal.Decimal) (lower, upper decimal.Decimal) {
+	reference := c.ReferencePrice
+	if !reference.IsPositive() {
+		reference = lastTradePrice
+	}
+
+	if !c.PriceBandRate.IsPositive() || !reference.IsPositive() {
+		return decimal.Zero, decimal.Zero
+	}
+
+	lower = decimal.Max(reference.Mul(decimal.New(1, 0).Sub(c.PriceBandRate)), decimal.Zero)
+	upper = reference.Mul(decimal.New(1, 0).Add(c.PriceBandRate))
+
+	return lower, upper
+}
+
+// applyDefaultFeeRates sets the default fee rates on an order without them
+func (c *MarketConfig) applyDefaultFeeRates(order *common.MemoryOrder) {
+	if order.MakerFeeRate.IsZero() {
+		order.MakerFeeRate = c.MakerFeeRate
+	}
+
+	if order.TakerFeeRate.IsZero() {
+		order.TakerFeeRate = c.TakerFeeRate
+	}
+}
+
+func exceedsDecimals(d decimal.Decimal, decimals int) bool {
+	return !d.Equal(d.Truncate(int32(decimals)))
+}
+
+// validateOrder checks the order against the market config.
+// The amount of a market buy order in quote token is not checked by AmountDecimals and MinOrderSize,
+// it is the value checked by MinNotional. Other market orders have no price for MinNotional.
+func (c *MarketConfig) validateOrder(order *common.MemoryOrder) error {
+	reject := func(reason error) error {
+		return &OrderRejectedError{OrderID: order.ID, MarketID: c.ID, Reason: reason}
+	}
+
+	if order.MarketID != c.ID {
+		return reject(ErrInvalidOrderMarket)
+	}
+
+	if order.Side != "buy" && order.Side != "sell" {
+		return reject(ErrInvalidOrderSide)
+	}
+
+	if order.Type != "limit" && order.Type != "market" {
+		return reject(ErrInvalidOrderType)
+	}
+
+	if order.Price.IsNegative() || (order.Type == "limit" && !order.Price.IsPositive()) {
+		return reject(ErrInvalidOrderPrice)
+	}
+
+	if exceedsDecimals(order.Price, c.PriceDecimals) || exceedsDecimals(order.StopPrice, c.PriceDecimals) {
+		return reject(ErrPriceDecimalsExceed)
+	}
+
+	if !order.Amount.IsPositive() {
+		return reject(ErrInvalidOrderAmount)
+	}
+
+	if order.QuoteAmountLimit.IsNegative() {
+		return reject(ErrInvalidOrderAmount)
+	}
+
+	if order.IsQuoteAmountMarketBuy() {
+		if order.Amount.LessThan(c.MinNotional) {
+			return reject(ErrNotionalTooSmall)
+		}
+
+		return nil
+	}
+
+	if exceedsDecimals(order.Amount, c.AmountDecimals) || exceedsDecimals(order.DisplayAmount, c.AmountDecimals) {
+		return reject(ErrAmountDecimalsExceed)
+	}
+
+	if order.Amount.LessThan(c.MinOrderSize) {
+		return reject(ErrOrderSizeTooSmall)
+	}
+
+	if order.Type == "limit" && order.Price.Mul(order.Amount).LessThan(c.MinNotional) {
+		return reject(ErrNotionalTooSmall)
+	}
+
+	return nil
+}
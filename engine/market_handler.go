@@ -7,6 +7,8 @@ import (
 	"github.com/HydroProtocol/hydro-sdk-backend/utils"
 	"github.com/labstack/gommon/log"
 	"github.com/shopspring/decimal"
+	"sync"
+	"time"
 )
 
 type MarketHandler struct {
@@ -14,14 +16,68 @@ type MarketHandler struct {
 	market               string
 	marketAmountDecimals int
 	orderbook            *common.Orderbook
+
+	// nil if the market is not registered, orders are not validated then
+	config *MarketConfig
+
+	stopOrderBook  *stopOrderBook
+	lastTradePrice decimal.Decimal
+
+	expiryIndex *expiryIndex
+	traderIndex *traderIndex
+
+	// decides which orders are expired, time.Now by default
+	now func() time.Time
+
+	// per order messages collected from orderbook events, nil if not enabled
+	l3Messages []common.WebSocketMessage
+
+	// orders collect without matching in an auction, auctionChanged is set when the orderbook is changed in it
+	inAuction      bool
+	auctionChanged bool
+
+	// unix time a market halted by the price band resumes at, zero if it is not halted
+	haltedUntil uint64
+
+	// trading, closed or cancel only
+	status string
+
+	// market status messages collected since last takePendingMessages
+	statusMessages []common.WebSocketMessage
+
+	// commands of the market, run in sequence by the goroutine of run
+	commands chan func()
+
+	// closed when run exits, commands are run one at a time by their callers then
+	stopped     chan struct{}
+	stoppedLock sync.Mutex
 }
 
-func (m MarketHandler) handleNewOrder(newOrder *common.MemoryOrder) (matchResult common.MatchResult, hasMatchOrder bool) {
+func (m *MarketHandler) handleNewOrder(newOrder *common.MemoryOrder) (matchResult common.MatchResult, hasMatchOrder bool) {
+	if newOrder.IsExpiredAt(uint64(m.now().Unix())) {
+		return m.rejectNewOrder(newOrder), false
+	}
+
+	if m.inAuction {
+		return m.handleNewAuctionOrder(newOrder), false
+	}
+
+	canMatch := m.orderbook.CanMatch(newOrder)
 
-	if m.orderbook.CanMatch(newOrder) {
+	// a FOK order which can't match at all is rejected directly
+	if !canMatch && newOrder.TimeInForce == common.TimeInForceFOK {
+		return m.rejectNewOrder(newOrder), false
+	}
+
+	if canMatch {
 		matchResult = *m.orderbook.ExecuteMatch(newOrder, m.marketAmountDecimals)
 
-		if len(matchResult.MatchItems) == 0 {
+		if matchResult.TakerOrderIsRejected {
+			return m.rejectNewOrder(newOrder), false
+		}
+
+		// a done taker without match items is a market buy order which can't buy a unit
+		if len(matchResult.MatchItems) == 0 && !matchResult.ExistSelfTrade() && !matchResult.ExistExpiredOrder() && !matchResult.PriceBandReached && !matchResult.TakerOrderIsDone {
 			log.Errorf("No Match Items, %+v %+v", matchResult, newOrder)
 			panic(fmt.Errorf("no match items"))
 		}
@@ -36,14 +92,41 @@ func (m MarketHandler) handleNewOrder(newOrder *common.MemoryOrder) (matchResult
 			utils.Debugf("  [Take Liquidity] price: %s amount: %s (%s) ", item.MakerOrder.Price.StringFixed(5), item.MatchedAmount.StringFixed(5), item.MakerOrder.ID)
 		}
 
-		hasMatchOrder = true
+		for i := range matchResult.SelfTradeItems {
+			item := matchResult.SelfTradeItems[i]
+
+			msgs := common.MessagesForUpdateOrder(item.MakerOrder)
+			matchResult.OrderBookActivities = append(matchResult.OrderBookActivities, msgs...)
+
+			utils.Debugf("  [Self Trade] price: %s canceled amount: %s (%s) ", item.MakerOrder.Price.StringFixed(5), item.CanceledAmount.StringFixed(5), item.MakerOrder.ID)
+		}
+
+		for _, order := range matchResult.ExpiredOrders {
+			msgs := common.MessagesForUpdateOrder(order)
+			matchResult.OrderBookActivities = append(matchResult.OrderBookActivities, msgs...)
+
+			utils.Debugf("  [Expired] price: %s amount: %s (%s) ", order.Price.StringFixed(5), order.Amount.StringFixed(5), order.ID)
+		}
+
+		newOrder.Amount = newOrder.Amount.Sub(matchResult.TakerOrderSelfTradeCanceledAmount)
+
+		hasMatchOrder = len(matchResult.MatchItems) > 0
+
+		if lastPrice := matchResult.LastMatchedPrice(); lastPrice.IsPositive() {
+			m.setLastTradePrice(lastPrice)
+		}
+
+		m.addTrades(&matchResult, 0)
+	} else {
+		matchResult.TakerOrder = newOrder
+		matchResult.TakerOrderLeftAmount = newOrder.Amount
 	}
 
 	msgs := common.MessagesForUpdateOrder(newOrder)
 	matchResult.OrderBookActivities = append(matchResult.OrderBookActivities, msgs...)
 
-	// check if newOrder can be added to orderbook
-	if common.TakerOrderShouldBeRemoved(newOrder) {
+	// check if newOrder can be added to orderbook, the rest of an order stopped by the price band still crosses it
+	if matchResult.TakerOrderIsDone || common.TakerOrderShouldBeRemoved(newOrder) || !newOrder.CanRestInBook() || matchResult.PriceBandReached {
 		matchResult.TakerOrderIsDone = true
 	} else {
 		// if matched, gasFee is paid
@@ -51,18 +134,434 @@ func (m MarketHandler) handleNewOrder(newOrder *common.MemoryOrder) (matchResult
 			newOrder.GasFeeAmount = decimal.Zero
 		}
 
-		e := m.orderbook.InsertOrder(newOrder)
-		msg := common.OrderBookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount)
+		e := m.insertOrder(newOrder)
+		msg := common.OrderBookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount, e.Checksum)
 		matchResult.OrderBookActivities = append(matchResult.OrderBookActivities, msg)
 
 		utils.Debugf("  [Make Liquidity] price: %s amount: %s (%s)", newOrder.Price.StringFixed(5), newOrder.Amount.StringFixed(5), newOrder.ID)
 	}
 
+	if matchResult.PriceBandReached && m.config != nil && m.config.VolatilityHaltDuration > 0 {
+		m.halt()
+	}
+
+	return
+}
+
+// addTrades builds the trades of the match items which are not canceled and their newMarketTrade messages.
+// Trade IDs are the market, the orderbook Sequence after the match and an index from firstIndex,
+// they are the same when the journal is replayed. It returns the index of the next trade.
+func (m *MarketHandler) addTrades(matchResult *common.MatchResult, firstIndex int) int {
+	index := firstIndex
+	ts := uint64(m.now().Unix())
+
+	for _, item := range matchResult.MatchItems {
+		if item.MatchShouldBeCanceled || !item.MatchedAmount.IsPositive() {
+			continue
+		}
+
+		id := fmt.Sprintf("%s-%d-%d", m.market, m.orderbook.Sequence, index)
+		trade := common.NewTrade(id, matchResult.TakerOrder, item, ts)
+		index++
+
+		matchResult.Trades = append(matchResult.Trades, trade)
+		matchResult.OrderBookActivities = append(matchResult.OrderBookActivities, common.NewMarketTradeMessage(trade))
+	}
+
+	return index
+}
+
+// halt stops matching for VolatilityHaltDuration, orders collect in an auction until the market resumes
+func (m *MarketHandler) halt() {
+	m.haltedUntil = uint64(m.now().Add(m.config.VolatilityHaltDuration).Unix())
+	m.startAuction()
+	m.statusMessages = append(m.statusMessages, common.MarketStatusMessage(m.market, common.MarketStatusHalted, m.haltedUntil))
+
+	utils.Debugf("  [Halt] last price: %s until: %d (%s)", m.lastTradePrice.StringFixed(5), m.haltedUntil, m.market)
+}
+
+func (m *MarketHandler) isHaltOverAt(ts uint64) bool {
+	return m.haltedUntil > 0 && ts >= m.haltedUntil
+}
+
+func (m *MarketHandler) setLastTradePrice(price decimal.Decimal) {
+	m.lastTradePrice = price
+	m.updatePriceBand()
+}
+
+func (m *MarketHandler) updatePriceBand() {
+	if m.config == nil {
+		return
+	}
+
+	m.orderbook.SetPriceBand(m.config.priceBand(m.lastTradePrice))
+}
+
+// quote simulates handleNewOrder without changing anything, expired orders and orders which can't join an auction are rejected.
+// The taker fee is calculated by feeCalculator like the fees of matches if it is not nil and the market is registered.
+func (m *MarketHandler) quote(newOrder *common.MemoryOrder, feeCalculator *common.FeeCalculator) *common.Quote {
+	if newOrder.IsExpiredAt(uint64(m.now().Unix())) {
+		return &common.Quote{LeftAmount: newOrder.Amount, IsRejected: true}
+	}
+
+	// nothing is matched in an auction
+	if m.inAuction {
+		return &common.Quote{LeftAmount: newOrder.Amount, IsRejected: newOrder.Type == "market" || !newOrder.CanRestInBook()}
+	}
+
+	if feeCalculator != nil && m.config != nil {
+		return m.orderbook.QuoteWithFees(newOrder, m.marketAmountDecimals, feeCalculator, m.config.QuoteTokenDecimals)
+	}
+
+	return m.orderbook.Quote(newOrder, m.marketAmountDecimals)
+}
+
+// an order in an auction rests in the orderbook without matching, orders which can't rest are rejected
+func (m *MarketHandler) handleNewAuctionOrder(newOrder *common.MemoryOrder) (matchResult common.MatchResult) {
+	if newOrder.Type == "market" || !newOrder.CanRestInBook() {
+		return m.rejectNewOrder(newOrder)
+	}
+
+	matchResult.TakerOrder = newOrder
+	matchResult.TakerOrderLeftAmount = newOrder.Amount
+	matchResult.MatchItems = []*common.MatchItem{}
+
+	e := m.insertOrder(newOrder)
+	msg := common.OrderBookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount, e.Checksum)
+
+	matchResult.OrderBookActivities = append(matchResult.OrderBookActivities, msg)
+	matchResult.OrderBookActivities = append(matchResult.OrderBookActivities, common.MessagesForUpdateOrder(newOrder)...)
+
+	utils.Debugf("  [Auction] price: %s amount: %s (%s)", newOrder.Price.StringFixed(5), newOrder.Amount.StringFixed(5), newOrder.ID)
+
+	return
+}
+
+func (m *MarketHandler) startAuction() {
+	m.inAuction = true
+	m.auctionChanged = true
+}
+
+// uncross ends the auction by executing the crossed orderbook at the auction price, continuous trading starts after it
+func (m *MarketHandler) uncross() (results []common.MatchResult) {
+	m.inAuction = false
+	m.auctionChanged = false
+
+	price, uncrossResults := m.orderbook.Uncross()
+	tradeIndex := 0
+
+	for _, uncrossResult := range uncrossResults {
+		result := *uncrossResult
+
+		for _, item := range result.MatchItems {
+			result.OrderBookActivities = append(result.OrderBookActivities, common.MessagesForUpdateOrder(item.MakerOrder)...)
+		}
+
+		for _, item := range result.SelfTradeItems {
+			result.OrderBookActivities = append(result.OrderBookActivities, common.MessagesForUpdateOrder(item.MakerOrder)...)
+		}
+
+		result.OrderBookActivities = append(result.OrderBookActivities, common.MessagesForUpdateOrder(result.TakerOrder)...)
+		tradeIndex = m.addTrades(&result, tradeIndex)
+		results = append(results, result)
+	}
+
+	for _, result := range results {
+		if result.LastMatchedPrice().IsPositive() {
+			m.setLastTradePrice(price)
+			break
+		}
+	}
+
+	m.haltedUntil = 0
+	m.statusMessages = append(m.statusMessages, common.MarketStatusMessage(m.market, common.MarketStatusTrading, 0))
+
+	utils.Debugf("  [Uncross] price: %s takers: %d (%s)", price.StringFixed(5), len(results), m.market)
+
+	return
+}
+
+// handleAmendOrder reduces bookOrder in place, or removes it and handles it as a new order with newPrice and newAmount
+func (m *MarketHandler) handleAmendOrder(bookOrder *common.MemoryOrder, newPrice, newAmount decimal.Decimal) (matchResult common.MatchResult, err error) {
+	if !newPrice.IsPositive() || !newAmount.IsPositive() {
+		return matchResult, fmt.Errorf("can't amend order %s to price %s amount %s", bookOrder.ID, newPrice.String(), newAmount.String())
+	}
+
+	if newPrice.Equal(bookOrder.Price) && newAmount.LessThanOrEqual(bookOrder.Amount) {
+		events, err := m.orderbook.AmendOrder(bookOrder, newPrice, newAmount)
+		if err != nil {
+			return matchResult, err
+		}
+
+		matchResult = common.MatchResult{
+			TakerOrder:           bookOrder,
+			TakerOrderLeftAmount: bookOrder.Amount,
+			MatchItems:           []*common.MatchItem{},
+		}
+
+		for _, e := range events {
+			msg := common.OrderBookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount, e.Checksum)
+			matchResult.OrderBookActivities = append(matchResult.OrderBookActivities, msg)
+		}
+
+		matchResult.OrderBookActivities = append(matchResult.OrderBookActivities, common.MessagesForUpdateOrder(bookOrder)...)
+
+		utils.Debugf("  [Amend] price: %s amount: %s (%s)", bookOrder.Price.StringFixed(5), bookOrder.Amount.StringFixed(5), bookOrder.ID)
+	} else {
+		e := m.orderbook.RemoveOrder(bookOrder)
+		removeMsg := common.OrderBookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount, e.Checksum)
+
+		bookOrder.Price = newPrice
+		bookOrder.Amount = newAmount
+
+		utils.Debugf("  [Amend Requeue] price: %s amount: %s (%s)", bookOrder.Price.StringFixed(5), bookOrder.Amount.StringFixed(5), bookOrder.ID)
+
+		matchResult, _ = m.handleNewOrder(bookOrder)
+		matchResult.OrderBookActivities = append([]common.WebSocketMessage{removeMsg}, matchResult.OrderBookActivities...)
+	}
+
+	matchResult.TakerOrderIsAmended = true
+
+	return matchResult, nil
+}
+
+func (m *MarketHandler) insertOrder(order *common.MemoryOrder) *common.OrderbookEvent {
+	e := m.orderbook.InsertOrder(order)
+	m.expiryIndex.add(order)
+	m.traderIndex.add(order)
+
+	return e
+}
+
+func (m *MarketHandler) setClock(clock func() time.Time) {
+	m.now = clock
+	m.orderbook.SetClock(clock)
+}
+
+// setTime fixes the time of the handler during a command
+func (m *MarketHandler) setTime(t time.Time) {
+	m.setClock(func() time.Time {
+		return t
+	})
+}
+
+func (m *MarketHandler) setConfig(config *MarketConfig) {
+	m.config = config
+	m.marketAmountDecimals = config.AmountDecimals
+	m.updatePriceBand()
+}
+
+func (m *MarketHandler) validateOrder(order *common.MemoryOrder) error {
+	switch m.status {
+	case common.MarketStatusClosed:
+		return &OrderRejectedError{OrderID: order.ID, MarketID: m.market, Reason: ErrMarketClosed}
+	case common.MarketStatusCancelOnly:
+		return &OrderRejectedError{OrderID: order.ID, MarketID: m.market, Reason: ErrMarketCancelOnly}
+	}
+
+	if m.config == nil {
+		return nil
+	}
+
+	if err := m.config.validateOrder(order); err != nil {
+		return err
+	}
+
+	// prices are discovered freely in an auction
+	if m.inAuction || order.Type != "limit" {
+		return nil
+	}
+
+	lower, upper := m.config.priceBand(m.lastTradePrice)
+	if (lower.IsPositive() && order.Price.LessThan(lower)) || (upper.IsPositive() && order.Price.GreaterThan(upper)) {
+		return &OrderRejectedError{OrderID: order.ID, MarketID: m.market, Reason: ErrPriceOutsideBand}
+	}
+
+	return nil
+}
+
+// orders of a registered market without fee rates get the fee rates of its config
+func (m *MarketHandler) applyDefaultFeeRates(order *common.MemoryOrder) {
+	if m.config != nil {
+		m.config.applyDefaultFeeRates(order)
+	}
+}
+
+func (m *MarketHandler) restoreOrderbook(checkpoint []byte) error {
+	if err := m.orderbook.UnmarshalBinary(checkpoint); err != nil {
+		return err
+	}
+
+	m.expiryIndex = newExpiryIndex()
+	m.traderIndex = newTraderIndex()
+	for _, order := range m.orderbook.Orders() {
+		m.expiryIndex.add(order)
+		m.traderIndex.add(order)
+	}
+
+	return nil
+}
+
+func (m *MarketHandler) rejectNewOrder(newOrder *common.MemoryOrder) common.MatchResult {
+	matchResult := *common.RejectedMatchResult(newOrder)
+	matchResult.OrderBookActivities = common.MessagesForUpdateOrder(newOrder)
+
+	utils.Debugf("  [Reject] price: %s amount: %s (%s)", newOrder.Price.StringFixed(5), newOrder.Amount.StringFixed(5), newOrder.ID)
+
+	return matchResult
+}
+
+func (m *MarketHandler) handleCancelOrder(id string) *common.OrderbookEvent {
+	_, event := m.orderbook.RemoveOrderByID(id)
+	return event
+}
+
+// removeExpiredOrders removes all orders in the orderbook which are expired at ts
+func (m *MarketHandler) removeExpiredOrders(ts uint64) (expiredOrders []*common.MemoryOrder, activities []common.WebSocketMessage) {
+	for _, order := range m.expiryIndex.popExpired(ts) {
+		// the order may already be matched or canceled
+		if bookOrder, exist := m.orderbook.GetOrderByID(order.ID); !exist || bookOrder != order {
+			continue
+		}
+
+		e := m.orderbook.RemoveOrder(order)
+		msg := common.OrderBookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount, e.Checksum)
+
+		activities = append(activities, msg)
+		activities = append(activities, common.MessagesForUpdateOrder(order)...)
+		expiredOrders = append(expiredOrders, order)
+
+		utils.Debugf("  [Expired] price: %s amount: %s (%s)", order.Price.StringFixed(5), order.Amount.StringFixed(5), order.ID)
+	}
+
+	return
+}
+
+// cancelTraderOrders removes all orders of the trader on side from the orderbook and the stop order book,
+// all sides if side is empty
+func (m *MarketHandler) cancelTraderOrders(trader, side string) (canceledOrders []*common.MemoryOrder, activities []common.WebSocketMessage) {
+	for _, order := range m.traderIndex.ordersOf(trader, side) {
+		e := m.orderbook.RemoveOrder(order)
+		msg := common.OrderBookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount, e.Checksum)
+
+		activities = append(activities, msg)
+		activities = append(activities, common.MessagesForUpdateOrder(order)...)
+		canceledOrders = append(canceledOrders, order)
+
+		utils.Debugf("  [Mass Cancel] price: %s amount: %s (%s)", order.Price.StringFixed(5), order.Amount.StringFixed(5), order.ID)
+	}
+
+	for _, order := range m.stopOrderBook.traderOrders(trader, side) {
+		m.stopOrderBook.remove(order.ID)
+
+		activities = append(activities, common.MessagesForUpdateOrder(order)...)
+		canceledOrders = append(canceledOrders, order)
+
+		utils.Debugf("  [Mass Cancel] stop price: %s amount: %s (%s)", order.StopPrice.StringFixed(5), order.Amount.StringFixed(5), order.ID)
+	}
+
+	return
+}
+
+// cancelAllOrders removes all orders from the orderbook in price time priority, then all stop orders
+func (m *MarketHandler) cancelAllOrders() (canceledOrders []*common.MemoryOrder, activities []common.WebSocketMessage) {
+	snapshot := m.orderbook.SnapshotL3()
+
+	for _, l3Order := range append(snapshot.Bids, snapshot.Asks...) {
+		order, e := m.orderbook.RemoveOrderByID(l3Order.ID)
+		if order == nil {
+			continue
+		}
+
+		msg := common.OrderBookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount, e.Checksum)
+
+		activities = append(activities, msg)
+		activities = append(activities, common.MessagesForUpdateOrder(order)...)
+		canceledOrders = append(canceledOrders, order)
+	}
+
+	for _, order := range m.stopOrderBook.all() {
+		m.stopOrderBook.remove(order.ID)
+
+		activities = append(activities, common.MessagesForUpdateOrder(order)...)
+		canceledOrders = append(canceledOrders, order)
+	}
+
+	utils.Debugf("  [Cancel All] orders: %d (%s)", len(canceledOrders), m.market)
+
+	return
+}
+
+// setStatus changes the status of the market and announces it on the market channel
+func (m *MarketHandler) setStatus(status string) {
+	if m.status == status {
+		return
+	}
+
+	m.status = status
+	m.statusMessages = append(m.statusMessages, common.MarketStatusMessage(m.market, status, 0))
+}
+
+// close rejects new orders until the market is opened, a halted market stays in the auction without resuming
+func (m *MarketHandler) close(status string) {
+	m.haltedUntil = 0
+	m.setStatus(status)
+}
+
+func (m *MarketHandler) enableL3Messages() {
+	m.l3Messages = make([]common.WebSocketMessage, 0)
+
+	m.orderbook.UsePlugin(func(e *common.OrderbookEvent) {
+		m.l3Messages = append(m.l3Messages, common.OrderBookL3ChangeMessage(m.market, m.orderbook.Sequence, e))
+	})
+}
+
+// takePendingMessages returns the market status, per order and auction indicative messages collected since last call
+func (m *MarketHandler) takePendingMessages() []common.WebSocketMessage {
+	msgs := m.statusMessages
+	m.statusMessages = nil
+
+	if len(m.l3Messages) > 0 {
+		msgs = append(msgs, m.l3Messages...)
+		m.l3Messages = make([]common.WebSocketMessage, 0)
+	}
+
+	if m.auctionChanged {
+		m.auctionChanged = false
+
+		price, volume := m.orderbook.AuctionPrice()
+		msgs = append(msgs, common.AuctionIndicativeMessage(m.market, price, volume))
+	}
+
+	return msgs
+}
+
+func (m *MarketHandler) stopOrderCanBeTriggered(order *common.MemoryOrder) bool {
+	return canBeTriggered(order, m.lastTradePrice)
+}
+
+// a stop order stays out of the orderbook until the last trade price reaches its stop price
+func (m *MarketHandler) handleNewStopOrder(order *common.MemoryOrder) (matchResult common.MatchResult) {
+	m.stopOrderBook.insert(order)
+
+	matchResult.TakerOrder = order
+	matchResult.OrderBookActivities = common.MessagesForUpdateOrder(order)
+
+	utils.Debugf("  [Stop Order] stop price: %s amount: %s (%s)", order.StopPrice.StringFixed(5), order.Amount.StringFixed(5), order.ID)
+
 	return
 }
 
-func (m *MarketHandler) handleCancelOrder(bookOrder *common.MemoryOrder) *common.OrderbookEvent {
-	return m.orderbook.RemoveOrder(bookOrder)
+func (m *MarketHandler) handleCancelStopOrder(id string) (*common.MemoryOrder, bool) {
+	return m.stopOrderBook.remove(id)
+}
+
+func (m *MarketHandler) popTriggeredStopOrders() []*common.MemoryOrder {
+	return m.stopOrderBook.popTriggered(m.lastTradePrice)
+}
+
+func (m *MarketHandler) setSelfTradePrevention(mode string) error {
+	return m.orderbook.SetSelfTradePrevention(mode)
 }
 
 func NewMarketHandler(ctx context.Context, market string) (*MarketHandler, error) {
@@ -73,10 +572,92 @@ func NewMarketHandler(ctx context.Context, market string) (*MarketHandler, error
 	})
 
 	marketHandler := MarketHandler{
-		market:    market,
-		ctx:       ctx,
-		orderbook: marketOrderbook,
+		market:        market,
+		ctx:           ctx,
+		orderbook:     marketOrderbook,
+		stopOrderBook: newStopOrderBook(),
+		expiryIndex:   newExpiryIndex(),
+		traderIndex:   newTraderIndex(),
+		now:           time.Now,
+		status:        common.MarketStatusTrading,
+		commands:      make(chan func()),
+		stopped:       make(chan struct{}),
 	}
 
+	marketOrderbook.UsePlugin(func(e *common.OrderbookEvent) {
+		// orders leave the orderbook by matching, canceling, amending and expiring
+		if e.Action == common.OrderbookEventRemove {
+			marketHandler.expiryIndex.remove(e.OrderID)
+			marketHandler.traderIndex.remove(e.OrderID)
+		}
+
+		if marketHandler.inAuction {
+			marketHandler.auctionChanged = true
+		}
+	})
+
 	return &marketHandler, nil
 }
+
+// run handles the commands of the market until ctx is canceled, commands are run by their callers after it
+func (m *MarketHandler) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer close(m.stopped)
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			utils.Infof("Market Handler %s Exit", m.market)
+			return
+		case command := <-m.commands:
+			command()
+		}
+	}
+}
+
+// do runs f in the goroutine of the market and waits for it, a panic of f is raised again in the caller
+func (m *MarketHandler) do(f func()) {
+	done := make(chan interface{}, 1)
+
+	command := func() {
+		defer func() {
+			done <- recover()
+		}()
+
+		f()
+	}
+
+	select {
+	case m.commands <- command:
+	case <-m.stopped:
+		m.stoppedLock.Lock()
+		command()
+		m.stoppedLock.Unlock()
+	}
+
+	if r := <-done; r != nil {
+		panic(r)
+	}
+}
+
+// pause blocks the commands of the market until resume is closed, it returns when the market is paused
+func (m *MarketHandler) pause(resume <-chan struct{}) {
+	paused := make(chan struct{})
+
+	command := func() {
+		close(paused)
+		<-resume
+	}
+
+	select {
+	case m.commands <- command:
+		<-paused
+	case <-m.stopped:
+		m.stoppedLock.Lock()
+
+		go func() {
+			<-resume
+			m.stoppedLock.Unlock()
+		}()
+	}
+}
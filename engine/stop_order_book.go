@@ -0,0 +1,190 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/HydroProtocol/hydro-sdk-backend/common"
+	"github.com/cevaris/ordered_map"
+	"github.com/petar/GoLLRB/llrb"
+	"github.com/shopspring/decimal"
+	"strings"
+)
+
+type stopPriceLevel struct {
+	price    decimal.Decimal
+	orderMap *ordered_map.OrderedMap
+}
+
+func newStopPriceLevel(price decimal.Decimal) *stopPriceLevel {
+	return &stopPriceLevel{
+		price:    price,
+		orderMap: ordered_map.NewOrderedMap(),
+	}
+}
+
+func (p *stopPriceLevel) Less(item llrb.Item) bool {
+	another := item.(*stopPriceLevel)
+	return p.price.LessThan(another.price)
+}
+
+// stopOrderBook keeps stop orders out of the visible orderbook until they are triggered.
+//
+// A buy stop order is triggered when the last trade price rises to its stop price,
+// a sell stop order is triggered when the last trade price falls to its stop price.
+type stopOrderBook struct {
+	buyTree  *llrb.LLRB
+	sellTree *llrb.LLRB
+	orders   map[string]*common.MemoryOrder
+}
+
+func newStopOrderBook() *stopOrderBook {
+	return &stopOrderBook{
+		buyTree:  llrb.New(),
+		sellTree: llrb.New(),
+		orders:   make(map[string]*common.MemoryOrder),
+	}
+}
+
+func (b *stopOrderBook) tree(side string) *llrb.LLRB {
+	if side == "sell" {
+		return b.sellTree
+	}
+
+	return b.buyTree
+}
+
+func (b *stopOrderBook) len() int {
+	return len(b.orders)
+}
+
+func (b *stopOrderBook) insert(order *common.MemoryOrder) {
+	if _, exist := b.orders[order.ID]; exist {
+		panic(fmt.Errorf("can't add stop order which is already in stop order book. orderID: %s", order.ID))
+	}
+
+	tree := b.tree(order.Side)
+
+	pl := tree.Get(newStopPriceLevel(order.StopPrice))
+	if pl == nil {
+		pl = newStopPriceLevel(order.StopPrice)
+		tree.InsertNoReplace(pl)
+	}
+
+	pl.(*stopPriceLevel).orderMap.Set(order.ID, order)
+	b.orders[order.ID] = order
+}
+
+func (b *stopOrderBook) get(id string) (*common.MemoryOrder, bool) {
+	order, exist := b.orders[id]
+	return order, exist
+}
+
+func (b *stopOrderBook) remove(id string) (*common.MemoryOrder, bool) {
+	order, exist := b.orders[id]
+	if !exist {
+		return nil, false
+	}
+
+	tree := b.tree(order.Side)
+	pl := tree.Get(newStopPriceLevel(order.StopPrice)).(*stopPriceLevel)
+	pl.orderMap.Delete(order.ID)
+
+	if pl.orderMap.Len() <= 0 {
+		tree.Delete(pl)
+	}
+
+	delete(b.orders, id)
+
+	return order, true
+}
+
+// traderOrders returns the stop orders of the trader on side, all sides if side is empty.
+// Trader addresses are compared case insensitively.
+func (b *stopOrderBook) traderOrders(trader, side string) []*common.MemoryOrder {
+	return b.filter(func(order *common.MemoryOrder) bool {
+		return strings.EqualFold(order.Trader, trader) && (side == "" || order.Side == side)
+	})
+}
+
+// all returns all stop orders, buy orders first
+func (b *stopOrderBook) all() []*common.MemoryOrder {
+	return b.filter(func(order *common.MemoryOrder) bool {
+		return true
+	})
+}
+
+func (b *stopOrderBook) filter(match func(order *common.MemoryOrder) bool) []*common.MemoryOrder {
+	orders := make([]*common.MemoryOrder, 0)
+
+	for _, tree := range []*llrb.LLRB{b.buyTree, b.sellTree} {
+		tree.AscendGreaterOrEqual(newStopPriceLevel(decimal.Zero), func(i llrb.Item) bool {
+			iter := i.(*stopPriceLevel).orderMap.IterFunc()
+			for kv, ok := iter(); ok; kv, ok = iter() {
+				order := kv.Value.(*common.MemoryOrder)
+
+				if match(order) {
+					orders = append(orders, order)
+				}
+			}
+
+			return true
+		})
+	}
+
+	return orders
+}
+
+func canBeTriggered(order *common.MemoryOrder, lastTradePrice decimal.Decimal) bool {
+	if !lastTradePrice.IsPositive() {
+		return false
+	}
+
+	if order.Side == "sell" {
+		return lastTradePrice.LessThanOrEqual(order.StopPrice)
+	}
+
+	return lastTradePrice.GreaterThanOrEqual(order.StopPrice)
+}
+
+// popTriggered removes and returns all stop orders triggered by lastTradePrice.
+// Orders are returned in the sequence the price would have passed their stop prices,
+// orders with the same stop price keep their arrival order.
+func (b *stopOrderBook) popTriggered(lastTradePrice decimal.Decimal) []*common.MemoryOrder {
+	triggered := make([]*common.MemoryOrder, 0)
+
+	if !lastTradePrice.IsPositive() {
+		return triggered
+	}
+
+	collect := func(pl *stopPriceLevel) {
+		iter := pl.orderMap.IterFunc()
+		for kv, ok := iter(); ok; kv, ok = iter() {
+			triggered = append(triggered, kv.Value.(*common.MemoryOrder))
+		}
+	}
+
+	b.buyTree.AscendGreaterOrEqual(newStopPriceLevel(decimal.Zero), func(i llrb.Item) bool {
+		pl := i.(*stopPriceLevel)
+		if pl.price.GreaterThan(lastTradePrice) {
+			return false
+		}
+
+		collect(pl)
+		return true
+	})
+
+	b.sellTree.DescendLessOrEqual(newStopPriceLevel(decimal.New(1, 99)), func(i llrb.Item) bool {
+		pl := i.(*stopPriceLevel)
+		if pl.price.LessThan(lastTradePrice) {
+			return false
+		}
+
+		collect(pl)
+		return true
+	})
+
+	for _, order := range triggered {
+		b.remove(order.ID)
+	}
+
+	return triggered
+}
@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"github.com/HydroProtocol/hydro-sdk-backend/common"
+	"github.com/cevaris/ordered_map"
+	"strings"
+)
+
+// traderIndex keeps the orders of every trader in the orderbook in the sequence they are added.
+// Orders are added by MarketHandler.insertOrder and removed by orderbook remove events.
+// Trader addresses are keyed in lower case, an address matches in any case.
+type traderIndex struct {
+	orders  map[string]*ordered_map.OrderedMap
+	traders map[string]string
+}
+
+func newTraderIndex() *traderIndex {
+	return &traderIndex{
+		orders:  make(map[string]*ordered_map.OrderedMap),
+		traders: make(map[string]string),
+	}
+}
+
+func (idx *traderIndex) add(order *common.MemoryOrder) {
+	trader := strings.ToLower(order.Trader)
+
+	orders, exist := idx.orders[trader]
+	if !exist {
+		orders = ordered_map.NewOrderedMap()
+		idx.orders[trader] = orders
+	}
+
+	orders.Set(order.ID, order)
+	idx.traders[order.ID] = trader
+}
+
+func (idx *traderIndex) remove(orderID string) {
+	trader, exist := idx.traders[orderID]
+	if !exist {
+		return
+	}
+
+	orders := idx.orders[trader]
+	orders.Delete(orderID)
+
+	if orders.Len() <= 0 {
+		delete(idx.orders, trader)
+	}
+
+	delete(idx.traders, orderID)
+}
+
+// ordersOf returns the orders of the trader on side, all sides if side is empty
+func (idx *traderIndex) ordersOf(trader, side string) []*common.MemoryOrder {
+	result := make([]*common.MemoryOrder, 0)
+
+	orders, exist := idx.orders[strings.ToLower(trader)]
+	if !exist {
+		return result
+	}
+
+	iter := orders.IterFunc()
+	for kv, ok := iter(); ok; kv, ok = iter() {
+		order := kv.Value.(*common.MemoryOrder)
+
+		if side == "" || order.Side == side {
+			result = append(result, order)
+		}
+	}
+
+	return result
+}
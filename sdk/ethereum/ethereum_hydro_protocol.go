@@ -231,7 +231,7 @@ func getLightOrderBytesFromOrder(order *sdk.Order) []byte {
 	return buf.Bytes()
 }
 
-const FeeRateBase = 100000
+const FeeRateBase = sdk.FeeRateBase
 
 func addTailingZero(data string, length int) string {
 	return data + strings.Repeat("0", length-len(data))
@@ -25,6 +25,9 @@ type BlockChain interface {
 	SendRawTransaction(tx interface{}) (string, error)
 }
 
+// FeeRateBase is the unit of fee rates in order data
+const FeeRateBase = 100000
+
 type HydroProtocol interface {
 	GenerateOrderData(version, expiredAtSeconds, salt int64, asMakerFeeRate, asTakerFeeRate, makerRebateRate decimal.Decimal, isSell, isMarket, isMakerOnly bool) string
 	GetOrderHash(*Order) []byte
@@ -1,7 +1,11 @@
 package websocket
 
 import (
+	"context"
+	"errors"
 	"github.com/HydroProtocol/hydro-sdk-backend/common"
+	"github.com/HydroProtocol/hydro-sdk-backend/engine"
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 	"net"
@@ -131,6 +135,261 @@ func (s *channelTestSuit) TestRunOrderbookChannel() {
 	s.Equal(mockSnapshot.Asks, channel.Orderbook.SnapshotV2().Asks)
 }
 
+func (s *channelTestSuit) TestOrderbookChannelForwardsAuctionMessage() {
+	channel, _ := s.NewMockMarketChannel("test-auction-channel#HOT-WETH")
+
+	c1, c1Connection := s.InitClient()
+	channel.AddSubscriber(c1)
+	time.Sleep(time.Millisecond * 20)
+
+	msg := common.AuctionIndicativeMessage("HOT-WETH", decimal.NewFromFloat(1.5), decimal.NewFromFloat(10))
+	channel.AddMessage(&msg)
+	time.Sleep(time.Millisecond * 20)
+
+	c1Connection.AssertNumberOfCalls(s.T(), "WriteJSON", 2)
+	c1Connection.AssertCalled(s.T(), "WriteJSON", &common.WebsocketMarketAuctionPayload{
+		Type:   common.WsTypeAuctionIndicative,
+		Price:  "1.5",
+		Volume: "10",
+	})
+
+	// the orderbook is not changed
+	s.Equal(uint64(12), channel.Orderbook.Sequence)
+}
+
+func (s *channelTestSuit) TestRunAggregatedOrderbookChannel() {
+	channel, _ := s.NewMockMarketChannel("test-channel#HOT-WETH")
+
+	c1, c1Connection := s.InitClient()
+	channel.setAggregation(c1.ID, decimal.NewFromFloat(5), 1)
+	channel.AddSubscriber(c1)
+	time.Sleep(time.Millisecond * 20)
+
+	c1Connection.AssertCalled(s.T(), "WriteJSON", newOrderbookLevel2Snapshot(channel.MarketID, [][2]string{{"0", "1"}}, [][2]string{{"5", "1"}}))
+
+	channel.AddMessage(s.buildWesocketMessage(13, "sell", "3", "1"))
+	time.Sleep(time.Millisecond * 20)
+
+	c1Connection.AssertCalled(s.T(), "WriteJSON", newOrderbookLevel2Snapshot(channel.MarketID, [][2]string{{"0", "1"}}, [][2]string{{"5", "2"}}))
+
+	channel.RemoveSubscriber(c1.ID)
+	time.Sleep(time.Millisecond * 20)
+	s.Nil(channel.getAggregation(c1.ID))
+}
+
+func (s *channelTestSuit) TestOrderbookChannelChecksum() {
+	channel, mockSnapshot := s.NewMockMarketChannel("test-checksum-channel#HOT-WETH")
+
+	c1, c1Connection := s.InitClient()
+	channel.AddSubscriber(c1)
+	time.Sleep(time.Millisecond * 20)
+	c1Connection.AssertCalled(s.T(), "WriteJSON", &orderbookLevel2Snapshot{
+		Type:     "level2OrderbookSnapshot",
+		MarketID: channel.MarketID,
+		Bids:     mockSnapshot.Bids,
+		Asks:     mockSnapshot.Asks,
+		Checksum: common.SnapshotChecksum(mockSnapshot.Bids, mockSnapshot.Asks),
+	})
+
+	checksum := common.SnapshotChecksum([][2]string{{"1", "2"}}, [][2]string{{"2", "1"}})
+	msg := s.buildWesocketMessage(13, "buy", "1", "1")
+	msg.Payload.(*common.WebsocketMarketOrderChangePayload).Checksum = checksum
+
+	channel.AddMessage(msg)
+	time.Sleep(time.Millisecond * 20)
+	c1Connection.AssertCalled(s.T(), "WriteJSON", newOrderbookLevel2Update(channel.MarketID, "buy", "1", "2", checksum))
+	s.True(channel.Orderbook.VerifyChecksum(checksum))
+
+	// out of sync, the orderbook is rebuilt from snapshot
+	msg = s.buildWesocketMessage(14, "buy", "1", "1")
+	msg.Payload.(*common.WebsocketMarketOrderChangePayload).Checksum = checksum
+
+	channel.AddMessage(msg)
+	time.Sleep(time.Millisecond * 20)
+	c1Connection.AssertNumberOfCalls(s.T(), "WriteJSON", 3)
+	s.Equal(mockSnapshot.Sequence, channel.Orderbook.Sequence)
+	s.Equal(mockSnapshot.Bids, channel.Orderbook.SnapshotV2().Bids)
+}
+
+func (s *channelTestSuit) TestOrderbookChannelResyncBackoff() {
+	fetcher := new(MockSnapshotV2Fetcher)
+	fetcher.On("FetchV2", mock.Anything).Return(nil, errors.New("api unavailable"))
+
+	// the channel is created without a snapshot
+	channel := NewMarketChannelCreator(fetcher)("test-resync-channel#HOT-WETH").(*marketChannel)
+	s.True(channel.outOfSync)
+	fetcher.AssertNumberOfCalls(s.T(), "FetchV2", 1)
+
+	// messages in the backoff of the last attempt are dropped
+	channel.handleMessage(s.buildWesocketMessage(13, "buy", "1", "1"))
+	fetcher.AssertNumberOfCalls(s.T(), "FetchV2", 1)
+	s.True(channel.nextResyncAt.After(time.Now()))
+
+	// attempts stop at the limit
+	for i := 0; i < maxResyncAttempts+2; i++ {
+		channel.nextResyncAt = time.Time{}
+		channel.handleMessage(s.buildWesocketMessage(13, "buy", "1", "1"))
+	}
+	fetcher.AssertNumberOfCalls(s.T(), "FetchV2", maxResyncAttempts)
+	s.Equal(0, len(channel.Orderbook.SnapshotV2().Bids))
+
+	// a new client restarts the resync
+	mockSnapshot := &common.SnapshotV2{Sequence: 12, Bids: [][2]string{{"1", "1"}}, Asks: [][2]string{}}
+	fetcher.ExpectedCalls = nil
+	fetcher.On("FetchV2", mock.Anything).Return(mockSnapshot, nil)
+
+	c1, c1Connection := s.InitClient()
+	channel.handleSubscriber(c1)
+	channel.nextResyncAt = time.Time{}
+	channel.handleMessage(s.buildWesocketMessage(13, "buy", "1", "1"))
+
+	s.False(channel.outOfSync)
+	s.Equal(uint64(13), channel.Orderbook.Sequence)
+	s.Equal([][2]string{{"1", "2"}}, channel.Orderbook.SnapshotV2().Bids)
+	c1Connection.AssertNumberOfCalls(s.T(), "WriteJSON", 3)
+}
+
+func (s *channelTestSuit) TestOrderbookChannelResyncOnChangeNotFittingTheOrderbook() {
+	mockSnapshot := &common.SnapshotV2{Sequence: 12, Bids: [][2]string{{"1", "1"}}, Asks: [][2]string{}}
+	fetcher := NewMockSnapshotFetcher(mockSnapshot)
+	channel := NewMarketChannelCreator(fetcher)("test-resync-change-channel#HOT-WETH").(*marketChannel)
+	fetcher.AssertNumberOfCalls(s.T(), "GetV2", 1)
+
+	// a missing level is reduced after the backoff of the first resync
+	channel.nextResyncAt = time.Time{}
+	channel.handleMessage(s.buildWesocketMessage(13, "buy", "0.9", "-1"))
+	fetcher.AssertNumberOfCalls(s.T(), "GetV2", 2)
+	s.False(channel.outOfSync)
+	s.Equal(uint64(12), channel.Orderbook.Sequence)
+	s.Equal(mockSnapshot.Bids, channel.Orderbook.SnapshotV2().Bids)
+
+	// a level is reduced below zero
+	channel.nextResyncAt = time.Time{}
+	channel.handleMessage(s.buildWesocketMessage(13, "buy", "1", "-2"))
+	fetcher.AssertNumberOfCalls(s.T(), "GetV2", 3)
+	s.Equal(mockSnapshot.Bids, channel.Orderbook.SnapshotV2().Bids)
+}
+
+func (s *channelTestSuit) TestRunMarketL3Channel() {
+	mockSnapshot := &common.SnapshotL3{
+		Sequence: 12,
+		Bids:     []*common.SnapshotL3Order{{ID: "o1", Price: "1", Amount: "1", Position: 0}},
+		Asks:     []*common.SnapshotL3Order{{ID: "o2", Price: "2", Amount: "1", Position: 0}},
+	}
+
+	channel := NewMarketL3ChannelCreator(NewMockL3SnapshotFetcher(mockSnapshot))("MarketL3#HOT-WETH").(*marketL3Channel)
+	saveChannel(channel)
+	go runChannel(channel)
+
+	s.Equal("HOT-WETH", channel.MarketID)
+	s.Equal(mockSnapshot.Bids, channel.Orderbook.SnapshotL3().Bids)
+
+	c1, c1Connection := s.InitClient()
+	channel.AddSubscriber(c1)
+	time.Sleep(time.Millisecond * 20)
+	c1Connection.AssertCalled(s.T(), "WriteJSON", newOrderbookLevel3Snapshot("HOT-WETH", mockSnapshot.Bids, mockSnapshot.Asks))
+
+	// overdue message
+	channel.AddMessage(s.buildL3WebsocketMessage(12, common.OrderbookEventAdd, "o3", "buy", "1", "1"))
+	time.Sleep(time.Millisecond * 20)
+	c1Connection.AssertNumberOfCalls(s.T(), "WriteJSON", 1)
+
+	channel.AddMessage(s.buildL3WebsocketMessage(13, common.OrderbookEventAdd, "o3", "buy", "1", "2"))
+	channel.AddMessage(s.buildL3WebsocketMessage(14, common.OrderbookEventChange, "o1", "buy", "1", "0.5"))
+	channel.AddMessage(s.buildL3WebsocketMessage(15, common.OrderbookEventRemove, "o2", "sell", "2", "0"))
+	time.Sleep(time.Millisecond * 20)
+
+	c1Connection.AssertNumberOfCalls(s.T(), "WriteJSON", 4)
+	c1Connection.AssertCalled(s.T(), "WriteJSON", newOrderbookLevel3Update("HOT-WETH", common.OrderbookEventAdd, "o3", "buy", "1", "2"))
+	s.Equal(uint64(15), channel.Sequence)
+
+	snapshot := channel.Orderbook.SnapshotL3()
+	s.Equal([]*common.SnapshotL3Order{
+		{ID: "o1", Price: "1", Amount: "0.5", Position: 0},
+		{ID: "o3", Price: "1", Amount: "2", Position: 1},
+	}, snapshot.Bids)
+	s.Equal(0, len(snapshot.Asks))
+}
+
+func (s *channelTestSuit) TestMarketL3ChannelResyncOnUnknownOrder() {
+	mockSnapshot := &common.SnapshotL3{
+		Sequence: 12,
+		Bids:     []*common.SnapshotL3Order{{ID: "o1", Price: "1", Amount: "1", Position: 0}},
+		Asks:     []*common.SnapshotL3Order{},
+	}
+
+	fetcher := NewMockL3SnapshotFetcher(mockSnapshot)
+	channel := NewMarketL3ChannelCreator(fetcher)("MarketL3#HOT-WETH").(*marketL3Channel)
+
+	c1, c1Connection := s.InitClient()
+	channel.handleSubscriber(c1)
+
+	// o2 was added by a lost message
+	resyncedSnapshot := &common.SnapshotL3{
+		Sequence: 14,
+		Bids: []*common.SnapshotL3Order{
+			{ID: "o1", Price: "1", Amount: "1", Position: 0},
+			{ID: "o2", Price: "1", Amount: "0.5", Position: 1},
+		},
+		Asks: []*common.SnapshotL3Order{},
+	}
+	fetcher.ExpectedCalls = nil
+	fetcher.On("SnapshotL3", mock.Anything).Return(resyncedSnapshot)
+
+	channel.handleMessage(s.buildL3WebsocketMessage(14, common.OrderbookEventChange, "o2", "buy", "1", "0.5"))
+	fetcher.AssertNumberOfCalls(s.T(), "SnapshotL3", 2)
+	s.False(channel.outOfSync)
+	s.Equal(uint64(14), channel.Sequence)
+	s.Equal(resyncedSnapshot.Bids, channel.Orderbook.SnapshotL3().Bids)
+	c1Connection.AssertCalled(s.T(), "WriteJSON", newOrderbookLevel3Snapshot("HOT-WETH", resyncedSnapshot.Bids, resyncedSnapshot.Asks))
+	c1Connection.AssertNumberOfCalls(s.T(), "WriteJSON", 2)
+
+	// the orderbook is out of sync until a snapshot can be fetched
+	fetcher.ExpectedCalls = nil
+	fetcher.On("SnapshotL3", mock.Anything).Return(nil)
+
+	channel.handleMessage(s.buildL3WebsocketMessage(15, common.OrderbookEventChange, "o3", "buy", "1", "0.5"))
+	s.True(channel.outOfSync)
+	channel.handleMessage(s.buildL3WebsocketMessage(16, common.OrderbookEventAdd, "o4", "buy", "1", "1"))
+	s.True(channel.outOfSync)
+	s.Equal(uint64(14), channel.Sequence)
+	c1Connection.AssertNumberOfCalls(s.T(), "WriteJSON", 2)
+}
+
+func (s *channelTestSuit) TestMarketL3ChannelFromEngine() {
+	e := engine.NewEngine(context.Background())
+	e.HandleNewOrder(&common.MemoryOrder{
+		ID:       "o1",
+		MarketID: "HOT-WETH",
+		Side:     "buy",
+		Type:     "limit",
+		Price:    decimal.NewFromFloat(1),
+		Amount:   decimal.NewFromFloat(2),
+	})
+
+	channel := NewMarketL3ChannelCreator(e)("MarketL3#HOT-WETH").(*marketL3Channel)
+	s.Equal(e.SnapshotL3("HOT-WETH").Bids, channel.Orderbook.SnapshotL3().Bids)
+	s.Equal(e.SnapshotL3("HOT-WETH").Sequence, channel.Sequence)
+
+	// a market without orderbook starts empty
+	channel = NewMarketL3ChannelCreator(e)("MarketL3#HOT-DAI").(*marketL3Channel)
+	s.Equal(0, len(channel.Orderbook.Orders()))
+	s.Equal(uint64(0), channel.Sequence)
+}
+
+func (s *channelTestSuit) buildL3WebsocketMessage(sequence uint64, action, orderID, side, price, amount string) *common.WebSocketMessage {
+	return &common.WebSocketMessage{
+		Payload: &common.WebsocketMarketL3OrderChangePayload{
+			Action:   action,
+			OrderID:  orderID,
+			Side:     side,
+			Price:    price,
+			Amount:   amount,
+			Sequence: sequence,
+		},
+	}
+}
+
 func (s *channelTestSuit) buildWesocketMessage(sequence uint64, side, price, changedAmount string) *common.WebSocketMessage {
 
 	payload := &common.WebsocketMarketOrderChangePayload{
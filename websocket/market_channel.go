@@ -5,20 +5,91 @@ import (
 	"fmt"
 	"github.com/HydroProtocol/hydro-sdk-backend/common"
 	"github.com/HydroProtocol/hydro-sdk-backend/utils"
+	"github.com/shopspring/decimal"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a failed resync is retried after resyncBackoff, doubled for every failed attempt
+	resyncBackoff = 100 * time.Millisecond
+
+	// resync stops after maxResyncAttempts attempts without an orderbook in sync, until a new client subscribes
+	maxResyncAttempts = 5
 )
 
 type marketChannel struct {
 	*Channel
 	MarketID  string
 	Orderbook *Orderbook
+
+	// used to fetch a new snapshot when the orderbook is out of sync
+	fetcher SnapshotFetcher
+
+	// orderbook changes are not sent to clients until a resync succeeds
+	outOfSync      bool
+	resyncAttempts int
+	nextResyncAt   time.Time
+
+	// clients who subscribe an aggregated orderbook
+	aggregations     map[string]*orderbookAggregation
+	aggregationsLock sync.Mutex
+}
+
+type orderbookAggregation struct {
+	tickSize decimal.Decimal
+	maxDepth int
+}
+
+func (a *orderbookAggregation) key() string {
+	return fmt.Sprintf("%s-%d", a.tickSize.String(), a.maxDepth)
+}
+
+// setAggregation should be called before the client is added as a subscriber
+func (c *marketChannel) setAggregation(clientID string, tickSize decimal.Decimal, maxDepth int) {
+	c.aggregationsLock.Lock()
+	defer c.aggregationsLock.Unlock()
+
+	c.aggregations[clientID] = &orderbookAggregation{tickSize: tickSize, maxDepth: maxDepth}
+}
+
+func (c *marketChannel) getAggregation(clientID string) *orderbookAggregation {
+	c.aggregationsLock.Lock()
+	defer c.aggregationsLock.Unlock()
+
+	return c.aggregations[clientID]
+}
+
+func (c *marketChannel) handleUnsubscriber(ID string) {
+	c.Channel.handleUnsubscriber(ID)
+
+	c.aggregationsLock.Lock()
+	defer c.aggregationsLock.Unlock()
+
+	delete(c.aggregations, ID)
+}
+
+func (c *marketChannel) snapshotMessage(clientID string) *orderbookLevel2Snapshot {
+	var snapshot *common.SnapshotV2
+	if aggregation := c.getAggregation(clientID); aggregation != nil {
+		snapshot = c.Orderbook.AggregatedSnapshotV2(aggregation.tickSize, aggregation.maxDepth)
+	} else {
+		snapshot = c.Orderbook.SnapshotV2()
+	}
+
+	return newOrderbookLevel2Snapshot(c.MarketID, snapshot.Bids, snapshot.Asks)
 }
 
 func (c *marketChannel) handleSubscriber(client *Client) {
 	c.Channel.handleSubscriber(client)
-	snapshot := c.Orderbook.SnapshotV2()
 
-	msg := newOrderbookLevel2Snapshot(c.MarketID, snapshot.Bids, snapshot.Asks)
+	// a resync which is given up is tried again for new clients
+	if c.outOfSync {
+		c.resyncAttempts = 0
+	}
+
+	msg := c.snapshotMessage(client.ID)
 
 	err := client.Send(msg)
 
@@ -38,49 +109,151 @@ func (c *marketChannel) handleMessage(msg *common.WebSocketMessage) {
 
 	var messageToBeSent interface{}
 
+	// aggregated subscribers receive a new aggregated snapshot for every orderbook change
+	var aggregatedMessages map[string]interface{}
+
 	switch commonPayload.Type {
 	case common.WsTypeNewMarketTrade:
 		var p common.WebsocketMarketNewMarketTradePayload
 		_ = json.Unmarshal(bts, &p)
 		messageToBeSent = &p
+	case common.WsTypeAuctionIndicative:
+		var p common.WebsocketMarketAuctionPayload
+		_ = json.Unmarshal(bts, &p)
+		messageToBeSent = &p
+	case common.WsTypeMarketStatus:
+		var p common.WebsocketMarketStatusPayload
+		_ = json.Unmarshal(bts, &p)
+		messageToBeSent = &p
 	default:
 		var p common.WebsocketMarketOrderChangePayload
 		_ = json.Unmarshal(bts, &p)
 
+		if c.outOfSync && !c.resync() {
+			return
+		}
+
 		// if current message is already aggregated in orderbook, skip it
 		if p.Sequence <= c.Orderbook.Sequence {
 			return
 		}
 
-		res := c.Orderbook.onMessage(&p)
+		res, err := c.Orderbook.onMessage(&p)
+
+		// the change doesn't fit the orderbook, e.g. a message is lost
+		if err != nil {
+			utils.Errorf("apply orderbook change error, market: %s, sequence: %d, resync from snapshot: %v", c.MarketID, p.Sequence, err)
+			c.outOfSync = true
+			c.resync()
+			return
+		}
+
+		// the orderbook drifted from the engine, rebuild it and send every client a new snapshot.
+		// messages without checksum are not verified
+		if p.Checksum != 0 && !c.Orderbook.VerifyChecksum(p.Checksum) {
+			utils.Errorf("orderbook checksum mismatch, market: %s, sequence: %d, resync from snapshot", c.MarketID, p.Sequence)
+			c.outOfSync = true
+			c.resync()
+			return
+		}
+
+		// the orderbook is in sync, the next mismatch is resynced at once
+		c.resyncAttempts = 0
+		c.nextResyncAt = time.Time{}
 
-		messageToBeSent = newOrderbookLevel2Update(c.MarketID, res.Side, res.Price.String(), res.Amount.String())
+		messageToBeSent = newOrderbookLevel2Update(c.MarketID, res.Side, res.Price.String(), res.Amount.String(), c.Orderbook.Checksum())
+		aggregatedMessages = make(map[string]interface{})
 	}
 
 	for _, client := range c.Clients {
-		err := client.Send(messageToBeSent)
+		msg := messageToBeSent
+
+		if aggregation := c.getAggregation(client.ID); aggregation != nil && aggregatedMessages != nil {
+			if _, exist := aggregatedMessages[aggregation.key()]; !exist {
+				snapshot := c.Orderbook.AggregatedSnapshotV2(aggregation.tickSize, aggregation.maxDepth)
+				aggregatedMessages[aggregation.key()] = newOrderbookLevel2Snapshot(c.MarketID, snapshot.Bids, snapshot.Asks)
+			}
+
+			msg = aggregatedMessages[aggregation.key()]
+		}
+
+		err := client.Send(msg)
 
 		if err != nil {
 			utils.Debugf("send message to client error: %v", err)
 			c.handleUnsubscriber(client.ID)
 		} else {
-			utils.Debugf("send market message to client, client: %s, channel: %s, msg: %v", client.ID, c.ID, messageToBeSent)
+			utils.Debugf("send market message to client, client: %s, channel: %s, msg: %v", client.ID, c.ID, msg)
 		}
 	}
 }
 
+// resync rebuilds the orderbook from a new snapshot and sends it to every client, it returns whether it succeeds.
+// Attempts are made by the messages of the channel, every attempt waits for the backoff of the one before it.
+func (c *marketChannel) resync() bool {
+	if c.resyncAttempts >= maxResyncAttempts || time.Now().Before(c.nextResyncAt) {
+		return false
+	}
+
+	c.resyncAttempts++
+	c.nextResyncAt = time.Now().Add(resyncBackoff << uint(c.resyncAttempts-1))
+
+	snapshot, err := c.fetchSnapshot()
+
+	if err != nil {
+		utils.Errorf("resync orderbook error, market: %s, attempt: %d, error: %v", c.MarketID, c.resyncAttempts, err)
+
+		if c.resyncAttempts == maxResyncAttempts {
+			utils.Errorf("stop resync orderbook of market %s after %d attempts", c.MarketID, c.resyncAttempts)
+		}
+
+		return false
+	}
+
+	c.Orderbook = initOrderbook(c.MarketID, snapshot)
+	c.outOfSync = false
+
+	for _, client := range c.Clients {
+		err := client.Send(c.snapshotMessage(client.ID))
+
+		if err != nil {
+			utils.Debugf("send message to client error: %v", err)
+			c.handleUnsubscriber(client.ID)
+		}
+	}
+
+	return true
+}
+
+// fetchSnapshot uses FetchV2 if the fetcher implements SnapshotV2Fetcher, a nil snapshot of GetV2 is an error
+func (c *marketChannel) fetchSnapshot() (*common.SnapshotV2, error) {
+	if fetcher, ok := c.fetcher.(SnapshotV2Fetcher); ok {
+		return fetcher.FetchV2(c.MarketID)
+	}
+
+	snapshot := c.fetcher.GetV2(c.MarketID)
+	if snapshot == nil {
+		return nil, fmt.Errorf("no orderbook snapshot of market %s", c.MarketID)
+	}
+
+	return snapshot, nil
+}
+
 func NewMarketChannelCreator(fetcher SnapshotFetcher) func(channelID string) IChannel {
 	return func(channelID string) IChannel {
 		marketID := strings.Replace(channelID, fmt.Sprintf("%s#", common.MarketChannelPrefix), "", -1)
 
 		channel := &marketChannel{
-			MarketID: marketID,
-			Channel:  createBaseChannel(channelID),
+			MarketID:     marketID,
+			Channel:      createBaseChannel(channelID),
+			aggregations: make(map[string]*orderbookAggregation),
+			fetcher:      fetcher,
+			Orderbook:    initOrderbook(marketID, &common.SnapshotV2{}),
+			outOfSync:    true,
 		}
 
-		snapshot := fetcher.GetV2(marketID)
-
-		channel.Orderbook = initOrderbook(marketID, snapshot)
+		// if the snapshot can't be fetched, the channel starts empty and resyncs on messages
+		channel.resync()
 
 		return channel
 	}
@@ -0,0 +1,187 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/HydroProtocol/hydro-sdk-backend/common"
+	"github.com/HydroProtocol/hydro-sdk-backend/utils"
+	"strings"
+)
+
+// marketL3Channel keeps every order of a market in memory,
+// new subscribers receive a per order snapshot, then every order change.
+type marketL3Channel struct {
+	*Channel
+	MarketID  string
+	Orderbook *common.Orderbook
+	Sequence  uint64
+
+	// used to fetch a new snapshot when the orderbook is out of sync
+	fetcher L3SnapshotFetcher
+
+	// order changes are not sent to clients until a resync succeeds
+	outOfSync bool
+}
+
+func (c *marketL3Channel) handleSubscriber(client *Client) {
+	c.Channel.handleSubscriber(client)
+	snapshot := c.Orderbook.SnapshotL3()
+
+	msg := newOrderbookLevel3Snapshot(c.MarketID, snapshot.Bids, snapshot.Asks)
+
+	err := client.Send(msg)
+
+	if err != nil {
+		utils.Debugf("send message to client error: %v", err)
+		c.handleUnsubscriber(client.ID)
+	}
+}
+
+func (c *marketL3Channel) handleMessage(msg *common.WebSocketMessage) {
+	var p common.WebsocketMarketL3OrderChangePayload
+
+	bts, _ := json.Marshal(msg.Payload)
+	_ = json.Unmarshal(bts, &p)
+
+	if c.outOfSync && !c.resync() {
+		return
+	}
+
+	// if current message is already applied in orderbook, skip it
+	if p.Sequence <= c.Sequence {
+		return
+	}
+
+	// the change doesn't fit the orderbook, e.g. a message is lost, rebuild it and send every client a new snapshot
+	if err := c.onMessage(&p); err != nil {
+		utils.Errorf("apply l3 orderbook change error, market: %s, sequence: %d, resync from snapshot: %v", c.MarketID, p.Sequence, err)
+		c.outOfSync = true
+		c.resync()
+		return
+	}
+
+	messageToBeSent := newOrderbookLevel3Update(c.MarketID, p.Action, p.OrderID, p.Side, p.Price, p.Amount)
+
+	for _, client := range c.Clients {
+		err := client.Send(messageToBeSent)
+
+		if err != nil {
+			utils.Debugf("send message to client error: %v", err)
+			c.handleUnsubscriber(client.ID)
+		} else {
+			utils.Debugf("send market l3 message to client, client: %s, channel: %s, msg: %v", client.ID, c.ID, messageToBeSent)
+		}
+	}
+}
+
+// onMessage applies an order change, it returns an error without changing the orderbook if the order of a change is unknown
+func (c *marketL3Channel) onMessage(p *common.WebsocketMarketL3OrderChangePayload) error {
+	price := utils.StringToDecimal(p.Price)
+	amount := utils.StringToDecimal(p.Amount)
+
+	order, exist := c.Orderbook.GetOrder(p.OrderID, p.Side, price)
+
+	switch p.Action {
+	case common.OrderbookEventAdd:
+		c.Orderbook.InsertOrder(&common.MemoryOrder{
+			ID:     p.OrderID,
+			Side:   p.Side,
+			Price:  price,
+			Amount: amount,
+		})
+	case common.OrderbookEventChange:
+		if !exist {
+			return fmt.Errorf("can't find order in l3 orderbook, change payload is %v", p)
+		}
+
+		changedAmount := amount.Sub(order.Amount)
+		order.Amount = amount
+		c.Orderbook.ChangeOrder(order, changedAmount)
+	case common.OrderbookEventRequeue:
+		if exist {
+			c.Orderbook.RemoveOrder(order)
+		}
+
+		c.Orderbook.InsertOrder(&common.MemoryOrder{
+			ID:     p.OrderID,
+			Side:   p.Side,
+			Price:  price,
+			Amount: amount,
+		})
+	case common.OrderbookEventRemove:
+		if exist {
+			c.Orderbook.RemoveOrder(order)
+		}
+	}
+
+	c.Sequence = p.Sequence
+
+	return nil
+}
+
+// resync rebuilds the orderbook from a new snapshot and sends it to every client, it returns whether it succeeds
+func (c *marketL3Channel) resync() bool {
+	snapshot := c.fetcher.SnapshotL3(c.MarketID)
+	if snapshot == nil {
+		utils.Errorf("resync l3 orderbook error, market: %s, no snapshot", c.MarketID)
+		return false
+	}
+
+	c.Orderbook = initL3Orderbook(c.MarketID, snapshot)
+	c.Sequence = snapshot.Sequence
+	c.outOfSync = false
+
+	msg := newOrderbookLevel3Snapshot(c.MarketID, snapshot.Bids, snapshot.Asks)
+
+	for _, client := range c.Clients {
+		err := client.Send(msg)
+
+		if err != nil {
+			utils.Debugf("send message to client error: %v", err)
+			c.handleUnsubscriber(client.ID)
+		}
+	}
+
+	return true
+}
+
+func initL3Orderbook(marketID string, snapshot *common.SnapshotL3) *common.Orderbook {
+	orderbook := common.NewOrderbook(marketID)
+
+	insert := func(side string, orders []*common.SnapshotL3Order) {
+		for _, o := range orders {
+			orderbook.InsertOrder(&common.MemoryOrder{
+				ID:     o.ID,
+				Side:   side,
+				Price:  utils.StringToDecimal(o.Price),
+				Amount: utils.StringToDecimal(o.Amount),
+			})
+		}
+	}
+
+	insert("buy", snapshot.Bids)
+	insert("sell", snapshot.Asks)
+
+	return orderbook
+}
+
+func NewMarketL3ChannelCreator(fetcher L3SnapshotFetcher) func(channelID string) IChannel {
+	return func(channelID string) IChannel {
+		marketID := strings.Replace(channelID, fmt.Sprintf("%s#", common.MarketL3ChannelPrefix), "", -1)
+
+		snapshot := fetcher.SnapshotL3(marketID)
+		if snapshot == nil {
+			snapshot = &common.SnapshotL3{}
+		}
+
+		channel := &marketL3Channel{
+			MarketID:  marketID,
+			Channel:   createBaseChannel(channelID),
+			Orderbook: initL3Orderbook(marketID, snapshot),
+			Sequence:  snapshot.Sequence,
+			fetcher:   fetcher,
+		}
+
+		return channel
+	}
+}
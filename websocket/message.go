@@ -1,10 +1,14 @@
 package websocket
 
+import "github.com/HydroProtocol/hydro-sdk-backend/common"
+
+// Checksum lets clients verify the orderbook they rebuilt, see common.SnapshotChecksum
 type orderbookLevel2Snapshot struct {
 	Type     string      `json:"type"`
 	MarketID string      `json:"marketID"`
 	Bids     [][2]string `json:"bids"`
 	Asks     [][2]string `json:"asks"`
+	Checksum uint32      `json:"checksum"`
 }
 
 func newOrderbookLevel2Snapshot(marketID string, bids, asks [][2]string) *orderbookLevel2Snapshot {
@@ -13,6 +17,7 @@ func newOrderbookLevel2Snapshot(marketID string, bids, asks [][2]string) *orderb
 		Asks:     asks,
 		MarketID: marketID,
 		Type:     "level2OrderbookSnapshot",
+		Checksum: common.SnapshotChecksum(bids, asks),
 	}
 }
 
@@ -22,14 +27,54 @@ type orderbookLevel2Update struct {
 	Price    string `json:"price"`
 	Side     string `json:"side"`
 	Amount   string `json:"amount"`
+	Checksum uint32 `json:"checksum"`
 }
 
-func newOrderbookLevel2Update(marketID string, side, price, amount string) *orderbookLevel2Update {
+func newOrderbookLevel2Update(marketID string, side, price, amount string, checksum uint32) *orderbookLevel2Update {
 	return &orderbookLevel2Update{
 		Type:     "level2OrderbookUpdate",
 		MarketID: marketID,
 		Side:     side,
 		Price:    price,
 		Amount:   amount,
+		Checksum: checksum,
+	}
+}
+
+type orderbookLevel3Snapshot struct {
+	Type     string                    `json:"type"`
+	MarketID string                    `json:"marketID"`
+	Bids     []*common.SnapshotL3Order `json:"bids"`
+	Asks     []*common.SnapshotL3Order `json:"asks"`
+}
+
+func newOrderbookLevel3Snapshot(marketID string, bids, asks []*common.SnapshotL3Order) *orderbookLevel3Snapshot {
+	return &orderbookLevel3Snapshot{
+		Bids:     bids,
+		Asks:     asks,
+		MarketID: marketID,
+		Type:     "level3OrderbookSnapshot",
+	}
+}
+
+type orderbookLevel3Update struct {
+	Type     string `json:"type"`
+	MarketID string `json:"marketID"`
+	Action   string `json:"action"`
+	OrderID  string `json:"orderID"`
+	Price    string `json:"price"`
+	Side     string `json:"side"`
+	Amount   string `json:"amount"`
+}
+
+func newOrderbookLevel3Update(marketID string, action, orderID, side, price, amount string) *orderbookLevel3Update {
+	return &orderbookLevel3Update{
+		Type:     "level3OrderbookUpdate",
+		MarketID: marketID,
+		Action:   action,
+		OrderID:  orderID,
+		Side:     side,
+		Price:    price,
+		Amount:   amount,
 	}
 }
@@ -53,7 +53,9 @@ func initOrderbook(marketID string, snapshot *common.SnapshotV2) *Orderbook {
 	return orderbook
 }
 
-func (o *Orderbook) onMessage(payload *common.WebsocketMarketOrderChangePayload) *OnMessageResult {
+// onMessage applies a change of a price level, it returns an error without changing the orderbook
+// if the change doesn't fit it, e.g. a missing level is reduced
+func (o *Orderbook) onMessage(payload *common.WebsocketMarketOrderChangePayload) (*OnMessageResult, error) {
 	o.lock.Lock()
 	defer o.lock.Unlock()
 
@@ -63,37 +65,47 @@ func (o *Orderbook) onMessage(payload *common.WebsocketMarketOrderChangePayload)
 	}
 
 	orderID := fmt.Sprintf("%s-%s", payload.Side, payload.Price)
+	changedAmount := utils.StringToDecimal(payload.Amount)
 
 	if order, ok := o.Orderbook.GetOrder(orderID, payload.Side, utils.StringToDecimal(payload.Price)); ok {
-		changedAmount := utils.StringToDecimal(payload.Amount)
-		order.Amount = order.Amount.Add(changedAmount)
-		priceLevelAmountAfterChange := order.Amount
+		priceLevelAmountAfterChange := order.Amount.Add(changedAmount)
+
+		if priceLevelAmountAfterChange.LessThan(decimal.Zero) {
+			return nil, fmt.Errorf("price level amount %s can't change by %s, change payload is %v", order.Amount.String(), payload.Amount, payload)
+		}
+
+		order.Amount = priceLevelAmountAfterChange
 		res.Amount = priceLevelAmountAfterChange
 
-		if priceLevelAmountAfterChange.LessThanOrEqual(decimal.Zero) {
+		if priceLevelAmountAfterChange.Equal(decimal.Zero) {
 			o.Orderbook.RemoveOrder(order)
 		} else {
 			o.Orderbook.ChangeOrder(order, changedAmount)
 		}
 	} else {
-		//s := o.SnapshotV2()
-		//s.Sequence = o.Sequence
+		if !changedAmount.IsPositive() {
+			return nil, fmt.Errorf("can't find order in orderbook, change payload is %v", payload)
+		}
 
 		o.Orderbook.InsertOrder(&common.MemoryOrder{
 			ID:     orderID,
 			Price:  utils.StringToDecimal(payload.Price),
-			Amount: utils.StringToDecimal(payload.Amount),
+			Amount: changedAmount,
 			Side:   payload.Side,
 		})
 
-		if utils.StringToDecimal(payload.Amount).LessThan(decimal.Zero) {
-			panic(fmt.Errorf("Can't find order in orderbook, change payload is %v", payload))
-		}
-
-		res.Amount = utils.StringToDecimal(payload.Amount)
+		res.Amount = changedAmount
 	}
 
 	o.Sequence = payload.Sequence
 
-	return res
+	return res, nil
+}
+
+// VerifyChecksum reports whether the orderbook is the same as the one checksum is computed from
+func (o *Orderbook) VerifyChecksum(checksum uint32) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return o.Orderbook.Checksum() == checksum
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"github.com/HydroProtocol/hydro-sdk-backend/utils"
 	"github.com/gorilla/websocket"
+	"github.com/shopspring/decimal"
 	"log"
 	"net/http"
 )
@@ -12,6 +13,10 @@ import (
 type ClientRequest struct {
 	Type     string
 	Channels []string
+
+	// optional, subscribe market channels with an aggregated orderbook
+	TickSize string
+	Depth    int
 }
 
 func handleClientRequest(client *Client) {
@@ -44,9 +49,22 @@ func handleClientRequest(client *Client) {
 					channel = createChannelByID(id)
 				}
 
-				if channel != nil {
-					channel.AddSubscriber(client)
+				if channel == nil {
+					continue
+				}
+
+				if marketChannel, ok := channel.(*marketChannel); ok && req.TickSize != "" {
+					tickSize, err := decimal.NewFromString(req.TickSize)
+
+					if err != nil || !tickSize.IsPositive() {
+						utils.Errorf("invalid tick size: %s", req.TickSize)
+						continue
+					}
+
+					marketChannel.setAggregation(client.ID, tickSize, req.Depth)
 				}
+
+				channel.AddSubscriber(client)
 			}
 		case "unsubscribe":
 			for _, id := range req.Channels {
@@ -12,21 +12,50 @@ type SnapshotFetcher interface {
 	GetV2(marketID string) *common.SnapshotV2
 }
 
+// SnapshotV2Fetcher is implemented by snapshot fetchers which return why a snapshot can't be fetched.
+// Market channels use FetchV2 instead of GetV2 if their fetcher implements it.
+type SnapshotV2Fetcher interface {
+	FetchV2(marketID string) (*common.SnapshotV2, error)
+}
+
+// L3SnapshotFetcher fetches the per order snapshot for market L3 channels, nil if the market has no orderbook.
+// The api serves no per order snapshot, *engine.Engine implements it for a server in the process of the engine.
+type L3SnapshotFetcher interface {
+	SnapshotL3(marketID string) *common.SnapshotL3
+}
+
 type DefaultHttpSnapshotFetcher struct {
 	ApiUrl string
 }
 
+// GetV2 panics if the snapshot can't be fetched, see FetchV2
 func (f *DefaultHttpSnapshotFetcher) GetV2(marketID string) *common.SnapshotV2 {
-	res, err := http.Get(fmt.Sprintf("%s/markets/%s/orderbook", f.ApiUrl, marketID))
+	snapshot, err := f.FetchV2(marketID)
 
 	if err != nil {
 		panic(err)
 	}
 
+	return snapshot
+}
+
+func (f *DefaultHttpSnapshotFetcher) FetchV2(marketID string) (*common.SnapshotV2, error) {
+	res, err := http.Get(fmt.Sprintf("%s/markets/%s/orderbook", f.ApiUrl, marketID))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get orderbook snapshot of market %s: http status %d", marketID, res.StatusCode)
+	}
+
 	bts, err := ioutil.ReadAll(res.Body)
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	var resStruct struct {
@@ -39,8 +68,12 @@ func (f *DefaultHttpSnapshotFetcher) GetV2(marketID string) *common.SnapshotV2 {
 	err = json.Unmarshal(bts, &resStruct)
 
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	if resStruct.Data.Orderbook == nil {
+		return nil, fmt.Errorf("get orderbook snapshot of market %s: no orderbook in response", marketID)
 	}
 
-	return resStruct.Data.Orderbook
+	return resStruct.Data.Orderbook, nil
 }
@@ -11,7 +11,8 @@ type MockSnapshotFetcher struct {
 
 func (m *MockSnapshotFetcher) GetV2(marketID string) *common.SnapshotV2 {
 	args := m.Called(marketID)
-	return args.Get(0).(*common.SnapshotV2)
+	snapshot, _ := args.Get(0).(*common.SnapshotV2)
+	return snapshot
 }
 
 func NewMockSnapshotFetcher(expectedSnapshot *common.SnapshotV2) *MockSnapshotFetcher {
@@ -19,3 +20,30 @@ func NewMockSnapshotFetcher(expectedSnapshot *common.SnapshotV2) *MockSnapshotFe
 	fetcher.On("GetV2", mock.Anything).Return(expectedSnapshot)
 	return fetcher
 }
+
+// MockSnapshotV2Fetcher returns errors by FetchV2
+type MockSnapshotV2Fetcher struct {
+	MockSnapshotFetcher
+}
+
+func (m *MockSnapshotV2Fetcher) FetchV2(marketID string) (*common.SnapshotV2, error) {
+	args := m.Called(marketID)
+	snapshot, _ := args.Get(0).(*common.SnapshotV2)
+	return snapshot, args.Error(1)
+}
+
+type MockL3SnapshotFetcher struct {
+	mock.Mock
+}
+
+func (m *MockL3SnapshotFetcher) SnapshotL3(marketID string) *common.SnapshotL3 {
+	args := m.Called(marketID)
+	snapshot, _ := args.Get(0).(*common.SnapshotL3)
+	return snapshot
+}
+
+func NewMockL3SnapshotFetcher(expectedSnapshot *common.SnapshotL3) *MockL3SnapshotFetcher {
+	fetcher := new(MockL3SnapshotFetcher)
+	fetcher.On("SnapshotL3", mock.Anything).Return(expectedSnapshot)
+	return fetcher
+}